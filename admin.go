@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/cosiner/tunnel/proxy"
+	"github.com/cosiner/tunnel/server"
+)
+
+func (a *app) runAdmin(addr, token string) error {
+	return server.RunAdmin(addr, &server.Admin{
+		Token: token,
+		Tunnels: func() []*server.TunnelNode {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			return a.tunnels
+		},
+		Config: func() interface{} {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			return redactConfig(a.cfg)
+		},
+		Reload: a.reload,
+	}, a.servers)
+}
+
+// secret fields of config, values are masked
+var secretFields = map[string]bool{
+	"key":   true,
+	"pass":  true,
+	"token": true,
+}
+
+const _REDACTED = "******"
+
+// redactConfig returns config with secrets masked, passwords of users are
+// masked and tunnel keys of limits are replaced by key ids.
+func redactConfig(cfg *Config) interface{} {
+	var v interface{}
+	data, _ := json.Marshal(cfg)
+	json.Unmarshal(data, &v)
+	redact(v)
+	return v
+}
+
+func redact(v interface{}) {
+	switch v := v.(type) {
+	case []interface{}:
+		for _, e := range v {
+			redact(e)
+		}
+	case map[string]interface{}:
+		for name, e := range v {
+			switch m, _ := e.(map[string]interface{}); {
+			case secretFields[name] && e != "":
+				v[name] = _REDACTED
+			case name == "userPass":
+				for user := range m {
+					m[user] = _REDACTED
+				}
+			case name == "keys" && m != nil:
+				ids := make(map[string]interface{}, len(m))
+				for key, e := range m {
+					ids[proxy.KeyID(key)] = e
+				}
+				v[name] = ids
+			default:
+				redact(e)
+			}
+		}
+	}
+}
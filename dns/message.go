@@ -0,0 +1,134 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+)
+
+const (
+	TYPE_A    uint16 = 1
+	TYPE_AAAA uint16 = 28
+
+	_CLASS_IN uint16 = 1
+
+	_HEADER_LEN   = 12
+	_FLAG_RD      = 0x0100 // recursion desired
+	_FLAG_TC      = 0x0200 // truncated
+	_FLAG_QR      = 0x8000 // response
+	_RCODE_MASK   = 0x000f
+	_RCODE_NXNAME = 3
+)
+
+var (
+	ErrBadMessage = errors.New("bad dns message")
+	ErrIDMismatch = errors.New("dns message id mismatch")
+	ErrTruncated  = errors.New("dns message truncated")
+	ErrNoRecords  = errors.New("no such records")
+	ErrNameError  = errors.New("no such domain")
+)
+
+// NewQuery build a query message for name and record type.
+// | ID 2 | Flags 2 | QDCount 2 | ANCount 2 | NSCount 2 | ARCount 2 | Question |
+func NewQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if len(name) == 0 || len(name) > 253 {
+		return nil, ErrBadMessage
+	}
+
+	msg := make([]byte, _HEADER_LEN, _HEADER_LEN+len(name)+2+4)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	binary.BigEndian.PutUint16(msg[2:], _FLAG_RD)
+	binary.BigEndian.PutUint16(msg[4:], 1)
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, ErrBadMessage
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0, byte(qtype>>8), byte(qtype), byte(_CLASS_IN>>8), byte(_CLASS_IN))
+	return msg, nil
+}
+
+// ParseResponse parse the A and AAAA records of a response, ttl is the
+// minimum ttl of records in seconds.
+func ParseResponse(id uint16, msg []byte) (ips []net.IP, ttl uint32, err error) {
+	if len(msg) < _HEADER_LEN {
+		return nil, 0, ErrBadMessage
+	}
+	if binary.BigEndian.Uint16(msg[0:]) != id {
+		return nil, 0, ErrIDMismatch
+	}
+	flags := binary.BigEndian.Uint16(msg[2:])
+	if flags&_FLAG_QR == 0 {
+		return nil, 0, ErrBadMessage
+	}
+	if flags&_FLAG_TC != 0 {
+		return nil, 0, ErrTruncated
+	}
+	switch flags & _RCODE_MASK {
+	case 0:
+	case _RCODE_NXNAME:
+		return nil, 0, ErrNameError
+	default:
+		return nil, 0, errors.New("dns server failure")
+	}
+
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:]))
+	i := _HEADER_LEN
+	for ; qdcount > 0; qdcount-- {
+		if i, err = skipName(msg, i); err != nil {
+			return nil, 0, err
+		}
+		i += 4
+	}
+
+	// | Name dynamic | Type 2 | Class 2 | TTL 4 | RDLen 2 | RData RDLen |
+	for ; ancount > 0; ancount-- {
+		if i, err = skipName(msg, i); err != nil {
+			return nil, 0, err
+		}
+		if i+10 > len(msg) {
+			return nil, 0, ErrBadMessage
+		}
+		typ := binary.BigEndian.Uint16(msg[i:])
+		rttl := binary.BigEndian.Uint32(msg[i+4:])
+		rdlen := int(binary.BigEndian.Uint16(msg[i+8:]))
+		i += 10
+		if i+rdlen > len(msg) {
+			return nil, 0, ErrBadMessage
+		}
+
+		if (typ == TYPE_A && rdlen == net.IPv4len) || (typ == TYPE_AAAA && rdlen == net.IPv6len) {
+			ip := make(net.IP, rdlen)
+			copy(ip, msg[i:i+rdlen])
+			ips = append(ips, ip)
+			if len(ips) == 1 || rttl < ttl {
+				ttl = rttl
+			}
+		}
+		i += rdlen
+	}
+	if len(ips) == 0 {
+		return nil, 0, ErrNoRecords
+	}
+	return ips, ttl, nil
+}
+
+func skipName(msg []byte, i int) (int, error) {
+	for i < len(msg) {
+		l := msg[i]
+		switch {
+		case l == 0:
+			return i + 1, nil
+		case l&0xc0 == 0xc0: // compression pointer
+			return i + 2, nil
+		default:
+			i += int(l) + 1
+		}
+	}
+	return 0, ErrBadMessage
+}
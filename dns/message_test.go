@@ -0,0 +1,51 @@
+package dns
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cosiner/gohper/testing2"
+)
+
+func TestParseResponse(t *testing.T) {
+	query, err := NewQuery(0x1234, "www.example.com.", TYPE_A)
+	testing2.True(t, err == nil)
+
+	resp := append([]byte{}, query...)
+	binary.BigEndian.PutUint16(resp[2:], _FLAG_QR|_FLAG_RD)
+	binary.BigEndian.PutUint16(resp[6:], 3)
+	// CNAME www.example.com -> example.com, then A records by compression
+	resp = append(resp, 0xc0, 12, 0, 5, 0, 1, 0, 0, 0, 100, 0, 2, 0xc0, 16)
+	resp = append(resp, 0xc0, 16, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 1, 2, 3, 4)
+	resp = append(resp, 0xc0, 16, 0, 1, 0, 1, 0, 0, 0, 30, 0, 4, 5, 6, 7, 8)
+
+	ips, ttl, err := ParseResponse(0x1234, resp)
+	testing2.True(t, err == nil)
+	testing2.True(t, len(ips) == 2 && ips[0].Equal(net.IPv4(1, 2, 3, 4)) && ips[1].Equal(net.IPv4(5, 6, 7, 8)))
+	testing2.True(t, ttl == 30)
+
+	_, _, err = ParseResponse(0x4321, resp)
+	testing2.True(t, err == ErrIDMismatch)
+
+	binary.BigEndian.PutUint16(resp[2:], _FLAG_QR|_RCODE_NXNAME)
+	_, _, err = ParseResponse(0x1234, resp)
+	testing2.True(t, err == ErrNameError)
+
+	_, _, err = ParseResponse(0x1234, query)
+	testing2.True(t, err == ErrBadMessage)
+}
+
+func TestCache(t *testing.T) {
+	c := NewCache(1)
+	c.Put("a.com", []net.IP{net.IPv4(1, 1, 1, 1)}, nil, time.Minute)
+	ips, _, has := c.Get("a.com")
+	testing2.True(t, has && len(ips) == 1)
+
+	c.Put("b.com", nil, ErrNoRecords, time.Minute)
+	_, _, has = c.Get("a.com")
+	testing2.False(t, has)
+	_, err, has := c.Get("b.com")
+	testing2.True(t, has && err == ErrNoRecords)
+}
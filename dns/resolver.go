@@ -0,0 +1,211 @@
+package dns
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	_MIN_TTL      = 10 * time.Second
+	_MAX_TTL      = time.Hour
+	_NEGATIVE_TTL = 30 * time.Second
+	_SYSTEM_TTL   = time.Minute
+)
+
+type cacheEntry struct {
+	ips    []net.IP
+	err    error
+	expire time.Time
+}
+
+// Cache is a ttl cache of lookup results shared by resolvers.
+type Cache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]cacheEntry
+}
+
+func NewCache(size int) *Cache {
+	return &Cache{
+		size:    size,
+		entries: make(map[string]cacheEntry),
+	}
+}
+
+func (c *Cache) Get(name string) (ips []net.IP, err error, has bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, has := c.entries[name]
+	if !has {
+		return nil, nil, false
+	}
+	if time.Now().After(e.expire) {
+		delete(c.entries, name)
+		return nil, nil, false
+	}
+	return e.ips, e.err, true
+}
+
+func (c *Cache) Put(name string, ips []net.IP, err error, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.entries) >= c.size {
+		now := time.Now()
+		for key, e := range c.entries {
+			if now.After(e.expire) {
+				delete(c.entries, key)
+			}
+		}
+		// still full, evict randomly
+		for key := range c.entries {
+			if len(c.entries) < c.size {
+				break
+			}
+			delete(c.entries, key)
+		}
+	}
+	c.entries[name] = cacheEntry{ips: ips, err: err, expire: time.Now().Add(ttl)}
+}
+
+// Resolver lookup ip addresses of host from Hosts, Cache and Upstreams in
+// order, upstreams are tried one by one until succeed. The system resolver is
+// used if there is no upstreams.
+type Resolver struct {
+	Upstreams []Upstream
+	Hosts     map[string][]net.IP
+	Cache     *Cache
+	Timeout   time.Duration
+}
+
+// Lookup returns ipv4 addresses of host if there are, otherwise ipv6
+// addresses.
+func (r *Resolver) Lookup(host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if ips, has := r.Hosts[host]; has {
+		return ips, nil
+	}
+	if r.Cache != nil {
+		if ips, err, has := r.Cache.Get(host); has {
+			return ips, err
+		}
+	}
+
+	ips, ttl, err := r.query(host, TYPE_A)
+	if err == ErrNoRecords {
+		ips, ttl, err = r.query(host, TYPE_AAAA)
+	}
+	if r.Cache != nil {
+		switch err {
+		case nil:
+			r.Cache.Put(host, ips, nil, ttl)
+		case ErrNoRecords, ErrNameError:
+			r.Cache.Put(host, nil, err, _NEGATIVE_TTL)
+		}
+	}
+	return ips, err
+}
+
+// newQueryID returns an unpredictable id, so responses can't be forged by
+// guessing it.
+func newQueryID() (uint16, error) {
+	var b [2]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(b[:]), nil
+}
+
+func (r *Resolver) query(host string, qtype uint16) (ips []net.IP, ttl time.Duration, err error) {
+	if len(r.Upstreams) == 0 {
+		return r.querySystem(host, qtype)
+	}
+
+	id, err := newQueryID()
+	if err != nil {
+		return nil, 0, err
+	}
+	query, err := NewQuery(id, host, qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, u := range r.Upstreams {
+		var resp []byte
+		resp, err = u.Exchange(query, r.Timeout)
+		if err != nil {
+			continue
+		}
+		var sec uint32
+		ips, sec, err = ParseResponse(id, resp)
+		if err == ErrTruncated {
+			if udp, ok := u.(udpUpstream); ok {
+				resp, err = tcpUpstream(udp).Exchange(query, r.Timeout)
+				if err == nil {
+					ips, sec, err = ParseResponse(id, resp)
+				}
+			}
+		}
+		switch err {
+		case nil:
+			ttl = time.Duration(sec) * time.Second
+			if ttl < _MIN_TTL {
+				ttl = _MIN_TTL
+			} else if ttl > _MAX_TTL {
+				ttl = _MAX_TTL
+			}
+			return ips, ttl, nil
+		case ErrNoRecords, ErrNameError:
+			// authoritative answers, other servers won't be different
+			return nil, 0, err
+		}
+	}
+	return nil, 0, err
+}
+
+func (r *Resolver) querySystem(host string, qtype uint16) (ips []net.IP, ttl time.Duration, err error) {
+	all, err := net.LookupIP(host)
+	if err != nil {
+		if e, ok := err.(*net.DNSError); ok && e.IsNotFound {
+			return nil, 0, ErrNameError
+		}
+		return nil, 0, err
+	}
+	for _, ip := range all {
+		if (ip.To4() != nil) == (qtype == TYPE_A) {
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, 0, ErrNoRecords
+	}
+	return ips, _SYSTEM_TTL, nil
+}
+
+// ParseHosts parse content in hosts file format.
+func ParseHosts(data string, hosts map[string][]net.IP) {
+	for _, line := range strings.Split(data, "\n") {
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			continue
+		}
+		for _, name := range fields[1:] {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			hosts[name] = append(hosts[name], ip)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package dns
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Upstream send a query message to dns server and returns the response.
+type Upstream interface {
+	Exchange(query []byte, timeout time.Duration) ([]byte, error)
+	String() string
+}
+
+// NewUpstream create upstream from url, supported schemes are udp, tcp,
+// tls(DNS-over-TLS) and https(DNS-over-HTTPS). A bare address is treated as
+// udp, default ports are used if absent.
+//
+//	8.8.8.8, udp://8.8.8.8:53, tcp://8.8.8.8, tls://1.1.1.1:853,
+//	https://dns.google/dns-query
+func NewUpstream(rawurl string) (Upstream, error) {
+	if !strings.Contains(rawurl, "://") {
+		rawurl = "udp://" + rawurl
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, errors.New("dns server address is empty: " + rawurl)
+	}
+
+	withPort := func(port string) string {
+		if u.Port() != "" {
+			return u.Host
+		}
+		return net.JoinHostPort(u.Hostname(), port)
+	}
+	switch u.Scheme {
+	case "udp":
+		return udpUpstream(withPort("53")), nil
+	case "tcp":
+		return tcpUpstream(withPort("53")), nil
+	case "tls":
+		return &tlsUpstream{
+			addr: withPort("853"),
+			config: &tls.Config{
+				ServerName: u.Hostname(),
+			},
+		}, nil
+	case "https":
+		return &httpsUpstream{
+			url: u.String(),
+			client: &http.Client{
+				Transport: &http.Transport{
+					Proxy:             nil,
+					ForceAttemptHTTP2: true,
+				},
+			},
+		}, nil
+	}
+	return nil, errors.New("unsupported dns server scheme: " + u.Scheme)
+}
+
+type udpUpstream string
+
+func (u udpUpstream) String() string {
+	return "udp://" + string(u)
+}
+
+func (u udpUpstream) Exchange(query []byte, timeout time.Duration) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", string(u), timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	_, err = conn.Write(query)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// drop responses of other queries
+		if n >= 2 && bytes.Equal(buf[:2], query[:2]) {
+			return buf[:n], nil
+		}
+	}
+}
+
+// | Len 2 | Message Len |
+func exchangeStream(conn net.Conn, query []byte, timeout time.Duration) ([]byte, error) {
+	conn.SetDeadline(time.Now().Add(timeout))
+	req := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(req, uint16(len(query)))
+	copy(req[2:], query)
+	_, err := conn.Write(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var l [2]byte
+	_, err = io.ReadFull(conn, l[:])
+	if err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(l[:]))
+	_, err = io.ReadFull(conn, resp)
+	return resp, err
+}
+
+type tcpUpstream string
+
+func (u tcpUpstream) String() string {
+	return "tcp://" + string(u)
+}
+
+func (u tcpUpstream) Exchange(query []byte, timeout time.Duration) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", string(u), timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return exchangeStream(conn, query, timeout)
+}
+
+type tlsUpstream struct {
+	addr   string
+	config *tls.Config
+}
+
+func (u *tlsUpstream) String() string {
+	return "tls://" + u.addr
+}
+
+func (u *tlsUpstream) Exchange(query []byte, timeout time.Duration) ([]byte, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", u.addr, u.config)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return exchangeStream(conn, query, timeout)
+}
+
+type httpsUpstream struct {
+	url    string
+	client *http.Client
+}
+
+func (u *httpsUpstream) String() string {
+	return u.url
+}
+
+func (u *httpsUpstream) Exchange(query []byte, timeout time.Duration) ([]byte, error) {
+	req, err := http.NewRequest("POST", u.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	client := *u.client
+	client.Timeout = timeout
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, 65535))
+}
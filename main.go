@@ -1,17 +1,27 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/cosiner/gohper/encoding"
 	"github.com/cosiner/gohper/terminal/color"
 	"github.com/cosiner/gohper/utils/encodeio"
+	"github.com/cosiner/tunnel/dns"
+	"github.com/cosiner/tunnel/mux"
 	"github.com/cosiner/tunnel/proxy"
 	"github.com/cosiner/tunnel/server"
+	"github.com/cosiner/tunnel/transport"
 	log "github.com/cosiner/ygo/jsonlog"
 )
 
@@ -23,15 +33,171 @@ type Config struct {
 	Socks []struct {
 		Addr     string            `json:"addr"`
 		UserPass map[string]string `json:"userPass"`
+		Group    string            `json:"group"`
 	} `json:"socks"`
 	Tunnels []struct {
-		Addr   string `json:"addr"`
-		Method string `json:"method"`
-		Key    string `json:"key"`
+		Addr      string `json:"addr"`
+		Method    string `json:"method"`
+		Key       string `json:"key"`
+		Weight    int    `json:"weight"`
+		Mux       int    `json:"mux"`
+		Pool      int    `json:"pool"`
+		HalfClose bool   `json:"halfClose"`
+
+		Transport struct {
+			Type     string `json:"type"`
+			Path     string `json:"path"`
+			Host     string `json:"host"`
+			Connect  string `json:"connect"`
+			Insecure bool   `json:"insecure"`
+			Cert     string `json:"cert"`
+			Key      string `json:"key"`
+			FastOpen bool   `json:"fastOpen"`
+
+			KCP struct {
+				SndWnd       int `json:"sndWnd"`
+				RcvWnd       int `json:"rcvWnd"`
+				MTU          int `json:"mtu"`
+				Interval     int `json:"interval"`
+				Timeout      int `json:"timeout"`
+				DataShards   int `json:"dataShards"`
+				ParityShards int `json:"parityShards"`
+			} `json:"kcp"`
+		} `json:"transport"`
 	} `json:"tunnels"`
+	Pool struct {
+		Idle int `json:"idle"`
+	} `json:"pool"`
+	Mux struct {
+		Window    int `json:"window"`
+		KeepAlive int `json:"keepAlive"`
+		Timeout   int `json:"timeout"`
+	} `json:"mux"`
+	Strategy string `json:"strategy"`
+	Retry    struct {
+		Attempts int  `json:"attempts"`
+		Deadline int  `json:"deadline"`
+		Direct   bool `json:"direct"`
+	} `json:"retry"`
+	Groups []struct {
+		Name     string   `json:"name"`
+		Members  []string `json:"members"`
+		Strategy string   `json:"strategy"`
+		Sites    []string `json:"sites"`
+	} `json:"groups"`
 	DirectSuffixes []string `json:"directSuffixes"`
 	DirectSites    []string `json:"directSites"`
 	TunnelSites    []string `json:"tunnelSites"`
+	RejectSites    []string `json:"rejectSites"`
+	RejectPorts    []uint16 `json:"rejectPorts"`
+	DirectIPs      []string `json:"directIPs"`
+	TunnelIPs      []string `json:"tunnelIPs"`
+	RejectIPs      []string `json:"rejectIPs"`
+	DNS            struct {
+		Servers   []string          `json:"servers"`
+		Hosts     map[string]string `json:"hosts"`
+		HostsFile string            `json:"hostsFile"`
+		CacheSize int               `json:"cacheSize"`
+		Timeout   int               `json:"timeout"`
+		Resolve   string            `json:"resolve"`
+	} `json:"dns"`
+	Lists []struct {
+		Mode    string `json:"mode"`
+		Url     string `json:"url"`
+		Format  string `json:"format"`
+		Cache   string `json:"cache"`
+		Refresh int    `json:"refresh"`
+	} `json:"lists"`
+	PublicSuffixList struct {
+		Url     string `json:"url"`
+		Cache   string `json:"cache"`
+		Refresh int    `json:"refresh"`
+	} `json:"publicSuffixList"`
+	Clients []struct {
+		Name        string   `json:"name"`
+		Users       []string `json:"users"`
+		Sources     []string `json:"sources"`
+		Route       string   `json:"route"`
+		DirectSites []string `json:"directSites"`
+		TunnelSites []string `json:"tunnelSites"`
+		RejectSites []string `json:"rejectSites"`
+		Tunnels     []string `json:"tunnels"`
+		Strategy    string   `json:"strategy"`
+		Group       string   `json:"group"`
+		MaxConns    int      `json:"maxConns"`
+		Resolve     string   `json:"resolve"`
+	} `json:"clients"`
+	HealthCheck struct {
+		Interval   int    `json:"interval"`
+		Timeout    int    `json:"timeout"`
+		Target     string `json:"target"`
+		Failures   int    `json:"failures"`
+		Backoff    int    `json:"backoff"`
+		MaxBackoff int    `json:"maxBackoff"`
+	} `json:"healthCheck"`
+	Reverse struct {
+		Token    string   `json:"token"`
+		Host     string   `json:"host"`
+		Ports    []uint16 `json:"ports"`
+		Bindings []struct {
+			Tunnel string `json:"tunnel"`
+			Port   uint16 `json:"port"`
+			Target string `json:"target"`
+		} `json:"bindings"`
+	} `json:"reverse"`
+	EarlyData int  `json:"earlyData"`
+	FastOpen  bool `json:"fastOpen"`
+	Linger    int  `json:"linger"`
+	Drain     int  `json:"drain"`
+	RateLimit struct {
+		Rate
+		Listeners map[string]Rate `json:"listeners"`
+		User      Rate            `json:"user"`
+		Users     map[string]Rate `json:"users"`
+		Keys      map[string]Rate `json:"keys"`
+	} `json:"rateLimit"`
+	Accounting struct {
+		File  string           `json:"file"`
+		Quota Quota            `json:"quota"`
+		Users map[string]Quota `json:"users"`
+		Keys  map[string]Quota `json:"keys"`
+	} `json:"accounting"`
+	Timeouts struct {
+		Handshake int `json:"handshake"`
+		Dial      int `json:"dial"`
+		Idle      int `json:"idle"`
+		Lifetime  int `json:"lifetime"`
+	} `json:"timeouts"`
+	Egress struct {
+		Default  string `json:"default"`
+		NextHops []struct {
+			Name     string `json:"name"`
+			Strategy string `json:"strategy"`
+			Chains   [][]struct {
+				Type   string `json:"type"`
+				Addr   string `json:"addr"`
+				Method string `json:"method"`
+				Key    string `json:"key"`
+				User   string `json:"user"`
+				Pass   string `json:"pass"`
+			} `json:"chains"`
+			Sites []string `json:"sites"`
+		} `json:"nextHops"`
+	} `json:"egress"`
+	Admin struct {
+		Addr  string `json:"addr"`
+		Token string `json:"token"`
+	} `json:"admin"`
+	Metrics struct {
+		Addr string `json:"addr"`
+	} `json:"metrics"`
+	Route struct {
+		Default      string `json:"default"`
+		AutoTimeout  int    `json:"autoTimeout"`
+		StallTimeout int    `json:"stallTimeout"`
+		Expire       int    `json:"expire"`
+		Cache        string `json:"cache"`
+	} `json:"route"`
 }
 
 var (
@@ -45,6 +211,11 @@ func init() {
 	flag.StringVar(&conf, "conf", "tunnel.json", "config file in json")
 	flag.BoolVar(&runLocal, "local", false, "run as local server")
 	flag.BoolVar(&runRemote, "remote", false, "run as remote server")
+}
+
+// parseFlags is called by main rather than init, flags of tests are not
+// registered until init finished.
+func parseFlags() {
 	flag.Parse()
 
 	if (runLocal && runRemote) || (!runLocal && !runRemote) {
@@ -61,12 +232,12 @@ func newSocks(cfg *Config) []proxy.Proxy {
 	socks := make([]proxy.Proxy, len(cfg.Socks))
 	for i, s := range cfg.Socks {
 		methods := []byte{proxy.AUTH_NOT_REQUIRED}
-		if len(s.UserPass) == 0 {
-			methods = append(methods, proxy.AUTH_USER_PASS)
+		if len(s.UserPass) != 0 {
+			methods = []byte{proxy.AUTH_USER_PASS}
 		}
 		sock, err := proxy.NewSocks5(methods, proxy.NewUserPass(s.UserPass), s.Addr)
 		if err != nil {
-			log.Fatal(log.M{"msg": "create socks5 proxy failed", "err": err.Error()})
+			configFatal(log.M{"msg": "create socks5 proxy failed", "err": err.Error()})
 		}
 		socks[i] = sock
 	}
@@ -78,48 +249,564 @@ func newTunnels(cfg *Config) []proxy.Proxy {
 	for i, t := range cfg.Tunnels {
 		tunnel, err := proxy.NewTunnel(t.Method, t.Key, t.Addr)
 		if err != nil {
-			log.Fatal(log.M{"msg": "create tunnel proxy failed", "err": err.Error()})
+			configFatal(log.M{"msg": "create tunnel proxy failed", "err": err.Error()})
 		}
+		tunnel.(*proxy.Tunnel).HalfClose = t.HalfClose
 		tunnels[i] = tunnel
 	}
 	return tunnels
 }
 
-//
-//func newList(white, black string) *server.SiteList {
-//	var listFile string
-//	if white != "" {
-//		listFile = white
-//	} else if black != "" {
-//		listFile = black
-//	} else {
-//		return nil
-//	}
-//
-//	mode := server.LIST_DIRECT
-//	if black != "" {
-//		mode = server.LIST_TUNNEL
-//	}
-//	list := server.NewList(mode)
-//	err := file.Filter(listFile, func(_ int, line []byte) error {
-//		if len(line) > 0 {
-//			site := string(line)
-//			if !strings.HasPrefix(site, "//") {
-//				list.Add(site)
-//			}
-//		}
-//		return nil
-//	})
-//	if err != nil {
-//		log.Fatal("parse list file failed:", err)
-//	}
-//	return list
-//}
-
-func waitOsSignal() os.Signal {
+// newTransports create transport of each tunnel, nil for tcp.
+func newTransports(cfg *Config) []*transport.Transport {
+	transports := make([]*transport.Transport, len(cfg.Tunnels))
+	for i, t := range cfg.Tunnels {
+		tc := t.Transport
+		if tc.Type == "" || tc.Type == transport.TYPE_TCP {
+			if tc.Connect == "" && !tc.FastOpen {
+				continue
+			}
+			tc.Type = transport.TYPE_TCP
+		}
+		if !transport.IsValidType(tc.Type) {
+			configFatal(log.M{"msg": "invalid transport type", "tunnel": t.Addr, "type": tc.Type})
+		}
+
+		tr := &transport.Transport{
+			Type:     tc.Type,
+			Path:     tc.Path,
+			Host:     tc.Host,
+			FastOpen: tc.FastOpen,
+		}
+		if tc.Connect != "" {
+			u, err := url.Parse(tc.Connect)
+			if err != nil || u.Host == "" {
+				configFatal(log.M{"msg": "invalid http proxy url", "tunnel": t.Addr, "connect": tc.Connect})
+			}
+			tr.Connect = u
+		}
+		if tc.Type == transport.TYPE_KCP {
+			kc := tc.KCP
+			if tc.Connect != "" {
+				configFatal(log.M{"msg": "kcp transport can't connect through http proxy", "tunnel": t.Addr})
+			}
+			if kc.DataShards > 0 && (kc.ParityShards <= 0 || kc.DataShards+kc.ParityShards > 256) {
+				configFatal(log.M{"msg": "invalid fec shards", "tunnel": t.Addr, "data": kc.DataShards, "parity": kc.ParityShards})
+			}
+			tr.KCP = transport.KCPConfig{
+				SndWnd:       kc.SndWnd,
+				RcvWnd:       kc.RcvWnd,
+				MTU:          kc.MTU,
+				Interval:     durationOr(kc.Interval, time.Millisecond, 0),
+				Timeout:      durationOr(kc.Timeout, time.Second, 0),
+				DataShards:   kc.DataShards,
+				ParityShards: kc.ParityShards,
+			}
+		}
+		if tc.Type == transport.TYPE_WSS {
+			tr.TLS = &tls.Config{InsecureSkipVerify: tc.Insecure}
+			if runRemote {
+				if tc.Cert == "" || tc.Key == "" {
+					configFatal(log.M{"msg": "wss transport requires cert and key", "tunnel": t.Addr})
+				}
+				cert, err := tls.LoadX509KeyPair(tc.Cert, tc.Key)
+				if err != nil {
+					configFatal(log.M{"msg": "load certificate failed", "tunnel": t.Addr, "err": err.Error()})
+				}
+				tr.TLS.Certificates = []tls.Certificate{cert}
+			}
+		}
+		transports[i] = tr
+	}
+	return transports
+}
+
+var listModes = map[string]int{
+	"direct":         server.LIST_DIRECT,
+	"directSuffixes": server.LIST_DIRECT_SUFFIXES,
+	"tunnel":         server.LIST_TUNNEL,
+	"reject":         server.LIST_REJECT,
+}
+
+func newListLoader(cfg *Config) *server.ListLoader {
+	loader := server.NewListLoader()
+	loader.List(server.LIST_DIRECT, cfg.DirectSites...)
+	loader.List(server.LIST_TUNNEL, cfg.TunnelSites...)
+	loader.List(server.LIST_DIRECT_SUFFIXES, cfg.DirectSuffixes...)
+	loader.List(server.LIST_REJECT, cfg.RejectSites...)
+	for _, l := range cfg.Lists {
+		mode, has := listModes[l.Mode]
+		if !has {
+			configFatal(log.M{"msg": "invalid list mode", "mode": l.Mode, "url": l.Url})
+		}
+		loader.AddSource(server.ListSource{
+			Mode:    mode,
+			Url:     l.Url,
+			Format:  l.Format,
+			Cache:   l.Cache,
+			Refresh: time.Duration(l.Refresh) * time.Second,
+		})
+	}
+	if psl := cfg.PublicSuffixList; psl.Url != "" {
+		loader.SetPublicSuffixSource(server.ListSource{
+			Url:     psl.Url,
+			Cache:   psl.Cache,
+			Refresh: time.Duration(psl.Refresh) * time.Second,
+		})
+	}
+	loader.Load()
+	return loader
+}
+
+// newRouter builds router of cfg, auto is the auto route currently used, it's
+// reused if not changed.
+func newRouter(cfg *Config, loader *server.ListLoader, auto *server.AutoRoute) *server.Router {
+	router := &server.Router{
+		Reject:      loader.List(server.LIST_REJECT),
+		RejectPorts: make(map[uint16]bool),
+		Direct:      loader.List(server.LIST_DIRECT),
+		Tunnel:      loader.List(server.LIST_TUNNEL),
+		Suffix:      loader.List(server.LIST_DIRECT_SUFFIXES),
+		Default:     cfg.Route.Default,
+	}
+	for _, port := range cfg.RejectPorts {
+		router.RejectPorts[port] = true
+	}
+	router.RejectIPs = newIPList("rejectIPs", cfg.RejectIPs)
+	router.DirectIPs = newIPList("directIPs", cfg.DirectIPs)
+	router.TunnelIPs = newIPList("tunnelIPs", cfg.TunnelIPs)
+	router.Resolver = newResolver(cfg)
+	router.Resolve = cfg.DNS.Resolve
+	if router.Resolve == "" {
+		router.Resolve = server.DNS_REMOTE
+	}
+	if !server.IsValidResolveMode(router.Resolve) {
+		configFatal(log.M{"msg": "invalid dns resolve mode", "resolve": router.Resolve})
+	}
+	if router.Default == "" {
+		router.Default = server.ROUTE_TUNNEL
+	}
+	if !server.IsValidRoute(router.Default) {
+		configFatal(log.M{"msg": "invalid default route", "route": router.Default})
+	}
+	if router.Default == server.ROUTE_AUTO {
+		router.Auto = newAutoRoute(cfg, auto)
+	}
+	return router
+}
+
+// newAutoRoute returns prev if settings not changed, otherwise a new one keeps
+// routes learned by prev, routes are loaded from cache file only on start.
+func newAutoRoute(cfg *Config, prev *server.AutoRoute) *server.AutoRoute {
+	rc := cfg.Route
+	auto := server.NewAutoRoute(
+		durationOr(rc.AutoTimeout, time.Millisecond, 2*time.Second),
+		durationOr(rc.StallTimeout, time.Millisecond, 10*time.Second),
+		durationOr(rc.Expire, time.Second, 7*24*time.Hour),
+		rc.Cache,
+	)
+	if prev == nil {
+		if err := auto.Load(); err != nil {
+			configFatal(log.M{"msg": "load learned routes failed", "file": rc.Cache, "err": err.Error()})
+		}
+		return auto
+	}
+	if prev.Timeout == auto.Timeout && prev.StallTimeout == auto.StallTimeout && prev.Expire == auto.Expire && prev.File == auto.File {
+		return prev
+	}
+	auto.Inherit(prev)
+	return auto
+}
+
+func newIPList(name string, cidrs []string) *server.IPList {
+	nets, err := server.ParseIPNets(cidrs)
+	if err != nil {
+		configFatal(log.M{"msg": "invalid ip list", "list": name, "err": err.Error()})
+	}
+	return server.NewIPList(nets...)
+}
+
+// newResolver returns nil if dns is not configured, direct connections use the
+// system resolver then.
+func newResolver(cfg *Config) *dns.Resolver {
+	dc := cfg.DNS
+	if len(dc.Servers) == 0 && len(dc.Hosts) == 0 && dc.HostsFile == "" && (dc.Resolve == "" || dc.Resolve == server.DNS_REMOTE) {
+		return nil
+	}
+	resolver := &dns.Resolver{
+		Hosts:   make(map[string][]net.IP),
+		Cache:   dns.NewCache(intOr(dc.CacheSize, 4096)),
+		Timeout: durationOr(dc.Timeout, time.Millisecond, 3*time.Second),
+	}
+	for _, s := range dc.Servers {
+		u, err := dns.NewUpstream(s)
+		if err != nil {
+			configFatal(log.M{"msg": "invalid dns server", "server": s, "err": err.Error()})
+		}
+		resolver.Upstreams = append(resolver.Upstreams, u)
+	}
+	if dc.HostsFile != "" {
+		data, err := ioutil.ReadFile(dc.HostsFile)
+		if err != nil {
+			configFatal(log.M{"msg": "read hosts file failed", "file": dc.HostsFile, "err": err.Error()})
+		}
+		dns.ParseHosts(string(data), resolver.Hosts)
+	}
+	for host, addr := range dc.Hosts {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			configFatal(log.M{"msg": "invalid hosts address", "host": host, "addr": addr})
+		}
+		host = strings.ToLower(host)
+		resolver.Hosts[host] = []net.IP{ip}
+	}
+	return resolver
+}
+
+func intOr(n, def int) int {
+	if n <= 0 {
+		return def
+	}
+	return n
+}
+
+func newBreaker(cfg *Config) server.Breaker {
+	hc := cfg.HealthCheck
+	return server.Breaker{
+		Failures:   intOr(hc.Failures, server.DefaultBreaker.Failures),
+		Backoff:    durationOr(hc.Backoff, time.Second, server.DefaultBreaker.Backoff),
+		MaxBackoff: durationOr(hc.MaxBackoff, time.Second, server.DefaultBreaker.MaxBackoff),
+	}
+}
+
+func newTunnelNode(cfg *Config, i int, t proxy.Proxy, tr *transport.Transport) *server.TunnelNode {
+	n := server.NewTunnelNode(t, cfg.Tunnels[i].Weight, newBreaker(cfg))
+	n.Transport = tr
+	if sessions := cfg.Tunnels[i].Mux; sessions > 0 {
+		n.Mux = server.NewMuxPool(t, n.Dial, sessions, newMuxConfig(cfg))
+	} else if size := cfg.Tunnels[i].Pool; size > 0 {
+		n.Pool = server.NewConnPool(t.Addr(), size, durationOr(cfg.Pool.Idle, time.Second, 30*time.Second), n.Dial)
+	}
+	return n
+}
+
+func newMuxConfig(cfg *Config) mux.Config {
+	return mux.Config{
+		Window:        intOr(cfg.Mux.Window, mux.DefaultConfig.Window),
+		KeepAlive:     durationOr(cfg.Mux.KeepAlive, time.Second, mux.DefaultConfig.KeepAlive),
+		Timeout:       durationOr(cfg.Mux.Timeout, time.Second, mux.DefaultConfig.Timeout),
+		AcceptBacklog: mux.DefaultConfig.AcceptBacklog,
+	}
+}
+
+func newHealthChecker(cfg *Config, nodes []*server.TunnelNode) *server.HealthChecker {
+	hc := cfg.HealthCheck
+	if hc.Interval <= 0 {
+		return nil
+	}
+	return server.NewHealthChecker(nodes,
+		time.Duration(hc.Interval)*time.Second,
+		durationOr(hc.Timeout, time.Millisecond, 5*time.Second),
+		hc.Target,
+	)
+}
+
+func selectTunnels(tunnels []*server.TunnelNode, addrs []string) []*server.TunnelNode {
+	if len(addrs) == 0 {
+		return tunnels
+	}
+
+	selected := make([]*server.TunnelNode, 0, len(addrs))
+	for _, addr := range addrs {
+		var found bool
+		for _, t := range tunnels {
+			if found = t.Addr() == addr; found {
+				selected = append(selected, t)
+				break
+			}
+		}
+		if !found {
+			configFatal(log.M{"msg": "tunnel not found", "addr": addr})
+		}
+	}
+	return selected
+}
+
+func newTunnelGroup(cfg *Config, name, strategy string, nodes []*server.TunnelNode, direct bool) *server.TunnelGroup {
+	group, err := server.NewTunnelGroup(name, strategy, nodes, direct)
+	if err != nil {
+		configFatal(log.M{"msg": "create tunnel group failed", "group": name, "err": err.Error()})
+	}
+	group.Retry = server.Retry{
+		Attempts: intOr(cfg.Retry.Attempts, 1),
+		Deadline: durationOr(cfg.Retry.Deadline, time.Millisecond, 0),
+		Direct:   cfg.Retry.Direct,
+	}
+	return group
+}
+
+const _GROUP_DIRECT = "direct"
+
+// newGroups create configured groups and the "default" group of all tunnels
+// if not configured. Members are tunnel addresses, group names or "direct",
+// members of nested groups are merged into the group.
+func newGroups(cfg *Config, nodes []*server.TunnelNode) map[string]*server.TunnelGroup {
+	configs := make(map[string]int, len(cfg.Groups))
+	for i, g := range cfg.Groups {
+		if g.Name == "" || g.Name == _GROUP_DIRECT {
+			configFatal(log.M{"msg": "invalid group name", "group": g.Name})
+		}
+		if _, has := configs[g.Name]; has {
+			configFatal(log.M{"msg": "duplicate group", "group": g.Name})
+		}
+		configs[g.Name] = i
+	}
+
+	groups := make(map[string]*server.TunnelGroup)
+	var members func(name string, visiting map[string]bool) ([]*server.TunnelNode, bool)
+	members = func(name string, visiting map[string]bool) (tunnels []*server.TunnelNode, direct bool) {
+		if visiting[name] {
+			configFatal(log.M{"msg": "group contains itself", "group": name})
+		}
+		visiting[name] = true
+		defer delete(visiting, name)
+
+		seen := make(map[*server.TunnelNode]bool)
+		add := func(ns ...*server.TunnelNode) {
+			for _, n := range ns {
+				if !seen[n] {
+					seen[n] = true
+					tunnels = append(tunnels, n)
+				}
+			}
+		}
+		for _, m := range cfg.Groups[configs[name]].Members {
+			if m == _GROUP_DIRECT {
+				direct = true
+			} else if _, has := configs[m]; has {
+				ns, d := members(m, visiting)
+				add(ns...)
+				direct = direct || d
+			} else {
+				add(selectTunnels(nodes, []string{m})...)
+			}
+		}
+		return tunnels, direct
+	}
+	for _, g := range cfg.Groups {
+		strategy := g.Strategy
+		if strategy == "" {
+			strategy = cfg.Strategy
+		}
+		tunnels, direct := members(g.Name, make(map[string]bool))
+		groups[g.Name] = newTunnelGroup(cfg, g.Name, strategy, tunnels, direct)
+	}
+	if _, has := groups[server.DEFAULT_GROUP]; !has {
+		groups[server.DEFAULT_GROUP] = newTunnelGroup(cfg, server.DEFAULT_GROUP, cfg.Strategy, nodes, false)
+	}
+	return groups
+}
+
+func findGroup(groups map[string]*server.TunnelGroup, name string) *server.TunnelGroup {
+	if name == "" {
+		name = server.DEFAULT_GROUP
+	}
+	group, has := groups[name]
+	if !has {
+		configFatal(log.M{"msg": "group not found", "group": name})
+	}
+	return group
+}
+
+// routeGroups add sites of groups to router.
+func routeGroups(cfg *Config, router *server.Router, groups map[string]*server.TunnelGroup) {
+	for _, g := range cfg.Groups {
+		if len(g.Sites) > 0 {
+			router.Groups = append(router.Groups, server.GroupSites{
+				Group: groups[g.Name],
+				Sites: server.NewList(server.LIST_TUNNEL, g.Sites...),
+			})
+		}
+	}
+}
+
+func socksGroups(cfg *Config, groups map[string]*server.TunnelGroup) []*server.TunnelGroup {
+	socks := make([]*server.TunnelGroup, len(cfg.Socks))
+	for i, s := range cfg.Socks {
+		socks[i] = findGroup(groups, s.Group)
+	}
+	return socks
+}
+
+func newPolicies(cfg *Config, router *server.Router, tunnels []*server.TunnelNode, groups map[string]*server.TunnelGroup) *server.Policies {
+	policies := &server.Policies{
+		Default: &server.ClientPolicy{
+			Name:   "default",
+			Router: router,
+		},
+	}
+	for i, c := range cfg.Clients {
+		if c.Name == "" {
+			c.Name = "client" + strconv.Itoa(i)
+		}
+		if len(c.Users) == 0 && len(c.Sources) == 0 {
+			configFatal(log.M{"msg": "client requires users or sources", "client": c.Name})
+		}
+		if c.Route != "" && (!server.IsValidRoute(c.Route) || (c.Route == server.ROUTE_AUTO && router.Auto == nil)) {
+			configFatal(log.M{"msg": "invalid client route", "client": c.Name, "route": c.Route})
+		}
+		if c.Resolve != "" && !server.IsValidResolveMode(c.Resolve) {
+			configFatal(log.M{"msg": "invalid client dns resolve mode", "client": c.Name, "resolve": c.Resolve})
+		}
+		sources, err := server.ParseIPNets(c.Sources)
+		if err != nil {
+			configFatal(log.M{"msg": "invalid client sources", "client": c.Name, "err": err.Error()})
+		}
+
+		if c.Strategy == "" {
+			c.Strategy = cfg.Strategy
+		}
+		if c.Group != "" && len(c.Tunnels) > 0 {
+			configFatal(log.M{"msg": "client group and tunnels are exclusive", "client": c.Name})
+		}
+		var group *server.TunnelGroup
+		if c.Group != "" {
+			group = findGroup(groups, c.Group)
+		} else if len(c.Tunnels) > 0 {
+			group = newTunnelGroup(cfg, c.Name, c.Strategy, selectTunnels(tunnels, c.Tunnels), false)
+		}
+		directOnly := c.Route == server.ROUTE_DIRECT
+		if directOnly && len(c.TunnelSites) > 0 {
+			configFatal(log.M{"msg": "tunnel sites is not allowed for direct route", "client": c.Name})
+		}
+		policies.Clients = append(policies.Clients, &server.ClientPolicy{
+			Name:    c.Name,
+			Users:   c.Users,
+			Sources: sources,
+			Router: &server.Router{
+				Reject:  server.NewList(server.LIST_REJECT, c.RejectSites...),
+				Direct:  server.NewList(server.LIST_DIRECT, c.DirectSites...),
+				Tunnel:  server.NewList(server.LIST_TUNNEL, c.TunnelSites...),
+				Default: c.Route,
+				Auto:    router.Auto,
+				Parent:  router,
+				Resolve: c.Resolve,
+			},
+			Tunnels:    group,
+			DirectOnly: directOnly,
+			MaxConns:   c.MaxConns,
+		})
+	}
+	return policies
+}
+
+func durationOr(n int, unit, def time.Duration) time.Duration {
+	if n <= 0 {
+		return def
+	}
+	return time.Duration(n) * unit
+}
+
+// Rate in KB/s, 0 for unlimited.
+type Rate struct {
+	Up   int64 `json:"up"`
+	Down int64 `json:"down"`
+}
+
+func (r Rate) bytes() server.Rate {
+	return server.Rate{Up: r.Up * 1024, Down: r.Down * 1024}
+}
+
+func setRateLimits(cfg *Config, limits *server.RateLimits) {
+	rc := cfg.RateLimit
+	listeners := make(map[string]server.Rate, len(rc.Listeners))
+	for addr, rate := range rc.Listeners {
+		listeners[addr] = rate.bytes()
+	}
+	users := make(map[string]server.Rate, len(rc.Users)+len(rc.Keys))
+	for user, rate := range rc.Users {
+		users[user] = rate.bytes()
+	}
+	for key, rate := range rc.Keys {
+		users[proxy.KeyID(key)] = rate.bytes()
+	}
+	limits.Reset(rc.Rate.bytes(), listeners, rc.User.bytes(), users)
+}
+
+// Quota in MB, 0 for unlimited.
+type Quota struct {
+	MB       int64  `json:"mb"`
+	Monthly  bool   `json:"monthly"`
+	Action   string `json:"action"`
+	Throttle Rate   `json:"throttle"`
+}
+
+func (q Quota) quota() server.Quota {
+	switch q.Action {
+	case "", server.QUOTA_BLOCK:
+		q.Action = server.QUOTA_BLOCK
+	case server.QUOTA_THROTTLE:
+	default:
+		configFatal(log.M{"msg": "invalid quota action", "action": q.Action})
+	}
+	return server.Quota{
+		Bytes:    q.MB << 20,
+		Monthly:  q.Monthly,
+		Action:   q.Action,
+		Throttle: q.Throttle.bytes(),
+	}
+}
+
+// newAccounting returns nil if accounting is disabled, quotas are set by
+// newQuotas.
+func newAccounting(cfg *Config) *server.Accounting {
+	ac := cfg.Accounting
+	if ac.File == "" {
+		return nil
+	}
+	a := server.NewAccounting(ac.File)
+	if err := a.Load(); err != nil {
+		log.Error(log.M{"msg": "load accounts failed", "file": ac.File, "err": err.Error()})
+	}
+	return a
+}
+
+func newQuotas(cfg *Config) (def server.Quota, quotas map[string]server.Quota) {
+	ac := cfg.Accounting
+	quotas = make(map[string]server.Quota, len(ac.Users)+len(ac.Keys))
+	for user, q := range ac.Users {
+		quotas[user] = q.quota()
+	}
+	for key, q := range ac.Keys {
+		quotas[proxy.KeyID(key)] = q.quota()
+	}
+	return ac.Quota.quota(), quotas
+}
+
+// timeoutOr is same as durationOr in seconds, but negative n disables the
+// timeout.
+func timeoutOr(n int, def time.Duration) time.Duration {
+	if n < 0 {
+		return 0
+	}
+	return durationOr(n, time.Second, def)
+}
+
+func newTimeouts(cfg *Config) server.Timeouts {
+	tc := cfg.Timeouts
+	def := server.DefaultTimeouts
+	return server.Timeouts{
+		Handshake: timeoutOr(tc.Handshake, def.Handshake),
+		Dial:      timeoutOr(tc.Dial, def.Dial),
+		Idle:      timeoutOr(tc.Idle, def.Idle),
+		Lifetime:  timeoutOr(tc.Lifetime, def.Lifetime),
+	}
+}
+
+func osSignals() <-chan os.Signal {
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
-	return <-sigs
+	return sigs
 }
 
 func initLog(fname string, debug bool) {
@@ -140,7 +827,127 @@ func initLog(fname string, debug bool) {
 	}
 }
 
+// hop types of egress chains
+const (
+	_HOP_TUNNEL = "tunnel"
+	_HOP_SOCKS5 = "socks5"
+)
+
+// newEgress create next hop groups of remote server, each chain of a next hop
+// is a tunnel node of the group. It returns nil if no next hops configured and
+// fast open is disabled.
+func newEgress(cfg *Config) *server.Egress {
+	ec := cfg.Egress
+	if len(ec.NextHops) == 0 {
+		if ec.Default != "" {
+			configFatal(log.M{"msg": "next hop not found", "nextHop": ec.Default})
+		}
+		if !cfg.FastOpen {
+			return nil
+		}
+	}
+
+	breaker := newBreaker(cfg)
+	egress := &server.Egress{FastOpen: cfg.FastOpen}
+	groups := make(map[string]*server.TunnelGroup)
+	for _, nh := range ec.NextHops {
+		if nh.Name == "" || groups[nh.Name] != nil || len(nh.Chains) == 0 {
+			configFatal(log.M{"msg": "next hop requires unique name and chains", "nextHop": nh.Name})
+		}
+		nodes := make([]*server.TunnelNode, len(nh.Chains))
+		for i, hops := range nh.Chains {
+			if len(hops) == 0 {
+				configFatal(log.M{"msg": "empty chain", "nextHop": nh.Name})
+			}
+			chain := make(proxy.Chain, len(hops))
+			for j, h := range hops {
+				var (
+					p   proxy.Proxy
+					err error
+				)
+				switch h.Type {
+				case "", _HOP_TUNNEL:
+					p, err = proxy.NewTunnel(h.Method, h.Key, h.Addr)
+				case _HOP_SOCKS5:
+					methods, users := []byte{proxy.AUTH_NOT_REQUIRED}, proxy.NewUserPass(nil)
+					if h.User != "" {
+						methods = []byte{proxy.AUTH_USER_PASS}
+						users.Add(h.User, h.Pass)
+					}
+					p, err = proxy.NewSocks5(methods, users, h.Addr)
+				default:
+					configFatal(log.M{"msg": "invalid hop type", "nextHop": nh.Name, "type": h.Type})
+				}
+				if err != nil {
+					configFatal(log.M{"msg": "create hop failed", "nextHop": nh.Name, "addr": h.Addr, "err": err.Error()})
+				}
+				chain[j] = p
+			}
+
+			var p proxy.Proxy = chain
+			if len(chain) == 1 {
+				p = chain[0]
+			}
+			nodes[i] = server.NewTunnelNode(p, 1, breaker)
+		}
+
+		strategy := nh.Strategy
+		if strategy == "" {
+			strategy = cfg.Strategy
+		}
+		group := newTunnelGroup(cfg, nh.Name, strategy, nodes, false)
+		groups[nh.Name] = group
+		if len(nh.Sites) > 0 {
+			egress.Groups = append(egress.Groups, server.GroupSites{
+				Group: group,
+				Sites: server.NewList(server.LIST_TUNNEL, nh.Sites...),
+			})
+		}
+	}
+	if ec.Default != "" {
+		if egress.Default = groups[ec.Default]; egress.Default == nil {
+			configFatal(log.M{"msg": "next hop not found", "nextHop": ec.Default})
+		}
+	}
+	return egress
+}
+
+// newReverseServer returns nil if reverse bindings are not allowed.
+func newReverseServer(cfg *Config) *server.ReverseServer {
+	rc := cfg.Reverse
+	if rc.Token == "" || len(rc.Ports) == 0 {
+		return nil
+	}
+	ports := make(map[uint16]bool, len(rc.Ports))
+	for _, p := range rc.Ports {
+		ports[p] = true
+	}
+	return &server.ReverseServer{
+		Token: rc.Token,
+		Host:  rc.Host,
+		Ports: ports,
+	}
+}
+
+func newReverseBindings(cfg *Config, nodes []*server.TunnelNode) []*server.ReverseBinding {
+	rc := cfg.Reverse
+	bindings := make([]*server.ReverseBinding, len(rc.Bindings))
+	for i, b := range rc.Bindings {
+		if rc.Token == "" || b.Port == 0 || b.Target == "" {
+			configFatal(log.M{"msg": "reverse binding requires token, port and target", "port": b.Port, "target": b.Target})
+		}
+		tunnel := nodes[0]
+		if b.Tunnel != "" {
+			tunnel = selectTunnels(nodes, []string{b.Tunnel})[0]
+		}
+		bindings[i] = server.NewReverseBinding(tunnel, rc.Token, b.Port, b.Target, newMuxConfig(cfg))
+	}
+	return bindings
+}
+
 func main() {
+	parseFlags()
+
 	var cfg Config
 	err := encodeio.ReadJSONWithComment(conf, &cfg)
 	if err != nil {
@@ -148,35 +955,36 @@ func main() {
 		os.Exit(-1)
 	}
 	initLog(cfg.Log.File, cfg.Log.Debug)
+	server.DefaultAccounting = newAccounting(&cfg)
 
-	if (runLocal && len(cfg.Socks) == 0) || len(cfg.Tunnels) == 0 {
-		log.Fatal(log.M{"msg": "empty socks or tunnels"})
+	app := newApp()
+	if err = app.apply(&cfg); err != nil {
+		log.Fatal(log.M{"msg": "create servers failed", "err": err.Error()})
 	}
-
-	var (
-		sig     server.Signal
-		tunnels = newTunnels(&cfg)
-	)
-	if runLocal {
-		directList := server.NewList(server.LIST_DIRECT, cfg.DirectSites...)
-		tunnelList := server.NewList(server.LIST_TUNNEL, cfg.TunnelSites...)
-		directSuffixSites := server.NewList(server.LIST_DIRECT_SUFFIXES, cfg.DirectSuffixes...)
-
-		socks := newSocks(&cfg)
-		sig, err = server.RunMultipleLocal(socks, tunnels, directList, tunnelList, directSuffixSites)
-		if err != nil {
-			log.Fatal(log.M{"msg": "create local proxies failed", "err": err.Error()})
+	log.Info(log.M{"msg": "servers running", "server_num": len(app.listeners)})
+	if cfg.Admin.Addr != "" {
+		if err = app.runAdmin(cfg.Admin.Addr, cfg.Admin.Token); err != nil {
+			log.Fatal(log.M{"msg": "create admin server failed", "err": err.Error()})
 		}
-		log.Info(log.M{"msg": "servers running", "server_num": len(socks)})
-	} else {
-		sig, err = server.RunMultipleRemote(tunnels)
-		if err != nil {
-			log.Fatal(log.M{"msg": "create remote proxies failed", "err": err.Error()})
+	}
+	if cfg.Metrics.Addr != "" {
+		if err = server.RunMetrics(cfg.Metrics.Addr, app.servers); err != nil {
+			log.Fatal(log.M{"msg": "create metrics server failed", "err": err.Error()})
 		}
-		log.Info(log.M{"msg": "servers running", "server_num": len(tunnels)})
+	}
+	if server.DefaultAccounting != nil {
+		server.DefaultAccounting.Run(app.servers.Signal())
 	}
 
-	waitOsSignal()
-	sig.Close()
+	for sig := range osSignals() {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		app.reload()
+	}
+	app.close()
+	if server.DefaultAccounting != nil {
+		server.DefaultAccounting.Save()
+	}
 	log.Close()
 }
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/cosiner/gohper/testing2"
+	"github.com/cosiner/tunnel/server"
+)
+
+// configFails reports whether fn aborts by configFatal.
+func configFails(fn func()) (failed bool) {
+	defer func() {
+		if e := recover(); e != nil {
+			_, failed = e.(configError)
+		}
+	}()
+	fn()
+	return false
+}
+
+func groupsConfig(groups string) *Config {
+	var cfg Config
+	json.Unmarshal([]byte(`{
+		"tunnels": [
+			{"addr": "10.0.0.1:80", "method": "aes-128-cfb", "key": "key"},
+			{"addr": "10.0.0.2:80", "method": "aes-128-cfb", "key": "key"},
+			{"addr": "10.0.0.3:80", "method": "aes-128-cfb", "key": "key"}
+		],
+		"groups": `+groups+`
+	}`), &cfg)
+	return &cfg
+}
+
+func groupNodes(cfg *Config) []*server.TunnelNode {
+	tunnels := newTunnels(cfg)
+	nodes := make([]*server.TunnelNode, len(tunnels))
+	for i, t := range tunnels {
+		nodes[i] = server.NewTunnelNode(t, 1, server.DefaultBreaker)
+	}
+	return nodes
+}
+
+func TestNewGroups(t *testing.T) {
+	cfg := groupsConfig(`[
+		{"name": "us", "members": ["10.0.0.1:80", "10.0.0.2:80"]},
+		{"name": "eu", "members": ["10.0.0.3:80", "direct"], "strategy": "round_robin"},
+		{"name": "all", "members": ["us", "eu", "10.0.0.1:80"]}
+	]`)
+	nodes := groupNodes(cfg)
+	groups := newGroups(cfg, nodes)
+
+	us, eu, all := groups["us"], groups["eu"], groups["all"]
+	testing2.True(t, len(us.Nodes) == 2 && !us.Direct && us.Strategy == server.SELECT_RANDOM)
+	testing2.True(t, len(eu.Nodes) == 1 && eu.Nodes[0] == nodes[2] && eu.Direct && eu.Strategy == server.SELECT_ROUND_ROBIN)
+	// members of nested groups are merged without duplicates
+	testing2.True(t, len(all.Nodes) == 3 && all.Direct)
+	testing2.True(t, all.Nodes[0] == nodes[0] && all.Nodes[1] == nodes[1] && all.Nodes[2] == nodes[2])
+	// default group of all tunnels
+	testing2.True(t, len(groups[server.DEFAULT_GROUP].Nodes) == 3)
+	testing2.True(t, findGroup(groups, "") == groups[server.DEFAULT_GROUP])
+	testing2.True(t, configFails(func() { findGroup(groups, "asia") }))
+
+	for _, invalid := range []string{
+		`[{"name": "a", "members": ["b"]}, {"name": "b", "members": ["a"]}]`,
+		`[{"name": "a", "members": ["10.0.0.9:80"]}]`,
+		`[{"name": "a", "members": ["direct"]}, {"name": "a", "members": ["direct"]}]`,
+		`[{"name": "direct", "members": ["10.0.0.1:80"]}]`,
+	} {
+		cfg = groupsConfig(invalid)
+		testing2.True(t, configFails(func() { newGroups(cfg, groupNodes(cfg)) }))
+	}
+}
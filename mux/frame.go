@@ -0,0 +1,97 @@
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+// | Version 1 | Cmd 1 | Length 2 | StreamId 4 | Payload Length |
+const (
+	VERSION byte = 1
+
+	CMD_SYN    byte = 0 // open stream
+	CMD_DATA   byte = 1
+	CMD_FIN    byte = 2 // sender will not write any more
+	CMD_RST    byte = 3 // abort stream
+	CMD_WINDOW byte = 4 // payload is 4 bytes window increment
+	CMD_PING   byte = 5 // payload is echoed by CMD_PONG
+	CMD_PONG   byte = 6
+
+	_HEADER_LEN = 8
+
+	MAX_FRAME_SIZE = 16 * 1024
+
+	// frames queued for replying by session
+	_CONTROL_QUEUE = 256
+)
+
+var (
+	ErrSessionClosed = errors.New("mux: session closed")
+	// messages same as net errors to be recognized by callers
+	ErrStreamClosed = errors.New("mux: use of closed network connection")
+	ErrStreamReset  = errors.New("mux: connection reset by peer")
+	ErrBadVersion   = errors.New("mux: unsupported version")
+	ErrBadFrame     = errors.New("mux: malformed frame")
+
+	errControlOverflow = errors.New("mux: too many frames to reply")
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "mux: i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var errTimeout error = timeoutError{}
+
+// Config of session, both sides should use the same Window.
+type Config struct {
+	Window        int           // receive window of each stream
+	KeepAlive     time.Duration // ping interval, 0 to disable
+	Timeout       time.Duration // session closed if nothing received in timeout, 0 to disable
+	AcceptBacklog int
+}
+
+var DefaultConfig = Config{
+	Window:        256 * 1024,
+	KeepAlive:     30 * time.Second,
+	Timeout:       90 * time.Second,
+	AcceptBacklog: 256,
+}
+
+type frame struct {
+	cmd     byte
+	id      uint32
+	payload []byte
+}
+
+func readFrame(r io.Reader, header []byte) (f frame, err error) {
+	if _, err = io.ReadFull(r, header[:_HEADER_LEN]); err != nil {
+		return f, err
+	}
+	if header[0] != VERSION {
+		return f, ErrBadVersion
+	}
+	f.cmd = header[1]
+	f.id = binary.BigEndian.Uint32(header[4:8])
+	if length := binary.BigEndian.Uint16(header[2:4]); length > 0 {
+		if length > MAX_FRAME_SIZE {
+			return f, ErrBadFrame
+		}
+		f.payload = make([]byte, length)
+		_, err = io.ReadFull(r, f.payload)
+	}
+	return f, err
+}
+
+func encodeFrame(cmd byte, id uint32, payload []byte) []byte {
+	b := make([]byte, _HEADER_LEN+len(payload))
+	b[0] = VERSION
+	b[1] = cmd
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(payload)))
+	binary.BigEndian.PutUint32(b[4:8], id)
+	copy(b[_HEADER_LEN:], payload)
+	return b
+}
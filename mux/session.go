@@ -0,0 +1,276 @@
+package mux
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Session carries many streams over a connection, streams can be opened by
+// both sides, ids of streams opened by client are odd, even by server.
+type Session struct {
+	conn   net.Conn
+	config Config
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextId  uint32
+	err     error
+
+	writeMu  sync.Mutex
+	control  chan frame // frames replied by recvLoop
+	accepts  chan *Stream
+	done     chan struct{}
+	lastRecv int64
+}
+
+func Client(conn net.Conn, config Config) *Session {
+	return newSession(conn, config, 1)
+}
+
+func Server(conn net.Conn, config Config) *Session {
+	return newSession(conn, config, 2)
+}
+
+func newSession(conn net.Conn, config Config, firstId uint32) *Session {
+	if config.Window <= 0 {
+		config.Window = DefaultConfig.Window
+	}
+	if config.AcceptBacklog <= 0 {
+		config.AcceptBacklog = DefaultConfig.AcceptBacklog
+	}
+	s := &Session{
+		conn:     conn,
+		config:   config,
+		streams:  make(map[uint32]*Stream),
+		nextId:   firstId,
+		control:  make(chan frame, _CONTROL_QUEUE),
+		accepts:  make(chan *Stream, config.AcceptBacklog),
+		done:     make(chan struct{}),
+		lastRecv: time.Now().UnixNano(),
+	}
+	go s.recvLoop()
+	go s.controlLoop()
+	if config.KeepAlive > 0 {
+		go s.keepAlive()
+	}
+	return s
+}
+
+func (s *Session) Open() (*Stream, error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	id := s.nextId
+	s.nextId += 2
+	st := newStream(id, s)
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	if err := s.writeFrame(CMD_SYN, id, nil); err != nil {
+		s.remove(id)
+		return nil, err
+	}
+	return st, nil
+}
+
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case st := <-s.accepts:
+		return st, nil
+	case <-s.done:
+		return nil, s.Err()
+	}
+}
+
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Err returns the reason session closed.
+func (s *Session) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *Session) Close() error {
+	s.closeWithError(ErrSessionClosed)
+	return nil
+}
+
+func (s *Session) closeWithError(err error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return
+	}
+	s.err = err
+	s.streams = make(map[uint32]*Stream)
+	s.mu.Unlock()
+
+	close(s.done)
+	s.conn.Close()
+}
+
+func (s *Session) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *Session) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+func (s *Session) writeFrame(cmd byte, id uint32, payload []byte) error {
+	b := encodeFrame(cmd, id, payload)
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	select {
+	case <-s.done:
+		return s.Err()
+	default:
+	}
+	if _, err := s.conn.Write(b); err != nil {
+		s.closeWithError(err)
+		return err
+	}
+	return nil
+}
+
+func (s *Session) stream(id uint32) *Stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[id]
+}
+
+func (s *Session) remove(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+func (s *Session) recvLoop() {
+	var header [_HEADER_LEN]byte
+	for {
+		f, err := readFrame(s.conn, header[:])
+		if err != nil {
+			s.closeWithError(err)
+			return
+		}
+		atomic.StoreInt64(&s.lastRecv, time.Now().UnixNano())
+
+		switch f.cmd {
+		case CMD_SYN:
+			s.accept(f.id)
+		case CMD_DATA:
+			st := s.stream(f.id)
+			if st == nil || !st.push(f.payload) {
+				s.remove(f.id)
+				s.reply(CMD_RST, f.id, nil)
+			}
+		case CMD_FIN:
+			if st := s.stream(f.id); st != nil {
+				st.finReceived()
+			}
+		case CMD_RST:
+			if st := s.stream(f.id); st != nil {
+				st.resetReceived()
+			}
+		case CMD_WINDOW:
+			if len(f.payload) != 4 {
+				s.closeWithError(ErrBadFrame)
+				return
+			}
+			if st := s.stream(f.id); st != nil {
+				st.grow(binary.BigEndian.Uint32(f.payload))
+			}
+		case CMD_PING:
+			s.reply(CMD_PONG, f.id, f.payload)
+		case CMD_PONG:
+		default:
+			s.closeWithError(ErrBadFrame)
+			return
+		}
+	}
+}
+
+// reply queues a frame written by controlLoop, recvLoop never writes since the
+// peer may be blocked writing to us. If the queue is full, the peer doesn't
+// read our replies, pongs are dropped and the session is closed for others.
+func (s *Session) reply(cmd byte, id uint32, payload []byte) {
+	select {
+	case s.control <- frame{cmd: cmd, id: id, payload: payload}:
+	default:
+		if cmd != CMD_PONG {
+			s.closeWithError(errControlOverflow)
+		}
+	}
+}
+
+func (s *Session) controlLoop() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case f := <-s.control:
+			s.writeFrame(f.cmd, f.id, f.payload)
+		}
+	}
+}
+
+func (s *Session) accept(id uint32) {
+	st := newStream(id, s)
+	s.mu.Lock()
+	if _, has := s.streams[id]; has || s.err != nil {
+		s.mu.Unlock()
+		return
+	}
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	select {
+	case s.accepts <- st:
+	default:
+		s.remove(id)
+		s.reply(CMD_RST, id, nil)
+	}
+}
+
+func (s *Session) keepAlive() {
+	ticker := time.NewTicker(s.config.KeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		if s.config.Timeout > 0 {
+			last := time.Unix(0, atomic.LoadInt64(&s.lastRecv))
+			if time.Since(last) > s.config.Timeout {
+				s.closeWithError(errTimeout)
+				return
+			}
+		}
+		var payload [8]byte
+		binary.BigEndian.PutUint64(payload[:], uint64(time.Now().UnixNano()))
+		s.writeFrame(CMD_PING, 0, payload[:])
+	}
+}
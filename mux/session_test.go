@@ -0,0 +1,117 @@
+package mux
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/cosiner/gohper/testing2"
+)
+
+func pipeSessions(window int) (*Session, *Session) {
+	c, s := net.Pipe()
+	config := Config{Window: window}
+	return Client(c, config), Server(s, config)
+}
+
+func TestStreamFlowControl(t *testing.T) {
+	client, server := pipeSessions(4096)
+	defer client.Close()
+	defer server.Close()
+
+	// echo until EOF then close
+	go func() {
+		st, err := server.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(st, st)
+		st.Close()
+	}()
+
+	st, err := client.Open()
+	testing2.True(t, err == nil)
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	go func() {
+		st.Write(data)
+		st.CloseWrite()
+	}()
+
+	st.SetReadDeadline(time.Now().Add(5 * time.Second))
+	echo, err := ioutil.ReadAll(st)
+	testing2.True(t, err == nil)
+	testing2.True(t, bytes.Equal(data, echo))
+	st.Close()
+
+	for i := 0; i < 100 && client.NumStreams() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	testing2.True(t, client.NumStreams() == 0)
+}
+
+func TestStreamResetAndTimeout(t *testing.T) {
+	client, server := pipeSessions(1024)
+	defer server.Close()
+
+	st, err := client.Open()
+	testing2.True(t, err == nil)
+	sst, err := server.Accept()
+	testing2.True(t, err == nil)
+
+	// data received after close resets the stream
+	sst.Close()
+	st.Write([]byte("hello"))
+	for i := 0; i < 100; i++ {
+		// EOF until RST received
+		if _, err = st.Read(make([]byte, 8)); err != io.EOF {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	testing2.True(t, err == ErrStreamReset)
+
+	st, err = client.Open()
+	testing2.True(t, err == nil)
+	st.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	_, err = st.Read(make([]byte, 8))
+	e, ok := err.(net.Error)
+	testing2.True(t, ok && e.Timeout())
+
+	client.Close()
+	_, err = st.Read(make([]byte, 8))
+	testing2.True(t, err == ErrSessionClosed)
+	_, err = server.Accept() // the second stream
+	testing2.True(t, err == nil)
+	_, err = server.Accept()
+	testing2.False(t, err == nil)
+}
+
+func TestSessionControlQueue(t *testing.T) {
+	c, s := net.Pipe()
+	sess := Client(c, Config{})
+	defer sess.Close()
+	defer s.Close()
+
+	// peer never reads pongs, they are dropped without blocking recvLoop or
+	// piling up goroutines
+	goroutines := runtime.NumGoroutine()
+	for i := 0; i < 4*_CONTROL_QUEUE; i++ {
+		s.SetWriteDeadline(time.Now().Add(time.Second))
+		_, err := s.Write(encodeFrame(CMD_PING, 0, []byte("ping")))
+		testing2.True(t, err == nil)
+	}
+	testing2.True(t, runtime.NumGoroutine() <= goroutines+1)
+	testing2.False(t, sess.IsClosed())
+
+	// resets which can't be queued close the session
+	for i := 0; i < 2*_CONTROL_QUEUE && !sess.IsClosed(); i++ {
+		s.SetWriteDeadline(time.Now().Add(time.Second))
+		s.Write(encodeFrame(CMD_DATA, uint32(i*2+2), []byte("x")))
+	}
+	testing2.True(t, sess.IsClosed())
+}
@@ -0,0 +1,278 @@
+package mux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Stream is a logical connection of session, it implements net.Conn. Each
+// side may send at most Window bytes not consumed by the other side, consumed
+// bytes are granted back by CMD_WINDOW.
+type Stream struct {
+	id   uint32
+	sess *Session
+
+	mu            sync.Mutex
+	buf           bytes.Buffer
+	recvAvail     int // bytes peer is allowed to send
+	consumed      int // bytes read but not granted back
+	sendWindow    int
+	finRecv       bool
+	finSent       bool
+	closed        bool
+	reset         bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	readCh  chan struct{}
+	writeCh chan struct{}
+}
+
+func newStream(id uint32, sess *Session) *Stream {
+	return &Stream{
+		id:         id,
+		sess:       sess,
+		recvAvail:  sess.config.Window,
+		sendWindow: sess.config.Window,
+		readCh:     make(chan struct{}, 1),
+		writeCh:    make(chan struct{}, 1),
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Stream) ID() uint32 {
+	return s.id
+}
+
+func (s *Stream) wait(ch chan struct{}, deadline time.Time) error {
+	if s.sess.IsClosed() {
+		return s.sess.Err()
+	}
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return errTimeout
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-ch:
+		return nil
+	case <-timeout:
+		return errTimeout
+	case <-s.sess.done:
+		return s.sess.Err()
+	}
+}
+
+func (s *Stream) Read(b []byte) (int, error) {
+	for {
+		s.mu.Lock()
+		if s.buf.Len() > 0 {
+			n, _ := s.buf.Read(b)
+			var grant int
+			if s.consumed += n; s.consumed >= s.sess.config.Window/2 && !s.finRecv {
+				grant = s.consumed
+				s.recvAvail += grant
+				s.consumed = 0
+			}
+			s.mu.Unlock()
+
+			if grant > 0 {
+				var payload [4]byte
+				binary.BigEndian.PutUint32(payload[:], uint32(grant))
+				s.sess.writeFrame(CMD_WINDOW, s.id, payload[:])
+			}
+			return n, nil
+		}
+		var err error
+		switch {
+		case s.reset:
+			err = ErrStreamReset
+		case s.closed:
+			err = ErrStreamClosed
+		case s.finRecv:
+			err = io.EOF
+		}
+		deadline := s.readDeadline
+		s.mu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+
+		if err = s.wait(s.readCh, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (s *Stream) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		s.mu.Lock()
+		switch {
+		case s.reset:
+			err = ErrStreamReset
+		case s.closed || s.finSent:
+			err = ErrStreamClosed
+		}
+		if err != nil {
+			s.mu.Unlock()
+			return n, err
+		}
+		if s.sendWindow == 0 {
+			deadline := s.writeDeadline
+			s.mu.Unlock()
+			if err = s.wait(s.writeCh, deadline); err != nil {
+				return n, err
+			}
+			continue
+		}
+		size := len(b)
+		if size > s.sendWindow {
+			size = s.sendWindow
+		}
+		if size > MAX_FRAME_SIZE {
+			size = MAX_FRAME_SIZE
+		}
+		s.sendWindow -= size
+		s.mu.Unlock()
+
+		if err = s.sess.writeFrame(CMD_DATA, s.id, b[:size]); err != nil {
+			return n, err
+		}
+		n += size
+		b = b[size:]
+	}
+	return n, nil
+}
+
+// CloseWrite sends FIN, the stream can still be read until peer sends FIN.
+func (s *Stream) CloseWrite() error {
+	s.mu.Lock()
+	if s.closed || s.finSent || s.reset {
+		s.mu.Unlock()
+		return nil
+	}
+	s.finSent = true
+	done := s.finRecv
+	s.mu.Unlock()
+
+	if done {
+		s.sess.remove(s.id)
+	}
+	notify(s.writeCh)
+	return s.sess.writeFrame(CMD_FIN, s.id, nil)
+}
+
+// Close sends FIN if not sent, data received after close resets the stream.
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	sendFin := !s.finSent && !s.reset
+	s.finSent = true
+	done := s.finRecv || s.reset
+	s.buf.Reset()
+	s.mu.Unlock()
+
+	notify(s.readCh)
+	notify(s.writeCh)
+	if done {
+		s.sess.remove(s.id)
+	}
+	if sendFin {
+		return s.sess.writeFrame(CMD_FIN, s.id, nil)
+	}
+	return nil
+}
+
+// push returns false if stream is closed or peer exceeds window.
+func (s *Stream) push(b []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed || s.finRecv || s.reset || len(b) > s.recvAvail {
+		s.reset = true
+		notify(s.readCh)
+		notify(s.writeCh)
+		return false
+	}
+	s.recvAvail -= len(b)
+	s.buf.Write(b)
+	notify(s.readCh)
+	return true
+}
+
+func (s *Stream) grow(n uint32) {
+	s.mu.Lock()
+	s.sendWindow += int(n)
+	s.mu.Unlock()
+	notify(s.writeCh)
+}
+
+func (s *Stream) finReceived() {
+	s.mu.Lock()
+	s.finRecv = true
+	done := s.finSent
+	s.mu.Unlock()
+
+	if done {
+		s.sess.remove(s.id)
+	}
+	notify(s.readCh)
+}
+
+func (s *Stream) resetReceived() {
+	s.mu.Lock()
+	s.reset = true
+	s.mu.Unlock()
+
+	s.sess.remove(s.id)
+	notify(s.readCh)
+	notify(s.writeCh)
+}
+
+func (s *Stream) LocalAddr() net.Addr {
+	return s.sess.LocalAddr()
+}
+
+func (s *Stream) RemoteAddr() net.Addr {
+	return s.sess.RemoteAddr()
+}
+
+func (s *Stream) SetDeadline(t time.Time) error {
+	s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
+}
+
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.readDeadline = t
+	s.mu.Unlock()
+	notify(s.readCh)
+	return nil
+}
+
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.writeDeadline = t
+	s.mu.Unlock()
+	notify(s.writeCh)
+	return nil
+}
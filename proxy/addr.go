@@ -2,7 +2,6 @@ package proxy
 
 import (
 	"encoding/binary"
-	"fmt"
 	"net"
 	"strconv"
 )
@@ -27,9 +26,12 @@ func NewAddr(typ byte, addr string) (a Addr, err error) {
 	switch typ {
 	case ADDR_IPV6, ADDR_IPV4:
 		ip := net.ParseIP(host)
-		if ip == nil || (typ == ADDR_IPV4 && len(ip) != 4) || (typ == ADDR_IPV6 && len(ip) != 6) {
+		if ip == nil {
 			return a, ErrIllegalAddr
 		}
+		if typ == ADDR_IPV4 {
+			ip = ip.To4()
+		}
 		return NewRawAddr(typ, ip, uint16(p))
 	case ADDR_DOMAIN_NAME:
 		return NewRawAddr(typ, []byte(host), uint16(p))
@@ -37,13 +39,29 @@ func NewAddr(typ byte, addr string) (a Addr, err error) {
 	return a, ErrIllegalAddr
 }
 
+// ParseAddr parse host:port, type of address is detected from host.
+func ParseAddr(addr string) (Addr, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return Addr{}, err
+	}
+	typ := ADDR_DOMAIN_NAME
+	if ip := net.ParseIP(host); ip != nil {
+		typ = ADDR_IPV6
+		if ip.To4() != nil {
+			typ = ADDR_IPV4
+		}
+	}
+	return NewAddr(typ, addr)
+}
+
 func NewRawAddr(typ byte, addr []byte, port uint16) (a Addr, err error) {
 	if port == 0 {
 		return a, ErrIllegalAddr
 	}
 	switch typ {
 	case ADDR_IPV4, ADDR_IPV6:
-		if (typ == ADDR_IPV4 && len(addr) != net.IPv4len) || (typ == ADDR_IPV4 && len(addr) != net.IPv6len) {
+		if (typ == ADDR_IPV4 && len(addr) != net.IPv4len) || (typ == ADDR_IPV6 && len(addr) != net.IPv6len) {
 			return a, ErrIllegalAddr
 		}
 	case ADDR_DOMAIN_NAME:
@@ -85,6 +103,16 @@ func (a *Addr) ToRaw() []byte {
 	return a.Raw
 }
 
+// HostString returns the host in text form, ip addresses are formatted rather
+// than returned as raw bytes.
+func (a *Addr) HostString() string {
+	switch a.Type {
+	case ADDR_IPV4, ADDR_IPV6:
+		return net.IP(a.Host).String()
+	}
+	return string(a.Host)
+}
+
 func (a *Addr) String() string {
-	return fmt.Sprintf("%s:%d", string(a.Host), a.Port)
+	return net.JoinHostPort(a.HostString(), strconv.Itoa(int(a.Port)))
 }
@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"net"
+)
+
+// Chain connects through each proxy in order, conn passed to Client must be
+// connected to the first proxy, the last proxy connects the destination. It
+// only works as client.
+type Chain []Proxy
+
+func (c Chain) Client(conn net.Conn, addr Addr) (net.Conn, error) {
+	var err error
+	for i, p := range c {
+		next := addr
+		if i < len(c)-1 {
+			if next, err = ParseAddr(c[i+1].Addr()); err != nil {
+				return conn, err
+			}
+		}
+		if conn, err = p.Client(conn, next); err != nil {
+			return conn, err
+		}
+	}
+	return conn, nil
+}
+
+// ClientEarly sends data with the request of the last proxy.
+func (c Chain) ClientEarly(conn net.Conn, addr Addr, data []byte) (net.Conn, error) {
+	last := len(c) - 1
+	if last > 0 {
+		next, err := ParseAddr(c[last].Addr())
+		if err != nil {
+			return conn, err
+		}
+		if conn, err = c[:last].Client(conn, next); err != nil {
+			return conn, err
+		}
+	}
+	return ClientEarly(c[last], conn, addr, data)
+}
+
+func (c Chain) Server(conn net.Conn) (net.Conn, Addr, error) {
+	return conn, Addr{}, ErrNoProxy
+}
+
+func (c Chain) Addr() string {
+	return c[0].Addr()
+}
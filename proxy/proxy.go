@@ -18,6 +18,44 @@ type Proxy interface {
 	Addr() string
 }
 
+// Replier is implemented by proxies whose UserServer.ServerUser leaves the
+// connect result to be replied after the outbound connection established, err
+// is nil on success. ErrNotAllowed means the request is rejected by rules.
+// Proxy.Server still replies success itself.
+type Replier interface {
+	Reply(conn net.Conn, err error) error
+}
+
+// EarlyDataClient is implemented by proxies which can send the first payload
+// with the request in a single write.
+type EarlyDataClient interface {
+	ClientEarly(conn net.Conn, addr Addr, data []byte) (net.Conn, error)
+}
+
+// ClientEarly sends data with the request if p supports, otherwise data is
+// written after request.
+func ClientEarly(p Proxy, conn net.Conn, addr Addr, data []byte) (net.Conn, error) {
+	if len(data) == 0 {
+		return p.Client(conn, addr)
+	}
+	if e, ok := p.(EarlyDataClient); ok {
+		return e.ClientEarly(conn, addr, data)
+	}
+	c, err := p.Client(conn, addr)
+	if err == nil {
+		// conn may encrypt in place, data is kept for retries
+		_, err = c.Write(append([]byte(nil), data...))
+	}
+	return c, err
+}
+
 func debugForward(conn net.Conn, addr Addr) {
 	//	log.Debug("forward for:", conn.RemoteAddr(), "To:", string(addr.Host), addr.Port)
 }
+
+// UserServer is implemented by proxies which authenticate users, ServerUser is
+// same as Proxy.Server but also returns the user name, and if the proxy is a
+// Replier, the reply is deferred to Reply.
+type UserServer interface {
+	ServerUser(net.Conn) (net.Conn, Addr, string, error)
+}
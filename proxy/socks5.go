@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"strings"
 
 	"github.com/cosiner/gohper/ds/set"
 )
@@ -21,6 +22,7 @@ var (
 	ErrHostUnreachable         = errors.New("host unreachable")
 	ErrConnRefused             = errors.New("connection refused")
 	ErrTTLExpired              = errors.New("ttl expired")
+	ErrNotAllowed              = errors.New("connection not allowed by ruleset")
 )
 
 const (
@@ -28,7 +30,7 @@ const (
 
 	AUTH_NOT_REQUIRED byte = 0x00
 	_AUTH_GSS_API     byte = 0x01 // unsupported
-	AUTH_USER_PASS    byte = 0x03
+	AUTH_USER_PASS    byte = 0x02
 	AUTH_UNACCEPTABLE byte = 0xff
 
 	CMD_CONNECT        byte = 0x01
@@ -161,6 +163,8 @@ func (s *Socks5) clientHandshake(conn net.Conn) (authRequired bool, err error) {
 
 func replyError(code byte) error {
 	switch code {
+	case 0x02:
+		return ErrNotAllowed
 	case 0x03:
 		return ErrNetworkUnreachable
 	case 0x04:
@@ -173,6 +177,33 @@ func replyError(code byte) error {
 	return fmt.Errorf("connection failed: %d", code)
 }
 
+func replyCode(err error) byte {
+	switch err {
+	case nil:
+		return 0x00
+	case ErrNotAllowed:
+		return 0x02
+	case ErrNetworkUnreachable:
+		return 0x03
+	case ErrHostUnreachable:
+		return 0x04
+	case ErrConnRefused:
+		return 0x05
+	case ErrTTLExpired:
+		return 0x06
+	}
+
+	switch msg := err.Error(); {
+	case strings.Contains(msg, "connection refused"):
+		return 0x05
+	case strings.Contains(msg, "network is unreachable"):
+		return 0x03
+	case strings.Contains(msg, "no route to host"), strings.Contains(msg, "no such host"):
+		return 0x04
+	}
+	return 0x01
+}
+
 const _MAX_CONNECT_DATA_LEN = 4 + 1 + 255 + 2
 
 //  | Ver 1 | CMD 1 | Rsv 0x00 | AddrType 1 | DstAddr dynamic | DstPort 2 |
@@ -261,30 +292,31 @@ func (s *Socks5) serverHandshake(conn net.Conn) (authRequired bool, err error) {
 
 	conn.Write([]byte{SOCKS_VER, selected})
 	if selected == AUTH_UNACCEPTABLE {
-		err = ErrNoProxy
+		err = ErrNoSupportedMethods
 	}
 	return selected == AUTH_USER_PASS, err
 }
 
-func (s *Socks5) serverVerifyUserPass(conn net.Conn) error {
-	var req [512]byte
-	un, err := io.ReadAtLeast(conn, req[:], 2)
+// | Ver 1 | UserLen 1 | User dynamic | PassLen 1 | Pass dynamic |
+func (s *Socks5) serverVerifyUserPass(conn net.Conn) (string, error) {
+	var req [513]byte
+	_, err := io.ReadFull(conn, req[:2])
 	if err != nil {
-		return err
+		return "", err
 	}
 	if req[0] != USER_PASS_VERIFY_VER {
 		conn.Write([]byte{USER_PASS_VERIFY_VER, USER_PASS_VERIFY_FAILED})
-		return ErrNoProxy
+		return "", ErrNoProxy
 	}
-	userLen := int(req[2])
-	pn, err := io.ReadAtLeast(conn, req[un:], userLen+1)
+	userLen := int(req[1])
+	_, err = io.ReadFull(conn, req[2:3+userLen])
 	if err != nil {
-		return err
+		return "", err
 	}
-	passLen := int(req[userLen+2])
-	_, err = io.ReadFull(conn, req[un+pn:3+userLen+passLen])
+	passLen := int(req[2+userLen])
+	_, err = io.ReadFull(conn, req[3+userLen:3+userLen+passLen])
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	user := req[2 : 2+userLen]
@@ -292,10 +324,10 @@ func (s *Socks5) serverVerifyUserPass(conn net.Conn) error {
 	verified := s.userPass.Verify(string(user), string(pass))
 	if verified {
 		conn.Write([]byte{USER_PASS_VERIFY_VER, USER_PASS_VERIFY_SUCCESS})
-		return nil
+		return string(user), nil
 	}
 	conn.Write([]byte{USER_PASS_VERIFY_VER, USER_PASS_VERIFY_FAILED})
-	return ErrNoProxy
+	return "", ErrAuthFailed
 }
 
 func (s *Socks5) serverConnectResp(code byte) []byte {
@@ -340,10 +372,6 @@ func (s *Socks5) serverConnect(conn net.Conn) (a Addr, err error) {
 	if err != nil {
 		return a, err
 	}
-	_, err = conn.Write(s.serverConnectResp(0x00))
-	if err != nil {
-		return a, err
-	}
 
 	a, err = NewRawAddr(atyp, req[addrIndex:rawLen-2], binary.BigEndian.Uint16(req[rawLen-2:rawLen]))
 	if err == nil {
@@ -353,16 +381,34 @@ func (s *Socks5) serverConnect(conn net.Conn) (a Addr, err error) {
 	return
 }
 
+// Server parse the connect request and replies success.
 func (s *Socks5) Server(conn net.Conn) (c net.Conn, a Addr, err error) {
+	c, a, _, err = s.ServerUser(conn)
+	if err == nil {
+		err = s.Reply(conn, nil)
+	}
+	return c, a, err
+}
+
+// ServerUser is same as Server but also returns the authenticated user, it's
+// empty if auth is not required. The reply is deferred to Reply after the
+// outbound connection established.
+func (s *Socks5) ServerUser(conn net.Conn) (c net.Conn, a Addr, user string, err error) {
 	var authRequired bool
 	authRequired, err = s.serverHandshake(conn)
 	if err == nil {
 		if authRequired {
-			err = s.serverVerifyUserPass(conn)
+			user, err = s.serverVerifyUserPass(conn)
 		}
 		if err == nil {
 			a, err = s.serverConnect(conn)
 		}
 	}
-	return conn, a, err
+	return conn, a, user, err
+}
+
+// Reply send the connect result to client.
+func (s *Socks5) Reply(conn net.Conn, err error) error {
+	_, err = conn.Write(s.serverConnectResp(replyCode(err)))
+	return err
 }
@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/cosiner/gohper/testing2"
+)
+
+type socks5Result struct {
+	addr Addr
+	user string
+	err  error
+}
+
+// socks5Auth runs a socks5 handshake of client with server authenticating
+// users.
+func socks5Auth(t *testing.T, client *Socks5, users map[string]string) (socks5Result, error) {
+	server, err := NewSocks5([]byte{AUTH_USER_PASS}, NewUserPass(users), "")
+	testing2.True(t, err == nil)
+
+	c, s := net.Pipe()
+	defer c.Close()
+	result := make(chan socks5Result, 1)
+	go func() {
+		defer s.Close()
+		_, addr, user, err := server.ServerUser(s)
+		if err == nil {
+			server.Reply(s, nil)
+		}
+		result <- socks5Result{addr, user, err}
+	}()
+
+	addr, _ := NewRawAddr(ADDR_DOMAIN_NAME, []byte("example.com"), 443)
+	_, err = client.Client(c, addr)
+	return <-result, err
+}
+
+func TestSocks5UserPass(t *testing.T) {
+	users := map[string]string{"alice": "secret"}
+	client, err := NewSocks5([]byte{AUTH_USER_PASS}, NewUserPass(users), "")
+	testing2.True(t, err == nil)
+	res, err := socks5Auth(t, client, users)
+	testing2.True(t, err == nil && res.err == nil)
+	testing2.True(t, res.user == "alice" && res.addr.String() == "example.com:443")
+
+	client, _ = NewSocks5([]byte{AUTH_USER_PASS}, NewUserPass(map[string]string{"alice": "wrong"}), "")
+	res, err = socks5Auth(t, client, users)
+	testing2.True(t, err == ErrAuthFailed && res.err == ErrAuthFailed)
+}
+
+// username/password auth of RFC 1929 is method 0x02, a request may arrive in
+// pieces.
+func TestSocks5UserPassWire(t *testing.T) {
+	server, _ := NewSocks5([]byte{AUTH_USER_PASS}, NewUserPass(map[string]string{"bob": "pw"}), "")
+	c, s := net.Pipe()
+	defer c.Close()
+	result := make(chan socks5Result, 1)
+	go func() {
+		defer s.Close()
+		_, addr, user, err := server.ServerUser(s)
+		result <- socks5Result{addr, user, err}
+	}()
+
+	resp := make([]byte, 2)
+	c.Write([]byte{SOCKS_VER, 1, 0x02})
+	io.ReadFull(c, resp)
+	testing2.True(t, resp[0] == SOCKS_VER && resp[1] == 0x02)
+
+	for _, b := range [][]byte{{USER_PASS_VERIFY_VER}, {3, 'b'}, {'o', 'b', 2, 'p'}, {'w'}} {
+		c.Write(b)
+	}
+	io.ReadFull(c, resp)
+	testing2.True(t, resp[0] == USER_PASS_VERIFY_VER && resp[1] == USER_PASS_VERIFY_SUCCESS)
+	c.Write([]byte{SOCKS_VER, CMD_CONNECT, 0, ADDR_IPV4, 127, 0, 0, 1, 0, 80})
+	res := <-result
+	testing2.True(t, res.err == nil && res.user == "bob" && res.addr.String() == "127.0.0.1:80")
+}
+
+// Server replies success itself, ServerUser leaves it to Reply.
+func TestSocks5ServerReply(t *testing.T) {
+	server, _ := NewSocks5([]byte{AUTH_NOT_REQUIRED}, nil, "")
+	client, _ := NewSocks5([]byte{AUTH_NOT_REQUIRED}, nil, "")
+	addr, _ := NewRawAddr(ADDR_DOMAIN_NAME, []byte("example.com"), 443)
+
+	c, s := net.Pipe()
+	go server.Server(s)
+	_, err := client.Client(c, addr)
+	testing2.True(t, err == nil)
+	c.Close()
+	s.Close()
+
+	c, s = net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	go func() {
+		server.ServerUser(s)
+		server.Reply(s, ErrNotAllowed)
+	}()
+	_, err = client.Client(c, addr)
+	testing2.True(t, err == ErrNotAllowed)
+}
@@ -1,18 +1,27 @@
 package proxy
 
 import (
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+
+	"github.com/cosiner/tunnel/mux"
 )
 
 type (
 	Tunnel struct {
-		addr string
+		addr  string
+		keyID string
 
 		originCipher *Cipher
+
+		// HalfClose requests framed mode for connections of client, server
+		// accepts both modes
+		HalfClose bool
 	}
 )
 
@@ -36,6 +45,7 @@ func NewTunnel(method, key, addr string) (Proxy, error) {
 
 	return &Tunnel{
 		addr:         addr,
+		keyID:        KeyID(key),
 		originCipher: NewCipher([]byte(key), meta),
 	}, nil
 }
@@ -44,29 +54,88 @@ func (t *Tunnel) Addr() string {
 	return t.addr
 }
 
+// KeyID identifies the key of tunnel without revealing it, e.g. in stats.
+func (t *Tunnel) KeyID() string {
+	return t.keyID
+}
+
+func KeyID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:4])
+}
+
+// ADDR_MUX as request address starts a mux session instead of a connection,
+// the request is | ADDR_MUX 1 | mux version 1 |, and addresses of streams are
+// sent as the first bytes of each stream.
+const ADDR_MUX byte = 0x7f
+
+var MuxAddr = Addr{Type: ADDR_MUX, Raw: []byte{ADDR_MUX, mux.VERSION}}
+
+// ADDR_REVERSE as request address starts a reverse binding, the request is
+// | ADDR_REVERSE 1 | mux version 1 |, followed by the bind request, then the
+// connection carries a mux session whose streams are opened by server.
+const ADDR_REVERSE byte = 0x7e
+
+var ReverseAddr = Addr{Type: ADDR_REVERSE, Raw: []byte{ADDR_REVERSE, mux.VERSION}}
+
 // | AddrType 1 | Addr dynamic | Port 2 |
-func (t *Tunnel) clientRequest(conn net.Conn, addr Addr) error {
+func (t *Tunnel) clientRequest(addr Addr) (req []byte, framed bool, err error) {
 	switch addr.Type {
 	case ADDR_IPV4, ADDR_IPV6, ADDR_DOMAIN_NAME:
+		framed = t.HalfClose
+	case ADDR_MUX, ADDR_REVERSE:
 	default:
-		return fmt.Errorf("unsupported addr type: %d", addr.Type)
+		return nil, false, fmt.Errorf("unsupported addr type: %d", addr.Type)
 	}
-	debugForward(conn, addr)
-	_, err := conn.Write(addr.ToRaw())
-	return err
+	raw := addr.ToRaw()
+	req = make([]byte, len(raw), len(raw)+2)
+	copy(req, raw)
+	if framed {
+		req[0] |= ADDR_FLAG_HALF_CLOSE
+	}
+	return req, framed, nil
 }
 
 func (t *Tunnel) Client(conn net.Conn, addr Addr) (net.Conn, error) {
-	conn = NewConn(conn, t.originCipher.Copy())
-	return conn, t.clientRequest(conn, addr)
+	return t.ClientEarly(conn, addr, nil)
 }
 
-func (t *Tunnel) serverRequest(conn net.Conn) (a Addr, err error) {
-	var rawAddr [259]byte
-	_, err = io.ReadFull(conn, rawAddr[:2])
+// ClientEarly sends iv, request and data in one write.
+func (t *Tunnel) ClientEarly(conn net.Conn, addr Addr, data []byte) (net.Conn, error) {
+	c := &Conn{Conn: conn, cipher: t.originCipher.Copy()}
+	req, framed, err := t.clientRequest(addr)
+	if err != nil {
+		return c, err
+	}
+	debugForward(c, addr)
+	if len(data) > 0 {
+		if framed {
+			if len(data) > _FRAME_MAX_DATA {
+				return c, ErrBadFormat
+			}
+			req = append(req, byte(len(data)>>8), byte(len(data)))
+		}
+		req = append(req, data...)
+	}
+	if _, err = c.Write(req); err != nil || !framed {
+		return c, err
+	}
+	return newFramedConn(c), nil
+}
+
+// ReadAddr reads | AddrType 1 | Addr dynamic | Port 2 | from r.
+func ReadAddr(r io.Reader) (a Addr, err error) {
+	var head [2]byte
+	_, err = io.ReadFull(r, head[:])
 	if err != nil {
 		return a, err
 	}
+	return readAddr(r, head)
+}
+
+func readAddr(r io.Reader, head [2]byte) (a Addr, err error) {
+	var rawAddr [259]byte
+	copy(rawAddr[:2], head[:])
 
 	a.Type = rawAddr[0]
 	var rawLen int
@@ -85,18 +154,48 @@ func (t *Tunnel) serverRequest(conn net.Conn) (a Addr, err error) {
 		return a, fmt.Errorf("unsupported addr type: %d", a.Type)
 	}
 
-	_, err = io.ReadFull(conn, rawAddr[2:rawLen])
+	_, err = io.ReadFull(r, rawAddr[2:rawLen])
 	if err != nil {
 		return a, err
 	}
 	a.Host = rawAddr[addrIndex : rawLen-2]
 	a.Port = binary.BigEndian.Uint16(rawAddr[rawLen-2 : rawLen])
-	debugForward(conn, a)
 	return a, nil
 }
 
+func (t *Tunnel) serverRequest(conn net.Conn) (a Addr, framed bool, err error) {
+	var head [2]byte
+	_, err = io.ReadFull(conn, head[:])
+	if err != nil {
+		return a, false, err
+	}
+	switch head[0] {
+	case ADDR_MUX, ADDR_REVERSE:
+		if head[1] != mux.VERSION {
+			return a, false, fmt.Errorf("unsupported mux version: %d", head[1])
+		}
+		if head[0] == ADDR_MUX {
+			return MuxAddr, false, nil
+		}
+		return ReverseAddr, false, nil
+	}
+	if head[0]&ADDR_FLAG_HALF_CLOSE != 0 {
+		head[0] &^= ADDR_FLAG_HALF_CLOSE
+		framed = true
+	}
+
+	a, err = readAddr(conn, head)
+	if err == nil {
+		debugForward(conn, a)
+	}
+	return a, framed, err
+}
+
 func (t *Tunnel) Server(conn net.Conn) (c net.Conn, a Addr, err error) {
-	conn = NewConn(conn, t.originCipher.Copy())
-	a, err = t.serverRequest(conn)
-	return conn, a, err
+	tc := &Conn{Conn: conn, cipher: t.originCipher.Copy(), ivs: seenIvs}
+	a, framed, err := t.serverRequest(tc)
+	if err != nil || !framed {
+		return tc, a, err
+	}
+	return newFramedConn(tc), a, nil
 }
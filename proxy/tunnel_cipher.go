@@ -3,9 +3,11 @@ package proxy
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/md5"
 	"crypto/rand"
 	"crypto/rc4"
+	"crypto/sha256"
 	"io"
 )
 
@@ -23,8 +25,10 @@ type (
 	Cipher struct {
 		key []byte
 
-		enc cipher.Stream
-		dec cipher.Stream
+		enc   cipher.Stream
+		dec   cipher.Stream
+		encIv []byte
+		decIv []byte
 
 		meta *CipherMeta
 	}
@@ -118,6 +122,7 @@ func (c *Cipher) InitEnc() ([]byte, error) {
 	iv, err := c.meta.NewIv()
 	if err == nil {
 		c.enc, err = c.meta.NewStream(c.key, iv, true)
+		c.encIv = iv
 	}
 	return iv, err
 }
@@ -133,6 +138,7 @@ func (c *Cipher) Encrypt(dst, src []byte) {
 func (c *Cipher) InitDec(iv []byte) error {
 	var err error
 	c.dec, err = c.meta.NewStream(c.key, iv, false)
+	c.decIv = append([]byte(nil), iv...)
 	return err
 }
 
@@ -143,3 +149,12 @@ func (c *Cipher) IsDecInited() bool {
 func (c *Cipher) Decrypt(dst, src []byte) {
 	c.dec.XORKeyStream(dst, src)
 }
+
+// Tag returns the authentication tag of label for the stream started with iv,
+// it can't be forged without key.
+func (c *Cipher) Tag(iv []byte, label string, size int) []byte {
+	m := hmac.New(sha256.New, c.key)
+	m.Write(iv)
+	m.Write([]byte(label))
+	return m.Sum(nil)[:size]
+}
@@ -9,6 +9,9 @@ type (
 	Conn struct {
 		cipher *Cipher
 		net.Conn
+
+		ivs      *ivFilter // server only, detects replayed ivs
+		replayed bool
 	}
 )
 
@@ -26,6 +29,9 @@ func (c *Conn) Read(b []byte) (int, error) {
 		if err != nil {
 			return 0, err
 		}
+		if c.ivs != nil && !c.ivs.add(iv) {
+			c.replayed = true
+		}
 
 		err = c.cipher.InitDec(iv)
 		if err != nil {
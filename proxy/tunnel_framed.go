@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+// ADDR_FLAG_HALF_CLOSE set in address type of tunnel request switches the
+// connection to framed mode, which is able to close one direction.
+//
+// Frame: | Len 2 | Data Len |, Len 0 is the end of stream marker followed by
+// | Tag 16 |, the tag is bound to the iv of the direction so it can't be
+// forged by flipping bits of encrypted stream, or replayed from others.
+const ADDR_FLAG_HALF_CLOSE byte = 0x80
+
+const (
+	_FRAME_MAX_DATA = 0xffff
+	_EOS_TAG_LEN    = 16
+	_EOS_LABEL      = "end of stream"
+)
+
+var (
+	ErrBadEndOfStream = errors.New("bad end of stream marker")
+	ErrWriteClosed    = errors.New("write side closed")
+)
+
+// FramedConn is a tunnel connection in framed mode, CloseWrite sends end of
+// stream to peer, whose Read returns io.EOF once data before it are read.
+type FramedConn struct {
+	*Conn
+
+	remaining int
+	eof       bool
+
+	wmu     sync.Mutex
+	wclosed bool
+}
+
+func newFramedConn(c *Conn) *FramedConn {
+	return &FramedConn{Conn: c}
+}
+
+func (c *FramedConn) Read(b []byte) (int, error) {
+	if c.eof {
+		return 0, io.EOF
+	}
+	if c.remaining == 0 {
+		var l [2]byte
+		if _, err := io.ReadFull(c.Conn, l[:]); err != nil {
+			return 0, err
+		}
+		if c.remaining = int(binary.BigEndian.Uint16(l[:])); c.remaining == 0 {
+			tag := make([]byte, _EOS_TAG_LEN)
+			if _, err := io.ReadFull(c.Conn, tag); err != nil {
+				return 0, err
+			}
+			if !hmac.Equal(tag, c.cipher.Tag(c.cipher.decIv, _EOS_LABEL, _EOS_TAG_LEN)) {
+				return 0, ErrBadEndOfStream
+			}
+			c.eof = true
+			return 0, io.EOF
+		}
+	}
+	if len(b) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.Conn.Read(b)
+	c.remaining -= n
+	return n, err
+}
+
+func (c *FramedConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.wclosed {
+		return 0, ErrWriteClosed
+	}
+
+	var n int
+	for len(b) > 0 {
+		size := len(b)
+		if size > _FRAME_MAX_DATA {
+			size = _FRAME_MAX_DATA
+		}
+		frame := make([]byte, 2+size)
+		binary.BigEndian.PutUint16(frame, uint16(size))
+		copy(frame[2:], b[:size])
+		if _, err := c.Conn.Write(frame); err != nil {
+			return n, err
+		}
+		n += size
+		b = b[size:]
+	}
+	return n, nil
+}
+
+// CloseWrite sends end of stream marker, reading is still available.
+func (c *FramedConn) CloseWrite() error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.wclosed {
+		return nil
+	}
+	c.wclosed = true
+
+	if !c.cipher.IsEncInited() {
+		// tag is bound to iv which is sent on first write
+		if _, err := c.Conn.Write(nil); err != nil {
+			return err
+		}
+	}
+	marker := make([]byte, 2, 2+_EOS_TAG_LEN)
+	marker = append(marker, c.cipher.Tag(c.cipher.encIv, _EOS_LABEL, _EOS_TAG_LEN)...)
+	_, err := c.Conn.Write(marker)
+	return err
+}
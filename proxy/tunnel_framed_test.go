@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"testing"
+
+	"github.com/cosiner/gohper/testing2"
+)
+
+// flipConn flips the last bit written once flip set.
+type flipConn struct {
+	net.Conn
+	flip bool
+}
+
+func (c *flipConn) Write(b []byte) (int, error) {
+	if c.flip && len(b) > 0 {
+		b = append([]byte(nil), b...)
+		b[len(b)-1] ^= 1
+	}
+	return c.Conn.Write(b)
+}
+
+// framedPair returns framed connections of client and server, wrap wraps the
+// raw connection of client if it's not nil.
+func framedPair(t *testing.T, wrap func(net.Conn) net.Conn) (client, server net.Conn) {
+	p, _ := NewTunnel("aes-256-cfb", "key", "tunnel")
+	p.(*Tunnel).HalfClose = true
+	addr, _ := NewRawAddr(ADDR_IPV4, net.IPv4(127, 0, 0, 1).To4(), 80)
+
+	raw, s := net.Pipe()
+	if wrap != nil {
+		raw = wrap(raw)
+	}
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		client, err = p.Client(raw, addr)
+		done <- err
+	}()
+	server, _, err := p.Server(s)
+	testing2.True(t, err == nil)
+	testing2.True(t, <-done == nil)
+	_, ok := client.(*FramedConn)
+	testing2.True(t, ok)
+	return client, server
+}
+
+func TestFramedLargeWrite(t *testing.T) {
+	client, server := framedPair(t, nil)
+	defer client.Close()
+	defer server.Close()
+
+	data := make([]byte, 3*_FRAME_MAX_DATA+100)
+	rand.Read(data)
+	go func() {
+		client.Write(data)
+		client.(*FramedConn).CloseWrite()
+	}()
+	got, err := ioutil.ReadAll(server)
+	testing2.True(t, err == nil)
+	testing2.True(t, bytes.Equal(data, got))
+}
+
+func TestFramedBadEndOfStream(t *testing.T) {
+	raw := &flipConn{}
+	client, server := framedPair(t, func(c net.Conn) net.Conn {
+		raw.Conn = c
+		return raw
+	})
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		client.Write([]byte("data"))
+		raw.flip = true
+		client.(*FramedConn).CloseWrite()
+	}()
+	buf := make([]byte, 8)
+	n, err := io.ReadFull(server, buf[:4])
+	testing2.True(t, err == nil && string(buf[:n]) == "data")
+	_, err = server.Read(buf)
+	testing2.True(t, err == ErrBadEndOfStream)
+}
+
+func TestFramedCloseWriteFirst(t *testing.T) {
+	client, server := framedPair(t, nil)
+	defer client.Close()
+	defer server.Close()
+
+	// server closes write before writing anything, iv is sent with the marker
+	go server.(*FramedConn).CloseWrite()
+	_, err := client.Read(make([]byte, 8))
+	testing2.True(t, err == io.EOF)
+
+	_, err = server.Write([]byte("data"))
+	testing2.True(t, err == ErrWriteClosed)
+	go client.Write([]byte("data"))
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(server, buf)
+	testing2.True(t, err == nil && string(buf) == "data")
+}
@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+)
+
+// ivs kept in each generation of ivFilter
+const _IV_FILTER_SIZE = 1 << 16
+
+// ivFilter remembers ivs seen by tunnel servers, it keeps two generations,
+// the older one is dropped once the newer one is full.
+type ivFilter struct {
+	mu   sync.Mutex
+	cur  map[string]struct{}
+	prev map[string]struct{}
+}
+
+func newIvFilter() *ivFilter {
+	return &ivFilter{cur: make(map[string]struct{})}
+}
+
+// add returns false if iv was seen.
+func (f *ivFilter) add(iv []byte) bool {
+	key := string(iv)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, has := f.cur[key]; has {
+		return false
+	}
+	if _, has := f.prev[key]; has {
+		return false
+	}
+	if len(f.cur) >= _IV_FILTER_SIZE {
+		f.prev, f.cur = f.cur, make(map[string]struct{})
+	}
+	f.cur[key] = struct{}{}
+	return true
+}
+
+// ivs seen by all tunnel servers, it's shared so it survives tunnels rebuilt
+var seenIvs = newIvFilter()
+
+// Replayed reports whether the iv of a connection returned by Tunnel.Server
+// was seen recently, a replayed connection is decrypted to the same request,
+// it's usually sent by an observer probing the server.
+func Replayed(conn net.Conn) bool {
+	switch c := conn.(type) {
+	case *Conn:
+		return c.replayed
+	case *FramedConn:
+		return c.replayed
+	}
+	return false
+}
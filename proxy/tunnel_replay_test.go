@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/cosiner/gohper/testing2"
+)
+
+func TestIvFilter(t *testing.T) {
+	f := newIvFilter()
+	iv := func(i int) []byte {
+		b := make([]byte, 16)
+		binary.BigEndian.PutUint64(b, uint64(i))
+		return b
+	}
+
+	for i := 0; i < _IV_FILTER_SIZE; i++ {
+		testing2.True(t, f.add(iv(i)))
+	}
+	testing2.False(t, f.add(iv(0)))
+
+	// the full generation becomes the older one, ivs are still seen
+	testing2.True(t, f.add(iv(_IV_FILTER_SIZE)))
+	testing2.False(t, f.add(iv(1)))
+	testing2.False(t, f.add(iv(_IV_FILTER_SIZE)))
+
+	// the older generation is dropped once the newer one is full again
+	for i := _IV_FILTER_SIZE + 1; i < 2*_IV_FILTER_SIZE; i++ {
+		testing2.True(t, f.add(iv(i)))
+	}
+	testing2.True(t, f.add(iv(2*_IV_FILTER_SIZE)))
+	testing2.True(t, f.add(iv(2)))
+	testing2.False(t, f.add(iv(_IV_FILTER_SIZE+1)))
+}
+
+func TestTunnelReplayed(t *testing.T) {
+	p, _ := NewTunnel("aes-128-cfb", "key", "tunnel")
+	addr, _ := NewRawAddr(ADDR_IPV4, net.IPv4(127, 0, 0, 1).To4(), 80)
+
+	var request []byte
+	for i := 0; i < 2; i++ {
+		client, server := net.Pipe()
+		if request == nil {
+			rec := &recordConn{Conn: client}
+			go p.Client(rec, addr)
+			conn, a, err := p.Server(server)
+			testing2.True(t, err == nil && a.String() == addr.String())
+			testing2.False(t, Replayed(conn))
+			request = rec.written
+		} else {
+			// replayed request is served but detected
+			go client.Write(request)
+			conn, a, err := p.Server(server)
+			testing2.True(t, err == nil && a.String() == addr.String())
+			testing2.True(t, Replayed(conn))
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+// recordConn records data written.
+type recordConn struct {
+	net.Conn
+	written []byte
+}
+
+func (c *recordConn) Write(b []byte) (int, error) {
+	c.written = append(c.written, b...)
+	return c.Conn.Write(b)
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/cosiner/gohper/utils/encodeio"
+	"github.com/cosiner/tunnel/server"
+	log "github.com/cosiner/ygo/jsonlog"
+)
+
+// configError is raised by configFatal while building components from config,
+// it's fatal on start and aborts the reload.
+type configError log.M
+
+func (e configError) Error() string {
+	b, _ := json.Marshal(e)
+	return string(b)
+}
+
+func configFatal(m log.M) {
+	panic(configError(m))
+}
+
+// stopper is a signal closed by stop or once servers closed.
+type stopper struct {
+	sig  server.Signal
+	once sync.Once
+}
+
+func newStopper(servers *server.Servers) *stopper {
+	s := &stopper{sig: server.NewSignal()}
+	go func() {
+		select {
+		case <-servers.Signal():
+			s.stop()
+		case <-s.sig:
+		}
+	}()
+	return s
+}
+
+func (s *stopper) stop() {
+	s.once.Do(s.sig.Close)
+}
+
+type tunnelNode struct {
+	*server.TunnelNode
+	stop *stopper
+}
+
+// app holds servers and components built from config. Reload builds all of
+// them again except tunnel nodes and auto route not changed, then swaps them
+// into listeners running, connections in flight keep running with the old
+// ones. Building may fetch site lists, so it's done without the lock, reloads
+// are serialized by reloadMu.
+type app struct {
+	reloadMu sync.Mutex
+	mu       sync.Mutex // held while swapping components
+	cfg      *Config
+	closed   bool
+	servers  *server.Servers
+	gen      *stopper // components of current config run until it stopped
+	tunnels  []*server.TunnelNode
+
+	listeners  map[string]*server.Listener // by address
+	transports map[string]string           // transport config of remote listeners
+	nodes      map[string]*tunnelNode      // by config of tunnel
+	bindings   []*server.ReverseBinding
+	bindingKey string
+	auto       *server.AutoRoute
+	autoStop   *stopper
+}
+
+func newApp() *app {
+	servers := server.NewServers()
+	return &app{
+		servers:    servers,
+		gen:        newStopper(servers),
+		listeners:  make(map[string]*server.Listener),
+		transports: make(map[string]string),
+		nodes:      make(map[string]*tunnelNode),
+	}
+}
+
+func jsonKey(v ...interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+var errServersClosed = errors.New("servers closed")
+
+// reload re-reads config file and applies it, old config is kept if it's
+// invalid.
+func (a *app) reload() error {
+	a.reloadMu.Lock()
+	defer a.reloadMu.Unlock()
+
+	var cfg Config
+	err := encodeio.ReadJSONWithComment(conf, &cfg)
+	if err == nil {
+		if cfg.Log != a.cfg.Log {
+			log.Warn(log.M{"msg": "log config changed, restart to apply"})
+		}
+		if cfg.Accounting.File != a.cfg.Accounting.File {
+			log.Warn(log.M{"msg": "accounting file changed, restart to apply", "file": cfg.Accounting.File})
+		}
+		if cfg.Admin != a.cfg.Admin || cfg.Metrics != a.cfg.Metrics {
+			log.Warn(log.M{"msg": "admin or metrics config changed, restart to apply"})
+		}
+		if err = a.apply(&cfg); err == nil {
+			log.Info(log.M{"msg": "config reloaded", "server_num": len(a.listeners)})
+		}
+	}
+	if err != nil {
+		server.DefaultStats.Incr("reloads_total", "result", "failed")
+		log.Error(log.M{"msg": "reload config failed, old config kept", "err": err.Error()})
+		return err
+	}
+	server.DefaultStats.Incr("reloads_total", "result", "ok")
+	return nil
+}
+
+// apply builds components from cfg and runs them, nothing is changed if it
+// fails. Caller should hold reloadMu except on start.
+func (a *app) apply(cfg *Config) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			cerr, ok := e.(configError)
+			if !ok {
+				panic(e)
+			}
+			err = cerr
+		}
+	}()
+
+	if runLocal {
+		return a.applyLocal(cfg)
+	}
+	return a.applyRemote(cfg)
+}
+
+// swap calls fn to replace running components by the ones built from cfg, with
+// the lock held. It fails if servers closed.
+func (a *app) swap(cfg *Config, fn func() error) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.closed {
+		return errServersClosed
+	}
+	if err := fn(); err != nil {
+		return err
+	}
+	a.cfg = cfg
+	return nil
+}
+
+// globals holds package level settings of server, they are built before
+// listeners changed and set after.
+type globals struct {
+	cfg      *Config
+	timeouts server.Timeouts
+	quota    server.Quota
+	quotas   map[string]server.Quota
+}
+
+func newGlobals(cfg *Config) *globals {
+	g := &globals{cfg: cfg, timeouts: newTimeouts(cfg)}
+	g.quota, g.quotas = newQuotas(cfg)
+	return g
+}
+
+func (g *globals) set() {
+	server.SetPipeLinger(durationOr(g.cfg.Linger, time.Second, server.PipeLinger))
+	server.SetTimeouts(g.timeouts)
+	setRateLimits(g.cfg, server.DefaultRateLimits)
+	if server.DefaultAccounting != nil {
+		server.DefaultAccounting.SetQuotas(g.quota, g.quotas)
+	}
+}
+
+func (a *app) applyLocal(cfg *Config) error {
+	if len(cfg.Socks) == 0 || len(cfg.Tunnels) == 0 {
+		configFatal(log.M{"msg": "empty socks or tunnels"})
+	}
+	var (
+		g          = newGlobals(cfg)
+		loader     = newListLoader(cfg)
+		router     = newRouter(cfg, loader, a.auto)
+		socks      = newSocks(cfg)
+		tunnels    = newTunnels(cfg)
+		transports = newTransports(cfg)
+		nodes      = make([]*server.TunnelNode, len(tunnels))
+		nodeMap    = make(map[string]*tunnelNode, len(tunnels))
+	)
+	for i, t := range tunnels {
+		key := jsonKey(cfg.Tunnels[i], cfg.Pool, cfg.Mux, cfg.HealthCheck)
+		for nodeMap[key] != nil {
+			key += "#"
+		}
+		n := a.nodes[key]
+		if n == nil {
+			n = &tunnelNode{TunnelNode: newTunnelNode(cfg, i, t, transports[i])}
+		}
+		nodeMap[key] = n
+		nodes[i] = n.TunnelNode
+	}
+	groups := newGroups(cfg, nodes)
+	routeGroups(cfg, router, groups)
+	var (
+		policies   = newPolicies(cfg, router, nodes, groups)
+		sockGroups = socksGroups(cfg, groups)
+		earlyWait  = durationOr(cfg.EarlyData, time.Millisecond, 0)
+		checker    = newHealthChecker(cfg, nodes)
+		bindingKey = jsonKey(cfg.Reverse, cfg.Tunnels, cfg.Pool, cfg.Mux, cfg.HealthCheck)
+		bindings   = a.bindings
+	)
+	if bindingKey != a.bindingKey {
+		bindings = newReverseBindings(cfg, nodes)
+	}
+
+	addrs := make([]string, len(socks))
+	for i, s := range socks {
+		addrs[i] = s.Addr()
+	}
+	return a.swap(cfg, func() error {
+		err := a.listen(addrs, func(i int) (*server.Listener, error) {
+			return server.RunLocal(socks[i], sockGroups[i], policies, earlyWait, a.servers)
+		}, func(ln *server.Listener, i int) {
+			server.UpdateLocal(ln, socks[i], sockGroups[i], policies, earlyWait)
+		})
+		if err != nil {
+			return err
+		}
+		g.set()
+
+		gen := newStopper(a.servers)
+		for key, n := range nodeMap {
+			if a.nodes[key] == nil {
+				n.stop = newStopper(a.servers)
+				if n.Pool != nil {
+					n.Pool.Run(n.stop.sig)
+				}
+			}
+		}
+		for key, n := range a.nodes {
+			if nodeMap[key] == nil {
+				n.stop.stop()
+				if n.Mux != nil {
+					n.Mux.Retire(a.servers.Signal())
+				}
+			}
+		}
+		a.nodes = nodeMap
+		retireTunnels(a.tunnels, nodes)
+		a.tunnels = nodes
+		if bindingKey != a.bindingKey {
+			for _, b := range a.bindings {
+				b.Stop()
+			}
+			for _, b := range bindings {
+				b.Run(a.servers)
+			}
+			a.bindings, a.bindingKey = bindings, bindingKey
+		}
+		if checker != nil {
+			checker.Run(gen.sig)
+		}
+		loader.Run(gen.sig)
+		if router.Auto != a.auto {
+			if a.autoStop != nil {
+				a.autoStop.stop()
+			}
+			a.auto, a.autoStop = router.Auto, nil
+			if a.auto != nil {
+				a.autoStop = newStopper(a.servers)
+				a.auto.Run(a.autoStop.sig)
+			}
+		}
+		a.gen.stop()
+		a.gen = gen
+		return nil
+	})
+}
+
+func (a *app) applyRemote(cfg *Config) error {
+	if len(cfg.Tunnels) == 0 {
+		configFatal(log.M{"msg": "empty tunnels"})
+	}
+
+	var (
+		g          = newGlobals(cfg)
+		tunnels    = newTunnels(cfg)
+		transports = newTransports(cfg)
+		muxConfig  = newMuxConfig(cfg)
+		egress     = newEgress(cfg)
+		reverse    = newReverseServer(cfg)
+		addrs      = make([]string, len(tunnels))
+		trKeys     = make(map[string]string, len(tunnels))
+	)
+	for i, t := range tunnels {
+		addrs[i] = t.Addr()
+		trKeys[addrs[i]] = jsonKey(cfg.Tunnels[i].Transport)
+		if key, has := a.transports[addrs[i]]; has && key != trKeys[addrs[i]] {
+			log.Warn(log.M{"msg": "transport of listener changed, restart to apply", "addr": addrs[i]})
+			trKeys[addrs[i]] = key
+		}
+	}
+	return a.swap(cfg, func() error {
+		err := a.listen(addrs, func(i int) (*server.Listener, error) {
+			return server.RunRemote(tunnels[i], transports[i], muxConfig, egress, reverse, a.servers)
+		}, func(ln *server.Listener, i int) {
+			server.UpdateRemote(ln, tunnels[i], muxConfig, egress, reverse)
+		})
+		if err != nil {
+			return err
+		}
+		a.transports = trKeys
+		nodes := egressNodes(egress)
+		retireTunnels(a.tunnels, nodes)
+		a.tunnels = nodes
+		g.set()
+		return nil
+	})
+}
+
+// listen opens listeners of addrs not opened yet, run is called for each of
+// them and update is called for each existing one, listeners not in addrs
+// are closed. If any listener failed, listeners opened are closed and nothing
+// else is changed.
+func (a *app) listen(addrs []string, run func(i int) (*server.Listener, error), update func(ln *server.Listener, i int)) error {
+	var (
+		listeners = make(map[string]*server.Listener, len(addrs))
+		err       error
+	)
+	for i, addr := range addrs {
+		if listeners[addr] != nil {
+			err = configError{"msg": "duplicate listener", "addr": addr}
+			break
+		}
+		if ln := a.listeners[addr]; ln != nil {
+			listeners[addr] = ln
+			continue
+		}
+		ln, e := run(i)
+		if e != nil {
+			err = configError{"msg": "listen failed", "addr": addr, "err": e.Error()}
+			break
+		}
+		listeners[addr] = ln
+	}
+	if err != nil {
+		for addr, ln := range listeners {
+			if a.listeners[addr] != ln {
+				ln.Close()
+			}
+		}
+		return err
+	}
+
+	for i, addr := range addrs {
+		if ln := a.listeners[addr]; ln != nil {
+			update(ln, i)
+		}
+	}
+	for addr, ln := range a.listeners {
+		if listeners[addr] == nil {
+			ln.Close()
+		}
+	}
+	a.listeners = listeners
+	return nil
+}
+
+// close shuts down servers gracefully.
+func (a *app) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.closed = true
+	a.servers.Drain = durationOr(a.cfg.Drain, time.Second, 10*time.Second)
+	log.Info(log.M{"msg": "shutting down", "drain": a.servers.Drain.String()})
+	a.servers.Close()
+	if a.auto != nil {
+		a.auto.Save()
+	}
+}
+
+// retireTunnels deletes health gauges of tunnels in old but not in current,
+// tunnels are identified by address.
+func retireTunnels(old, current []*server.TunnelNode) {
+	addrs := make(map[string]bool, len(current))
+	for _, n := range current {
+		addrs[n.Addr()] = true
+	}
+	for _, n := range old {
+		if !addrs[n.Addr()] {
+			server.DefaultStats.Delete("tunnel_healthy", "tunnel", n.Addr())
+		}
+	}
+}
+
+// egressNodes returns next hops of egress.
+func egressNodes(egress *server.Egress) []*server.TunnelNode {
+	if egress == nil {
+		return nil
+	}
+	groups := []*server.TunnelGroup{egress.Default}
+	for _, g := range egress.Groups {
+		groups = append(groups, g.Group)
+	}
+	var (
+		nodes []*server.TunnelNode
+		seen  = make(map[*server.TunnelNode]bool)
+	)
+	for _, g := range groups {
+		if g == nil {
+			continue
+		}
+		for _, n := range g.Nodes {
+			if !seen[n] {
+				seen[n] = true
+				nodes = append(nodes, n)
+			}
+		}
+	}
+	return nodes
+}
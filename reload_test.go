@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cosiner/gohper/testing2"
+	"github.com/cosiner/tunnel/server"
+)
+
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	testing2.True(t, err == nil)
+	ln.Close()
+	return ln.Addr().String()
+}
+
+func remoteConfigJSON(addrs ...string) []byte {
+	tunnels := make([]map[string]string, len(addrs))
+	for i, addr := range addrs {
+		tunnels[i] = map[string]string{"addr": addr, "method": "aes-128-cfb", "key": "key"}
+	}
+	b, _ := json.Marshal(map[string]interface{}{"tunnels": tunnels})
+	return b
+}
+
+func remoteConfig(addrs ...string) *Config {
+	var cfg Config
+	json.Unmarshal(remoteConfigJSON(addrs...), &cfg)
+	return &cfg
+}
+
+func listening(addr string) bool {
+	c, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		return false
+	}
+	c.Close()
+	return true
+}
+
+func TestAppApplyRollback(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	testing2.True(t, err == nil)
+	defer busy.Close()
+	addr1, addr2 := freeAddr(t), freeAddr(t)
+
+	a := newApp()
+	cfg := remoteConfig(addr1)
+	testing2.True(t, a.apply(cfg) == nil)
+	testing2.True(t, listening(addr1))
+
+	// listeners opened are closed if any of them failed
+	testing2.False(t, a.apply(remoteConfig(addr1, addr2, busy.Addr().String())) == nil)
+	testing2.True(t, a.cfg == cfg && len(a.listeners) == 1)
+	testing2.True(t, listening(addr1))
+	testing2.False(t, listening(addr2))
+
+	// invalid configs change nothing
+	testing2.False(t, a.apply(remoteConfig()) == nil)
+	testing2.False(t, a.apply(remoteConfig(addr2, addr2)) == nil)
+	testing2.True(t, a.cfg == cfg && len(a.listeners) == 1)
+	testing2.False(t, listening(addr2))
+
+	// listeners removed are closed
+	cfg = remoteConfig(addr2)
+	testing2.True(t, a.apply(cfg) == nil)
+	testing2.True(t, a.cfg == cfg)
+	testing2.True(t, listening(addr2))
+	testing2.False(t, listening(addr1))
+
+	a.close()
+	testing2.True(t, a.apply(remoteConfig(addr1)) == errServersClosed)
+	testing2.False(t, listening(addr1))
+}
+
+func TestAppReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	testing2.True(t, err == nil)
+	defer os.RemoveAll(dir)
+	prev := conf
+	conf = filepath.Join(dir, "tunnel.json")
+	defer func() { conf = prev }()
+	addr1, addr2 := freeAddr(t), freeAddr(t)
+
+	a := newApp()
+	defer a.close()
+	cfg := remoteConfig(addr1)
+	testing2.True(t, a.apply(cfg) == nil)
+
+	// config unreadable or invalid is not applied
+	ioutil.WriteFile(conf, []byte("{"), 0644)
+	testing2.False(t, a.reload() == nil)
+	ioutil.WriteFile(conf, remoteConfigJSON(), 0644)
+	testing2.False(t, a.reload() == nil)
+	testing2.True(t, a.cfg == cfg && listening(addr1))
+
+	ioutil.WriteFile(conf, remoteConfigJSON(addr1, addr2), 0644)
+	testing2.True(t, a.reload() == nil)
+	testing2.True(t, len(a.listeners) == 2 && listening(addr1) && listening(addr2))
+}
+
+// egressConfig returns a remote config listening on addr, with a next hop
+// of each hop address.
+func egressConfig(addr string, hops ...string) *Config {
+	var cfg Config
+	json.Unmarshal(remoteConfigJSON(addr), &cfg)
+	nextHops := make([]map[string]interface{}, len(hops))
+	for i, hop := range hops {
+		nextHops[i] = map[string]interface{}{
+			"name":   hop,
+			"chains": [][]map[string]string{{{"addr": hop, "method": "aes-128-cfb", "key": "key"}}},
+			"sites":  []string{"a.com"},
+		}
+	}
+	b, _ := json.Marshal(map[string]interface{}{"nextHops": nextHops})
+	json.Unmarshal(b, &cfg.Egress)
+	return &cfg
+}
+
+func TestAppReloadRetireTunnels(t *testing.T) {
+	addr, hop1, hop2 := freeAddr(t), freeAddr(t), freeAddr(t)
+	healthy := func(hop string) bool {
+		_, has := server.DefaultStats.Snapshot()[server.StatsKey("tunnel_healthy", "tunnel", hop)]
+		return has
+	}
+
+	a := newApp()
+	defer a.close()
+	testing2.True(t, a.apply(egressConfig(addr, hop1)) == nil)
+	testing2.True(t, healthy(hop1))
+
+	// gauges of removed tunnels are deleted, tunnels kept are untouched
+	testing2.True(t, a.apply(egressConfig(addr, hop1, hop2)) == nil)
+	testing2.True(t, healthy(hop1) && healthy(hop2))
+	testing2.True(t, a.apply(egressConfig(addr, hop2)) == nil)
+	testing2.False(t, healthy(hop1))
+	testing2.True(t, healthy(hop2))
+}
@@ -0,0 +1,433 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/cosiner/ygo/jsonlog"
+)
+
+const (
+	_ACCOUNT_SAVE_INTERVAL = time.Minute
+	_ACCOUNT_MAX_DOMAINS   = 10000
+	// domains counted after max domains reached
+	_ACCOUNT_OTHER_DOMAINS = "*"
+	_ACCOUNT_MONTH_LAYOUT  = "2006-01"
+)
+
+// Actions of users exceeded quota, blocked users are rejected and their
+// connections are cut off.
+const (
+	QUOTA_BLOCK    = "block"
+	QUOTA_THROTTLE = "throttle"
+)
+
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// Traffic is bytes from clients(Up), bytes to clients(Down) and count of
+// connections.
+type Traffic struct {
+	Up    int64 `json:"up"`
+	Down  int64 `json:"down"`
+	Conns int64 `json:"conns"`
+}
+
+func (t Traffic) Bytes() int64 {
+	return t.Up + t.Down
+}
+
+// Account is the traffic of a user or a domain, in total and in the month.
+type Account struct {
+	Total   Traffic `json:"total"`
+	Month   Traffic `json:"month"`
+	MonthOf string  `json:"monthOf"`
+}
+
+type account struct {
+	Account
+
+	mu        sync.Mutex
+	throttle  *limiterPair // users only
+	throttled bool
+}
+
+func newAccount(month string) *account {
+	return &account{
+		Account:  Account{MonthOf: month},
+		throttle: newLimiterPair(Rate{}),
+	}
+}
+
+func (a *account) snapshot() Account {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.Account
+}
+
+// roll resets traffic of the month if month changed, throttled user is
+// restored since monthly quota is reset.
+func (a *account) roll(month string) {
+	a.mu.Lock()
+	if a.MonthOf != month {
+		a.MonthOf = month
+		a.Month = Traffic{}
+		a.unthrottle()
+	}
+	a.mu.Unlock()
+}
+
+func (a *account) unthrottle() {
+	if a.throttled {
+		a.throttled = false
+		a.throttle.set(Rate{})
+	}
+}
+
+func (a *account) add(n int64, up bool, quota *Quota) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if up {
+		a.Total.Up += n
+		a.Month.Up += n
+	} else {
+		a.Total.Down += n
+		a.Month.Down += n
+	}
+	return a.enforce(quota)
+}
+
+// enforce throttles user or returns ErrQuotaExceeded if quota exceeded, nil
+// quota is unlimited.
+func (a *account) enforce(quota *Quota) error {
+	if quota == nil || quota.Bytes <= 0 {
+		return nil
+	}
+	used := a.Total.Bytes()
+	if quota.Monthly {
+		used = a.Month.Bytes()
+	}
+	if used < quota.Bytes {
+		return nil
+	}
+	if quota.Action != QUOTA_THROTTLE {
+		return ErrQuotaExceeded
+	}
+	if !a.throttled {
+		a.throttled = true
+		a.throttle.set(quota.Throttle)
+		DefaultStats.Incr("quota_throttled_total")
+	}
+	return nil
+}
+
+// Quota limits bytes of both directions of a user, in each month if Monthly.
+// The user is blocked by default once exceeded, or throttled to Throttle.
+type Quota struct {
+	Bytes    int64
+	Monthly  bool
+	Action   string
+	Throttle Rate
+}
+
+// Accounting counts traffic of users and destination domains, and enforces
+// quotas of users. Users are socks users on local and tunnel key ids on
+// remote. Accounts are persisted to File.
+type Accounting struct {
+	File string
+
+	mu      sync.Mutex
+	users   map[string]*account
+	domains map[string]*account
+	quotas  map[string]*Quota
+	quota   *Quota // default for users without their own
+
+	log *log.Logger
+}
+
+// DefaultAccounting is used by servers, nil disables accounting.
+var DefaultAccounting *Accounting
+
+func NewAccounting(file string) *Accounting {
+	return &Accounting{
+		File:    file,
+		users:   make(map[string]*account),
+		domains: make(map[string]*account),
+		quotas:  make(map[string]*Quota),
+		log:     log.Derive("Accounting", file),
+	}
+}
+
+func currentMonth() string {
+	return time.Now().Format(_ACCOUNT_MONTH_LAYOUT)
+}
+
+// SetQuota sets quota of user, it overrides the default quota, zero Bytes
+// removes the quota. It's applied to new connections.
+func (a *Accounting) SetQuota(user string, quota Quota) {
+	a.mu.Lock()
+	if quota.Bytes > 0 {
+		a.quotas[user] = &quota
+	} else {
+		delete(a.quotas, user)
+	}
+	if acc, has := a.users[user]; has {
+		acc.mu.Lock()
+		acc.unthrottle()
+		acc.mu.Unlock()
+	}
+	a.mu.Unlock()
+}
+
+// SetDefaultQuota sets quota of users without their own quota, zero Bytes
+// removes it.
+func (a *Accounting) SetDefaultQuota(quota Quota) {
+	a.mu.Lock()
+	if quota.Bytes > 0 {
+		a.quota = &quota
+	} else {
+		a.quota = nil
+	}
+	for _, acc := range a.users {
+		acc.mu.Lock()
+		acc.unthrottle()
+		acc.mu.Unlock()
+	}
+	a.mu.Unlock()
+}
+
+// SetQuotas replaces the default quota and quotas of all users at once.
+func (a *Accounting) SetQuotas(def Quota, quotas map[string]Quota) {
+	a.mu.Lock()
+	a.quota = nil
+	if def.Bytes > 0 {
+		a.quota = &def
+	}
+	a.quotas = make(map[string]*Quota, len(quotas))
+	for user, quota := range quotas {
+		if quota.Bytes > 0 {
+			quota := quota
+			a.quotas[user] = &quota
+		}
+	}
+	for _, acc := range a.users {
+		acc.mu.Lock()
+		acc.unthrottle()
+		acc.mu.Unlock()
+	}
+	a.mu.Unlock()
+}
+
+func (a *Accounting) account(accounts map[string]*account, name, month string) *account {
+	acc, has := accounts[name]
+	if !has {
+		acc = newAccount(month)
+		accounts[name] = acc
+	}
+	return acc
+}
+
+// Open starts accounting a connection of user to host, user is empty if not
+// authenticated. ErrQuotaExceeded is returned if the user is blocked.
+func (a *Accounting) Open(user, host string) (*Usage, error) {
+	if a == nil {
+		return nil, nil
+	}
+
+	month := currentMonth()
+	u := &Usage{}
+	if user != "" {
+		a.mu.Lock()
+		u.user = a.account(a.users, user, month)
+		if u.quota = a.quotas[user]; u.quota == nil {
+			u.quota = a.quota
+		}
+		a.mu.Unlock()
+
+		u.user.roll(month)
+		u.user.mu.Lock()
+		err := u.user.enforce(u.quota)
+		if err == nil {
+			u.user.Total.Conns++
+			u.user.Month.Conns++
+		}
+		u.user.mu.Unlock()
+		if err != nil {
+			DefaultStats.Incr("quota_rejected_total")
+			a.log.Warn(log.M{"msg": "quota exceeded, connection rejected", "user": user, "host": host})
+			return nil, err
+		}
+	}
+
+	domain := DefaultPublicSuffixList.RegistrableDomain(host)
+	a.mu.Lock()
+	if _, has := a.domains[domain]; !has && len(a.domains) >= _ACCOUNT_MAX_DOMAINS {
+		domain = _ACCOUNT_OTHER_DOMAINS
+	}
+	u.domain = a.account(a.domains, domain, month)
+	a.mu.Unlock()
+
+	u.domain.roll(month)
+	u.domain.mu.Lock()
+	u.domain.Total.Conns++
+	u.domain.Month.Conns++
+	u.domain.mu.Unlock()
+	return u, nil
+}
+
+type accountsFile struct {
+	Users   map[string]*account `json:"users"`
+	Domains map[string]*account `json:"domains"`
+}
+
+func (a *Accounting) Load() error {
+	if a.File == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(a.File)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var f accountsFile
+	if err = json.Unmarshal(data, &f); err != nil {
+		return err
+	}
+	for _, accounts := range []map[string]*account{f.Users, f.Domains} {
+		for _, acc := range accounts {
+			acc.throttle = newLimiterPair(Rate{})
+		}
+	}
+
+	a.mu.Lock()
+	if f.Users != nil {
+		a.users = f.Users
+	}
+	if f.Domains != nil {
+		a.domains = f.Domains
+	}
+	a.mu.Unlock()
+	return nil
+}
+
+// Snapshot returns copies of accounts of users and domains.
+func (a *Accounting) Snapshot() (users, domains map[string]Account) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	users = make(map[string]Account, len(a.users))
+	for name, acc := range a.users {
+		users[name] = acc.snapshot()
+	}
+	domains = make(map[string]Account, len(a.domains))
+	for name, acc := range a.domains {
+		domains[name] = acc.snapshot()
+	}
+	return users, domains
+}
+
+func (a *Accounting) Save() error {
+	if a.File == "" {
+		return nil
+	}
+	users, domains := a.Snapshot()
+	data, err := json.Marshal(map[string]map[string]Account{"users": users, "domains": domains})
+	if err != nil {
+		return err
+	}
+
+	tmp := a.File + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err == nil {
+		err = os.Rename(tmp, a.File)
+	}
+	return err
+}
+
+// Run rolls months, updates stats of users and saves accounts periodically
+// until signal closed.
+func (a *Accounting) Run(sig Signal) {
+	go func() {
+		ticker := time.NewTicker(_ACCOUNT_SAVE_INTERVAL)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-sig:
+				a.save()
+				return
+			case <-ticker.C:
+				a.roll()
+				a.save()
+			}
+		}
+	}()
+}
+
+func (a *Accounting) roll() {
+	month := currentMonth()
+	a.mu.Lock()
+	accounts := make([]*account, 0, len(a.users)+len(a.domains))
+	for _, acc := range a.users {
+		accounts = append(accounts, acc)
+	}
+	for _, acc := range a.domains {
+		accounts = append(accounts, acc)
+	}
+	a.mu.Unlock()
+
+	for _, acc := range accounts {
+		acc.roll(month)
+	}
+}
+
+func (a *Accounting) save() {
+	users, _ := a.Snapshot()
+	for name, acc := range users {
+		DefaultStats.Set(acc.Total.Up, "user_bytes_total", "user", name, "dir", _DIR_UP)
+		DefaultStats.Set(acc.Total.Down, "user_bytes_total", "user", name, "dir", _DIR_DOWN)
+		DefaultStats.Set(acc.Total.Conns, "user_conns_total", "user", name)
+	}
+	if err := a.Save(); err != nil {
+		a.log.Error(log.M{"msg": "save accounts failed", "err": err.Error()})
+	}
+}
+
+// Usage counts traffic of a connection to accounts of its user and domain.
+type Usage struct {
+	user   *account
+	domain *account
+	quota  *Quota
+}
+
+// add counts n bytes, ErrQuotaExceeded is returned if the user is blocked.
+func (u *Usage) add(n int, up bool) error {
+	if u == nil {
+		return nil
+	}
+	u.domain.add(int64(n), up, nil)
+	if u.user == nil {
+		return nil
+	}
+	return u.user.add(int64(n), up, u.quota)
+}
+
+// limiters returns limiters with the throttle of user.
+func (u *Usage) limiters(l *Limiters) *Limiters {
+	if l == nil {
+		l = &Limiters{}
+	}
+	if u == nil || u.user == nil {
+		return l
+	}
+	return &Limiters{
+		Up:   append(l.Up[:len(l.Up):len(l.Up)], u.user.throttle.up),
+		Down: append(l.Down[:len(l.Down):len(l.Down)], u.user.throttle.down),
+	}
+}
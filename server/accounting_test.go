@@ -0,0 +1,103 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/cosiner/gohper/testing2"
+)
+
+func TestAccountingBlock(t *testing.T) {
+	a := NewAccounting("")
+	a.SetQuotas(Quota{Bytes: 100}, nil)
+
+	u, err := a.Open("alice", "www.example.com")
+	testing2.True(t, err == nil)
+	testing2.True(t, u.add(60, true) == nil)
+	// connections in flight are cut off once exceeded
+	testing2.True(t, u.add(40, false) == ErrQuotaExceeded)
+	_, err = a.Open("alice", "www.example.com")
+	testing2.True(t, err == ErrQuotaExceeded)
+
+	// unauthenticated connections are only counted to domains
+	u, err = a.Open("", "www.example.com")
+	testing2.True(t, err == nil && u.add(1000, true) == nil)
+
+	users, domains := a.Snapshot()
+	testing2.True(t, users["alice"].Total == Traffic{Up: 60, Down: 40, Conns: 1})
+	testing2.True(t, domains["example.com"].Total == Traffic{Up: 1060, Down: 40, Conns: 2})
+
+	// raising the quota unblocks the user
+	a.SetQuotas(Quota{Bytes: 200}, nil)
+	_, err = a.Open("alice", "www.example.com")
+	testing2.True(t, err == nil)
+}
+
+func TestAccountingThrottleAndRoll(t *testing.T) {
+	a := NewAccounting("")
+	throttle := Rate{Up: 1024, Down: 2048}
+	a.SetQuotas(Quota{}, map[string]Quota{"bob": {Bytes: 100, Monthly: true, Action: QUOTA_THROTTLE, Throttle: throttle}})
+
+	u, err := a.Open("bob", "a.com")
+	testing2.True(t, err == nil)
+	l := u.limiters(nil)
+	testing2.True(t, len(l.Up) == 1 && l.Up[0].Rate() == 0)
+	testing2.True(t, u.add(100, true) == nil)
+	testing2.True(t, l.Up[0].Rate() == throttle.Up && l.Down[0].Rate() == throttle.Down)
+	_, err = a.Open("bob", "a.com")
+	testing2.True(t, err == nil)
+
+	// monthly traffic is reset in a new month and the throttle is lifted
+	u.user.roll("2000-01")
+	testing2.True(t, l.Up[0].Rate() == 0)
+	acc := u.user.snapshot()
+	testing2.True(t, acc.Month == Traffic{} && acc.Total.Up == 100 && acc.MonthOf == "2000-01")
+}
+
+func TestAccountingConcurrent(t *testing.T) {
+	a := NewAccounting("")
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			u, _ := a.Open("carol", "b.com")
+			for j := 0; j < 1000; j++ {
+				u.add(1, j%2 == 0)
+			}
+		}()
+	}
+	wg.Wait()
+	users, _ := a.Snapshot()
+	testing2.True(t, users["carol"].Total == Traffic{Up: 4000, Down: 4000, Conns: 8})
+}
+
+func TestAccountingSaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "accounting")
+	testing2.True(t, err == nil)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "accounts.json")
+
+	a := NewAccounting(file)
+	u, _ := a.Open("dave", "c.com")
+	u.add(10, true)
+	testing2.True(t, a.Save() == nil)
+
+	b := NewAccounting(file)
+	testing2.True(t, b.Load() == nil)
+	users, domains := b.Snapshot()
+	testing2.True(t, users["dave"].Total == Traffic{Up: 10, Conns: 1})
+	testing2.True(t, domains["c.com"].Total == Traffic{Up: 10, Conns: 1})
+
+	// loaded users can be throttled
+	b.SetQuotas(Quota{Bytes: 10, Action: QUOTA_THROTTLE, Throttle: Rate{Up: 1}}, nil)
+	u, err = b.Open("dave", "c.com")
+	testing2.True(t, err == nil && u.limiters(nil).Up[0].Rate() == 1)
+
+	testing2.True(t, NewAccounting(filepath.Join(dir, "none.json")).Load() == nil)
+	ioutil.WriteFile(file, []byte("{"), 0644)
+	testing2.False(t, NewAccounting(file).Load() == nil)
+}
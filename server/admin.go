@@ -0,0 +1,206 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"strconv"
+	"strings"
+
+	log "github.com/cosiner/ygo/jsonlog"
+)
+
+// admin address prefix of unix socket
+const _ADMIN_UNIX_PREFIX = "unix:"
+
+// Admin serves the admin HTTP API, requests must carry Token as bearer token
+// or token query parameter.
+//
+//	GET  /conns              active connections
+//	POST /conns/close?id=ID  close a connection
+//	GET  /tunnels            state of tunnel nodes
+//	GET  /config             effective config
+//	POST /reload             reload config
+//	GET  /metrics            prometheus metrics
+//	GET  /debug/pprof/       pprof endpoints
+type Admin struct {
+	Token   string
+	Tunnels func() []*TunnelNode
+	Config  func() interface{}
+	Reload  func() error
+
+	log *log.Logger
+}
+
+// TunnelInfo is the state of a tunnel node.
+type TunnelInfo struct {
+	Addr     string `json:"addr"`
+	State    string `json:"state"`
+	Failures int    `json:"failures"`
+	LastErr  string `json:"lastErr"`
+	Active   int64  `json:"active"`
+	Latency  string `json:"latency"`
+}
+
+// RunAdmin serves admin on addr until servers closed, addr is a loopback tcp
+// address or a unix socket path prefixed by "unix:".
+func RunAdmin(addr string, admin *Admin, servers *Servers) error {
+	if admin.Token == "" {
+		return errors.New("admin token is required")
+	}
+	ln, err := listenAdmin(addr)
+	if err != nil {
+		return err
+	}
+
+	admin.log = log.Derive("Admin", addr)
+	srv := &http.Server{Handler: admin.Handler()}
+	servers.run(func() {
+		go func() {
+			servers.Signal().Wait()
+			srv.Close()
+		}()
+		if err := srv.Serve(ln); err != http.ErrServerClosed {
+			admin.log.Error(log.M{"msg": "admin server closed", "err": err.Error()})
+		}
+	})
+	return nil
+}
+
+func listenAdmin(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, _ADMIN_UNIX_PREFIX) {
+		path := addr[len(_ADMIN_UNIX_PREFIX):]
+		os.Remove(path)
+		ln, err := net.Listen("unix", path)
+		if err == nil {
+			err = os.Chmod(path, 0600)
+		}
+		return ln, err
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, errors.New("admin address must be loopback or unix socket: " + addr)
+	}
+	return net.Listen("tcp", addr)
+}
+
+func (a *Admin) Handler() http.Handler {
+	handlers := http.NewServeMux()
+	handlers.HandleFunc("/conns", a.method(http.MethodGet, a.conns))
+	handlers.HandleFunc("/conns/close", a.method(http.MethodPost, a.closeConn))
+	handlers.HandleFunc("/tunnels", a.method(http.MethodGet, a.tunnels))
+	handlers.HandleFunc("/config", a.method(http.MethodGet, a.config))
+	handlers.HandleFunc("/reload", a.method(http.MethodPost, a.reload))
+	handlers.Handle("/metrics", MetricsHandler())
+	handlers.HandleFunc("/debug/pprof/", pprof.Index)
+	handlers.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	handlers.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	handlers.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	handlers.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return a.auth(handlers)
+}
+
+func (a *Admin) auth(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get("token")
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			token = auth[len("Bearer "):]
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(a.Token)) != 1 {
+			DefaultStats.Incr("admin_unauthorized_total")
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (a *Admin) method(method string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		h(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]string{"error": msg})
+}
+
+func (a *Admin) conns(w http.ResponseWriter, r *http.Request) {
+	conns := DefaultRegistry.List()
+	if conns == nil {
+		conns = []ConnInfo{}
+	}
+	writeJSON(w, http.StatusOK, conns)
+}
+
+func (a *Admin) closeConn(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid connection id")
+		return
+	}
+	if !DefaultRegistry.Close(id) {
+		writeError(w, http.StatusNotFound, "connection not found")
+		return
+	}
+	a.log.Info(log.M{"msg": "connection closed by admin", "id": id})
+	writeJSON(w, http.StatusOK, map[string]uint64{"closed": id})
+}
+
+func (a *Admin) tunnels(w http.ResponseWriter, r *http.Request) {
+	infos := []TunnelInfo{}
+	if a.Tunnels != nil {
+		for _, n := range a.Tunnels() {
+			state, failures, lastErr := n.State()
+			infos = append(infos, TunnelInfo{
+				Addr:     n.Addr(),
+				State:    state,
+				Failures: failures,
+				LastErr:  lastErr,
+				Active:   n.Active(),
+				Latency:  n.Latency().String(),
+			})
+		}
+	}
+	writeJSON(w, http.StatusOK, infos)
+}
+
+func (a *Admin) config(w http.ResponseWriter, r *http.Request) {
+	if a.Config == nil {
+		writeError(w, http.StatusNotFound, "config not available")
+		return
+	}
+	writeJSON(w, http.StatusOK, a.Config())
+}
+
+func (a *Admin) reload(w http.ResponseWriter, r *http.Request) {
+	if a.Reload == nil {
+		writeError(w, http.StatusNotFound, "reload not available")
+		return
+	}
+	if err := a.Reload(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"reloaded": true})
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/cosiner/gohper/testing2"
+)
+
+// adminRequest sends request to admin and decodes the response body into v.
+func adminRequest(t *testing.T, method, url, token string, v interface{}) int {
+	req, err := http.NewRequest(method, url, nil)
+	testing2.True(t, err == nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	testing2.True(t, err == nil)
+	defer resp.Body.Close()
+	if v != nil {
+		testing2.True(t, json.NewDecoder(resp.Body).Decode(v) == nil)
+	}
+	return resp.StatusCode
+}
+
+func listening(addr string) bool {
+	c, err := net.DialTimeout("tcp", addr, time.Second)
+	if err == nil {
+		c.Close()
+	}
+	return err == nil
+}
+
+func TestListenAdmin(t *testing.T) {
+	_, err := listenAdmin("0.0.0.0:0")
+	testing2.True(t, err != nil)
+	_, err = listenAdmin("example.com:0")
+	testing2.True(t, err != nil)
+	ln, err := listenAdmin("127.0.0.1:0")
+	testing2.True(t, err == nil)
+	ln.Close()
+
+	testing2.True(t, RunAdmin("127.0.0.1:0", &Admin{}, NewServers()) != nil)
+}
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	client, peer := net.Pipe()
+	dst, dstPeer := net.Pipe()
+	defer peer.Close()
+	defer dstPeer.Close()
+
+	c1 := r.Add("127.0.0.1:1080", "user", "a.com:443", client)
+	c2 := r.Add("127.0.0.1:1080", "", "b.com:443", client)
+	c1.Connected(ROUTE_TUNNEL, "1.2.3.4:8080", dst)
+	c1.add(3, true)
+	c1.add(5, false)
+	infos := r.List()
+	testing2.True(t, len(infos) == 2 && infos[0].ID == 1 && infos[1].ID == 2)
+	testing2.True(t, infos[0].User == "user" && infos[0].Dest == "a.com:443" && infos[0].Route == ROUTE_TUNNEL)
+	testing2.True(t, infos[0].Tunnel == "1.2.3.4:8080" && infos[0].Up == 3 && infos[0].Down == 5)
+
+	// close closes both sides
+	testing2.True(t, r.Close(1))
+	testing2.False(t, r.Close(3))
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := peer.Read(make([]byte, 1))
+	testing2.True(t, err != nil && !isTimeout(err))
+	dstPeer.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = dstPeer.Read(make([]byte, 1))
+	testing2.True(t, err != nil && !isTimeout(err))
+
+	c1.Done()
+	c2.Done()
+	testing2.True(t, len(r.List()) == 0)
+
+	// nil registry and connections are no-ops
+	var nr *Registry
+	testing2.True(t, nr.Add("", "", "", client) == nil)
+	var nc *ActiveConn
+	nc.Connected(ROUTE_DIRECT, "", nil)
+	nc.add(1, true)
+	nc.Done()
+}
+
+func TestAdmin(t *testing.T) {
+	registry := DefaultRegistry
+	DefaultRegistry = NewRegistry()
+	defer func() { DefaultRegistry = registry }()
+
+	f := newFakeTunnel(t)
+	defer f.ln.Close()
+	node := NewTunnelNode(f, 1, DefaultBreaker)
+	node.Failure(errFakeTunnel)
+	reloads := 0
+	var errReload error
+	admin := &Admin{
+		Token:   "token",
+		Tunnels: func() []*TunnelNode { return []*TunnelNode{node} },
+		Config:  func() interface{} { return map[string]string{"mode": MODE_LOCAL} },
+		Reload: func() error {
+			reloads++
+			return errReload
+		},
+	}
+	addr := freeAddr(t)
+	servers := NewServers()
+	defer servers.Close()
+	testing2.True(t, RunAdmin(addr, admin, servers) == nil)
+	url := "http://" + addr
+
+	// token is required as bearer token or query parameter
+	var errResp map[string]string
+	testing2.True(t, adminRequest(t, http.MethodGet, url+"/conns", "", &errResp) == http.StatusUnauthorized)
+	testing2.True(t, errResp["error"] == "unauthorized")
+	testing2.True(t, adminRequest(t, http.MethodGet, url+"/conns", "bad", nil) == http.StatusUnauthorized)
+	var conns []ConnInfo
+	testing2.True(t, adminRequest(t, http.MethodGet, url+"/conns?token=token", "", &conns) == http.StatusOK)
+	testing2.True(t, conns != nil && len(conns) == 0)
+	testing2.True(t, adminRequest(t, http.MethodPost, url+"/conns", "token", nil) == http.StatusMethodNotAllowed)
+
+	// connections are listed and closed by id
+	client, peer := net.Pipe()
+	defer peer.Close()
+	c := DefaultRegistry.Add("127.0.0.1:1080", "user", "a.com:443", client)
+	defer c.Done()
+	testing2.True(t, adminRequest(t, http.MethodGet, url+"/conns", "token", &conns) == http.StatusOK)
+	testing2.True(t, len(conns) == 1 && conns[0].Dest == "a.com:443" && conns[0].User == "user")
+	testing2.True(t, adminRequest(t, http.MethodPost, url+"/conns/close?id=x", "token", nil) == http.StatusBadRequest)
+	testing2.True(t, adminRequest(t, http.MethodPost, url+"/conns/close?id=100", "token", nil) == http.StatusNotFound)
+	var closed map[string]uint64
+	testing2.True(t, adminRequest(t, http.MethodPost, url+"/conns/close?id=1", "token", &closed) == http.StatusOK)
+	testing2.True(t, closed["closed"] == 1)
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := peer.Read(make([]byte, 1))
+	testing2.True(t, err != nil && !isTimeout(err))
+
+	var tunnels []TunnelInfo
+	testing2.True(t, adminRequest(t, http.MethodGet, url+"/tunnels", "token", &tunnels) == http.StatusOK)
+	testing2.True(t, len(tunnels) == 1 && tunnels[0].Addr == f.Addr())
+	testing2.True(t, tunnels[0].State == CIRCUIT_CLOSED && tunnels[0].Failures == 1 && tunnels[0].LastErr == errFakeTunnel.Error())
+
+	var cfg map[string]string
+	testing2.True(t, adminRequest(t, http.MethodGet, url+"/config", "token", &cfg) == http.StatusOK)
+	testing2.True(t, cfg["mode"] == MODE_LOCAL)
+
+	var reloaded map[string]bool
+	testing2.True(t, adminRequest(t, http.MethodGet, url+"/reload", "token", nil) == http.StatusMethodNotAllowed)
+	testing2.True(t, adminRequest(t, http.MethodPost, url+"/reload", "token", &reloaded) == http.StatusOK)
+	testing2.True(t, reloaded["reloaded"] && reloads == 1)
+	errReload = errors.New("invalid config")
+	testing2.True(t, adminRequest(t, http.MethodPost, url+"/reload", "token", &errResp) == http.StatusInternalServerError)
+	testing2.True(t, errResp["error"] == "invalid config" && reloads == 2)
+
+	testing2.True(t, adminRequest(t, http.MethodGet, url+"/metrics", "token", nil) == http.StatusOK)
+
+	// admin server is closed with servers
+	servers.Close()
+	testing2.True(t, waitUntil(time.Second, func() bool {
+		return !listening(addr)
+	}))
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// ClientPolicy is the routing rules, tunnels and limits applied to clients
+// identified by authenticated user or source address.
+type ClientPolicy struct {
+	Name    string
+	Users   []string     // empty to match any user
+	Sources []*net.IPNet // empty to match any source address
+
+	Router     *Router
+	Tunnels    *TunnelGroup // nil to use the default group of listener
+	DirectOnly bool         // never fall back to tunnel
+	MaxConns   int          // max concurrent connections, 0 for unlimited
+
+	conns int64
+}
+
+func (p *ClientPolicy) Match(user string, ip net.IP) bool {
+	if len(p.Users) == 0 && len(p.Sources) == 0 {
+		return false
+	}
+	if len(p.Users) > 0 {
+		var matched bool
+		for _, u := range p.Users {
+			if matched = u == user; matched {
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(p.Sources) > 0 {
+		if ip == nil {
+			return false
+		}
+		for _, n := range p.Sources {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// Acquire count a new connection, it returns false if MaxConns exceeded.
+func (p *ClientPolicy) Acquire() bool {
+	n := atomic.AddInt64(&p.conns, 1)
+	if p.MaxConns > 0 && n > int64(p.MaxConns) {
+		atomic.AddInt64(&p.conns, -1)
+		return false
+	}
+	return true
+}
+
+func (p *ClientPolicy) Release() {
+	atomic.AddInt64(&p.conns, -1)
+}
+
+// Policies select the first client policy matched, Default is used if none
+// matched.
+type Policies struct {
+	Clients []*ClientPolicy
+	Default *ClientPolicy
+}
+
+func (p *Policies) Match(user string, ip net.IP) *ClientPolicy {
+	for _, c := range p.Clients {
+		if c.Match(user, ip) {
+			return c
+		}
+	}
+	return p.Default
+}
+
+func connIP(conn net.Conn) net.IP {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
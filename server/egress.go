@@ -0,0 +1,28 @@
+package server
+
+// Egress decides how remote server connects destinations, destinations matched
+// by sites of a group are forwarded through tunnels of the group as next hops,
+// others through Default, or directly if Default is nil. With FastOpen, data
+// arrived with tunnel request is sent in SYN of direct connections.
+type Egress struct {
+	Groups   []GroupSites
+	Default  *TunnelGroup
+	FastOpen bool
+}
+
+// Group returns the next hop group of host, nil means direct.
+func (e *Egress) Group(host string) *TunnelGroup {
+	if e == nil {
+		return nil
+	}
+	for _, g := range e.Groups {
+		if g.Sites.Contains(host) {
+			return g.Group
+		}
+	}
+	return e.Default
+}
+
+func (e *Egress) fastOpen() bool {
+	return e != nil && e.FastOpen
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cosiner/gohper/testing2"
+	"github.com/cosiner/tunnel/proxy"
+	log "github.com/cosiner/ygo/jsonlog"
+)
+
+func TestEgressGroup(t *testing.T) {
+	var e *Egress
+	testing2.True(t, e.Group("a.com") == nil)
+	testing2.False(t, e.fastOpen())
+
+	a, _ := NewTunnelGroup("a", SELECT_RANDOM, nil, false)
+	def, _ := NewTunnelGroup("default", SELECT_RANDOM, nil, false)
+	e = &Egress{Groups: []GroupSites{{Group: a, Sites: NewList(LIST_TUNNEL, "a.com")}}}
+	testing2.True(t, e.Group("www.a.com") == a)
+	testing2.True(t, e.Group("b.com") == nil)
+	e.Default = def
+	testing2.True(t, e.Group("b.com") == def)
+}
+
+// echoThrough reports whether data written to c is echoed back.
+func echoThrough(c net.Conn) bool {
+	c.SetDeadline(time.Now().Add(time.Second))
+	c.Write([]byte("ping"))
+	b := make([]byte, 4)
+	_, err := io.ReadFull(c, b)
+	return err == nil && string(b) == "ping"
+}
+
+func TestRemoteDialChain(t *testing.T) {
+	echo := runEcho(t)
+	defer echo.Close()
+	_, port, _ := net.SplitHostPort(echo.Addr().String())
+
+	// chain of two remote servers, the last connects destinations directly
+	first, last := freeAddr(t), freeAddr(t)
+	firstServers, lastServers := runReverseRemote(t, first, nil), runReverseRemote(t, last, nil)
+	defer firstServers.Close()
+	firstHop, _ := proxy.NewTunnel("aes-128-cfb", "key", first)
+	lastHop, _ := proxy.NewTunnel("aes-128-cfb", "key", last)
+	node := NewTunnelNode(proxy.Chain{firstHop, lastHop}, 1, DefaultBreaker)
+	group, _ := NewTunnelGroup("hop", SELECT_RANDOM, []*TunnelNode{node}, false)
+	r := &Remote{
+		egress: &Egress{Groups: []GroupSites{{Group: group, Sites: NewList(LIST_TUNNEL, "localhost")}}},
+		log:    log.Derive("Test", "chain"),
+	}
+
+	chained, err := proxy.ParseAddr("localhost:" + port)
+	testing2.True(t, err == nil)
+	c, hop, err := r.dial(chained, []byte("early"))
+	testing2.True(t, err == nil && hop == node)
+	b := make([]byte, 5)
+	c.SetDeadline(time.Now().Add(time.Second))
+	_, err = io.ReadFull(c, b)
+	testing2.True(t, err == nil && string(b) == "early")
+	testing2.True(t, echoThrough(c))
+	c.Close()
+
+	// other destinations are connected directly
+	direct, _ := proxy.ParseAddr(echo.Addr().String())
+	c, hop, err = r.dial(direct, nil)
+	testing2.True(t, err == nil && hop == nil)
+	testing2.True(t, echoThrough(c))
+	c.Close()
+
+	// chained destinations are unreachable once the last hop is gone
+	lastServers.Close()
+	c, _, err = r.dial(chained, nil)
+	testing2.True(t, err != nil || !echoThrough(c))
+}
@@ -0,0 +1,88 @@
+//go:build ignore
+// +build ignore
+
+// gen_public_suffix generates public_suffix_list.go from the public suffix
+// list, comments and blank lines are dropped.
+//
+//	go run gen_public_suffix.go [-url url] [-file path]
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+func main() {
+	var (
+		url  string
+		file string
+		out  string
+	)
+	flag.StringVar(&url, "url", "https://publicsuffix.org/list/public_suffix_list.dat", "url of the list")
+	flag.StringVar(&file, "file", "", "local copy of the list, used instead of url")
+	flag.StringVar(&out, "out", "public_suffix_list.go", "output file")
+	flag.Parse()
+
+	var r io.Reader
+	if file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		r = f
+	} else {
+		resp, err := http.Get(url)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			log.Fatal("unexpected status: ", resp.Status)
+		}
+		r = resp.Body
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintln(&buf, "// Code generated by gen_public_suffix.go; DO NOT EDIT.")
+	fmt.Fprintln(&buf)
+	fmt.Fprintln(&buf, "package server")
+	fmt.Fprintln(&buf)
+	fmt.Fprintln(&buf, "// embeddedPublicSuffixes is the rules of public suffix list from")
+	fmt.Fprintln(&buf, "// https://publicsuffix.org/list/public_suffix_list.dat.")
+	fmt.Fprintln(&buf, "const embeddedPublicSuffixes = `")
+	sc := bufio.NewScanner(r)
+	var rules int
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if i := strings.IndexAny(line, " \t"); i >= 0 {
+			line = line[:i]
+		}
+		if line == "" || strings.HasPrefix(line, "//") {
+			continue
+		}
+		if strings.ContainsRune(line, '`') {
+			log.Fatal("invalid rule: ", line)
+		}
+		fmt.Fprintln(&buf, line)
+		rules++
+	}
+	if err := sc.Err(); err != nil {
+		log.Fatal(err)
+	}
+	if rules == 0 {
+		log.Fatal("no rules")
+	}
+	fmt.Fprintln(&buf, "`")
+	if err := ioutil.WriteFile(out, buf.Bytes(), 0644); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"net"
+	"strings"
+)
+
+// IPList matches ip addresses by cidr.
+type IPList struct {
+	nets []*net.IPNet
+}
+
+func NewIPList(nets ...*net.IPNet) *IPList {
+	return &IPList{nets: nets}
+}
+
+func (l *IPList) Contains(ip net.IP) bool {
+	if l == nil || ip == nil {
+		return false
+	}
+	for _, n := range l.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseIPNets parse cidrs, a single ip is treated as a /32 or /128 network.
+func ParseIPNets(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, s := range cidrs {
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
@@ -1,81 +1,90 @@
 package server
 
 import (
-	"math/rand"
 	"net"
+	"strconv"
+	"time"
 
 	"github.com/cosiner/gohper/net2"
+	"github.com/cosiner/tunnel/dns"
 	"github.com/cosiner/tunnel/proxy"
 	log "github.com/cosiner/ygo/jsonlog"
 )
 
-func RunMultipleLocal(socks, tunnels []proxy.Proxy, directList, tunnelList, suffixList *SiteList) (sig Signal, err error) {
-	sig = NewSignal()
-	for _, sock := range socks {
-		err = RunLocal(sock, tunnels, sig, directList, tunnelList, suffixList)
+// RunMultipleLocal run socks listeners, groups are the default tunnel group of
+// each listener. If earlyWait is positive, tunnel requests are replied before
+// connecting tunnel, and the first data of client received in earlyWait is
+// sent with the tunnel request.
+func RunMultipleLocal(socks []proxy.Proxy, groups []*TunnelGroup, policies *Policies, earlyWait time.Duration) (servers *Servers, err error) {
+	servers = NewServers()
+	for i, sock := range socks {
+		_, err = RunLocal(sock, groups[i], policies, earlyWait, servers)
 		if err != nil {
 			break
 		}
 	}
 	if err != nil {
-		sig.Close()
-		sig = nil
+		servers.Close()
+		servers = nil
 	}
 	return
 }
 
+// max size of client data sent with tunnel request
+const _EARLY_DATA_SIZE = 4096
+
 type Local struct {
-	directList, tunnelList, suffixList *SiteList
+	policies  *Policies
+	group     *TunnelGroup
+	earlyWait time.Duration
 
-	sock    proxy.Proxy
-	tunnels []proxy.Proxy
+	sock     proxy.Proxy
+	deferred bool // sock replies the connect result by Reply
 
-	listener net.Listener
-	signal   Signal
+	servers *Servers
 
 	log *log.Logger
 }
 
-func RunLocal(sock proxy.Proxy, tunnels []proxy.Proxy, signal Signal, directList, tunnelList, suffixList *SiteList) error {
-	ln, err := net2.RetryListen("tcp", sock.Addr(), 5, 1000)
-	if err != nil {
-		return err
-	}
-
-	local := &Local{
-		directList: directList,
-		tunnelList: tunnelList,
-		suffixList: suffixList,
+func newLocal(sock proxy.Proxy, group *TunnelGroup, policies *Policies, earlyWait time.Duration, servers *Servers) *Local {
+	_, isUserServer := sock.(proxy.UserServer)
+	_, isReplier := sock.(proxy.Replier)
+	return &Local{
+		policies:  policies,
+		group:     group,
+		earlyWait: earlyWait,
 
 		sock:     sock,
-		tunnels:  tunnels,
-		listener: ln,
-		signal:   signal,
+		deferred: isUserServer && isReplier,
+		servers:  servers,
 		log:      log.Derive("Local", sock.Addr()),
 	}
-
-	go local.serve()
-	return nil
 }
 
-func (l *Local) serve() error {
-	for {
-		select {
-		case <-l.signal:
-			return l.listener.Close()
-		default:
-			conn, err := l.listener.Accept()
-			if err != nil {
-				return err
-			}
-
-			go l.serveConn(conn)
-		}
+func RunLocal(sock proxy.Proxy, group *TunnelGroup, policies *Policies, earlyWait time.Duration, servers *Servers) (*Listener, error) {
+	ln, err := net2.RetryListen("tcp", sock.Addr(), 5, 1000)
+	if err != nil {
+		return nil, err
 	}
+
+	local := newLocal(sock, group, policies, earlyWait, servers)
+	return servers.serve(ln, local.serveConn, func(err error) {
+		local.log.Error(log.M{"msg": "accept failed, listener closed", "err": err.Error()})
+	}), nil
+}
+
+// UpdateLocal replaces settings of listener run by RunLocal, sock should have
+// the same address, connections in flight are not affected.
+func UpdateLocal(ln *Listener, sock proxy.Proxy, group *TunnelGroup, policies *Policies, earlyWait time.Duration) {
+	ln.setHandler(newLocal(sock, group, policies, earlyWait, ln.servers).serveConn)
 }
 
-func (l *Local) randTunnel() proxy.Proxy {
-	return l.tunnels[rand.Intn(len(l.tunnels))]
+func (l *Local) serverUser(conn net.Conn) (net.Conn, proxy.Addr, string, error) {
+	if s, ok := l.sock.(proxy.UserServer); ok {
+		return s.ServerUser(conn)
+	}
+	c, addr, err := l.sock.Server(conn)
+	return c, addr, "", err
 }
 
 func (l *Local) serveConn(conn net.Conn) {
@@ -93,69 +102,217 @@ func (l *Local) serveConn(conn net.Conn) {
 		}
 	}()
 
-	conn, addr, err = l.sock.Server(conn)
+	defer countConn(l.sock.Addr())()
+
+	var user string
+	accepted := conn
+	conn.SetDeadline(deadlineAfter(CurrentTimeouts().Handshake))
+	conn, addr, user, err = l.serverUser(conn)
 	if err != nil {
+		countHandshakeFailure(l.sock.Addr(), err)
 		l.log.Warn(log.M{"msg": "parse socks5 request failed:", "err": err.Error()})
 		return
 	}
+	conn.SetDeadline(time.Time{})
 
-	remote, _, err = l.dial(addr)
+	policy := l.policies.Match(user, connIP(conn))
+	if !policy.Acquire() {
+		DefaultStats.Incr("rejected_total", "rule", "max_conns")
+		l.log.Warn(log.M{"msg": "too many connections", "policy": policy.Name, "user": user, "client": conn.RemoteAddr().String()})
+		l.reply(conn, proxy.ErrNotAllowed)
+		return
+	}
+	defer policy.Release()
+
+	host := addr.HostString()
+	route, rule := policy.Router.Route(host, addr.Port)
+	DefaultStats.Incr("route_decisions_total", "action", route, "rule", rule)
+	l.log.Info(log.M{"addr_type": addr.Type, "host": host, "port": addr.Port, "route": route, "rule": rule, "policy": policy.Name, "user": user})
+	if route == ROUTE_REJECT {
+		DefaultStats.Incr("rejected_total", "rule", rule)
+		l.reply(conn, proxy.ErrNotAllowed)
+		return
+	}
+
+	usage, err := DefaultAccounting.Open(user, host)
+	if err != nil {
+		DefaultStats.Incr("rejected_total", "rule", "quota")
+		l.reply(conn, proxy.ErrNotAllowed)
+		return
+	}
+	active := DefaultRegistry.Add(l.sock.Addr(), user, addr.String(), accepted)
+	defer active.Done()
+
+	var (
+		tunnel  *TunnelNode
+		early   []byte
+		replied bool
+	)
+	if l.deferred && route == ROUTE_TUNNEL && l.earlyWait > 0 {
+		// client sends nothing before replied, failures of tunnel are seen as
+		// closed connection
+		l.reply(conn, nil)
+		replied = true
+		if early, err = l.readEarly(conn); err != nil {
+			return
+		}
+	}
+	remote, tunnel, err = l.dial(policy, addr, host, route, early)
+	if !replied {
+		l.reply(conn, err)
+	}
 	if err != nil {
 		return
 	}
+	var tunnelAddr string
+	if tunnel != nil {
+		tunnel.Acquire()
+		defer tunnel.Release()
+		tunnelAddr = tunnel.Addr()
+	}
+	active.Connected(route, tunnelAddr, remote)
 
-	go PipeCloseDst(conn, remote, l.log)
-	PipeCloseDst(remote, conn, l.log)
+	l.servers.closeWith(accepted, remote)
+	Pipe(conn, remote, DefaultRateLimits.Limiters(l.sock.Addr(), user), usage, active, l.log)
 	remote = nil
 	conn = nil
 }
 
-func (l *Local) isDirectConnect(host string) bool {
-	if l.suffixList != nil {
-		if l.suffixList.Contains(host) {
-			return true
+// reply sends the connect result if it's deferred, otherwise the client has
+// been replied success by Server.
+func (l *Local) reply(conn net.Conn, err error) {
+	if !l.deferred {
+		return
+	}
+	if r, ok := l.sock.(proxy.Replier); ok {
+		if rerr := r.Reply(conn, err); rerr != nil && err == nil {
+			l.log.Warn(log.M{"msg": "reply client failed", "err": rerr.Error()})
 		}
 	}
-	if l.directList != nil {
-		if l.directList.Contains(host) {
-			return true
+}
+
+// readEarly reads the first data of client in earlyWait, nil if client sent
+// nothing.
+func (l *Local) readEarly(conn net.Conn) ([]byte, error) {
+	buf := make([]byte, _EARLY_DATA_SIZE)
+	conn.SetReadDeadline(time.Now().Add(l.earlyWait))
+	n, err := conn.Read(buf)
+	conn.SetReadDeadline(time.Time{})
+	if n > 0 {
+		DefaultStats.Incr("early_data_total")
+		return buf[:n], nil
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return nil, nil
+	}
+	return nil, err
+}
+
+// dial returns the tunnel used, nil for direct connections. early is sent
+// with tunnel request, or written after connected directly.
+func (l *Local) dial(policy *ClientPolicy, addr proxy.Addr, host, route string, early []byte) (conn net.Conn, tunnel *TunnelNode, err error) {
+	switch route {
+	case ROUTE_DIRECT:
+		conn, err = l.dialDirect(policy, addr, CurrentTimeouts().Dial)
+		if err == nil {
+			return conn, nil, nil
+		}
+		if policy.DirectOnly {
+			l.log.Error(log.M{"msg": "direct connect failed", "host": host, "err": err.Error()})
+			return nil, nil, err
 		}
+		l.log.Error(log.M{"msg": "direct connect failed, try tunnel.", "host": host, "err": err.Error()})
+	case ROUTE_AUTO:
+		conn, err = policy.Router.Auto.Dial(host, func(timeout time.Duration) (net.Conn, error) {
+			return l.dialDirect(policy, addr, timeout)
+		})
+		if err == nil {
+			return conn, nil, nil
+		}
+		l.log.Warn(log.M{"msg": "auto direct connect failed, try tunnel.", "host": host, "err": err.Error()})
 	}
-	if l.tunnelList != nil {
-		if l.tunnelList.Contains(host) {
-			return false
+	if policy.Router.ResolveMode() == DNS_LOCAL && policy.Router.DNSResolver() != nil && addr.Type == proxy.ADDR_DOMAIN_NAME {
+		if addr, err = l.resolveAddr(policy, addr); err != nil {
+			l.log.Error(log.M{"msg": "resolve host failed", "host": host, "err": err.Error()})
+			return nil, nil, err
 		}
 	}
-	return false
+	return l.dialTunnel(policy, addr, host, early)
+}
+
+func (l *Local) resolveAddr(policy *ClientPolicy, addr proxy.Addr) (proxy.Addr, error) {
+	ips, err := policy.Router.DNSResolver().Lookup(string(addr.Host))
+	if err != nil {
+		return addr, err
+	}
+	if len(ips) == 0 {
+		return addr, dns.ErrNoRecords
+	}
+	if ip4 := ips[0].To4(); ip4 != nil {
+		return proxy.NewRawAddr(proxy.ADDR_IPV4, ip4, addr.Port)
+	}
+	return proxy.NewRawAddr(proxy.ADDR_IPV6, ips[0].To16(), addr.Port)
+}
+
+// dialDirect connect addr directly, domains are resolved by the resolver of
+// router if there is one, each resolved address is tried until succeed.
+func (l *Local) dialDirect(policy *ClientPolicy, addr proxy.Addr, timeout time.Duration) (net.Conn, error) {
+	conn, err := l.dialResolved(policy, addr, timeout)
+	return conn, countIfTimeout(err, _TIMEOUT_DIAL)
 }
 
-func (l *Local) dial(addr proxy.Addr) (conn net.Conn, isTunnel bool, err error) {
-	host := string(addr.Host)
-	l.log.Info(log.M{"addr_type": addr.Type, "host": host, "port": addr.Port})
-	if host := string(addr.Host); l.isDirectConnect(host) {
-		conn, err = net.Dial("tcp", addr.String())
+func (l *Local) dialResolved(policy *ClientPolicy, addr proxy.Addr, timeout time.Duration) (net.Conn, error) {
+	resolver := policy.Router.DNSResolver()
+	if resolver == nil || addr.Type != proxy.ADDR_DOMAIN_NAME {
+		return net.DialTimeout("tcp", addr.String(), timeout)
+	}
+
+	ips, err := resolver.Lookup(string(addr.Host))
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, dns.ErrNoRecords
+	}
+	port := strconv.Itoa(int(addr.Port))
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = net.DialTimeout("tcp", net.JoinHostPort(ip.String(), port), timeout)
 		if err == nil {
-			if l.log.IsDebugEnable() {
-				l.log.Debug(log.M{"connect_mode": "direct", "host": host})
-			}
-			return conn, false, nil
+			return conn, nil
 		}
+	}
+	return nil, err
+}
 
-		l.log.Error(log.M{"msg": "direct connect failed, try tunnel.", "host": host, "err": err.Error()})
+// tunnelGroup returns the group targeted by site rules, or the group of client
+// policy, or the default group of listener.
+func (l *Local) tunnelGroup(policy *ClientPolicy, host string) *TunnelGroup {
+	if g := policy.Router.TunnelGroup(host); g != nil {
+		return g
+	}
+	if policy.Tunnels != nil {
+		return policy.Tunnels
 	}
+	return l.group
+}
 
-	// tunnel
-	tunnel := l.randTunnel()
-	conn, err = net.Dial("tcp", tunnel.Addr())
-	if err == nil {
-		conn, err = tunnel.Client(conn, addr)
-		if err != nil {
-			l.log.Error(log.M{"msg": "tunnel handshake failed", "addr": tunnel.Addr(), "err": err.Error()})
+// dialTunnel try tunnels of the group, then connect directly if the group
+// allowed.
+func (l *Local) dialTunnel(policy *ClientPolicy, addr proxy.Addr, host string, early []byte) (conn net.Conn, tunnel *TunnelNode, err error) {
+	group := l.tunnelGroup(policy, host)
+	conn, tunnel, err = group.Dial(addr, early, host, l.log)
+	if err == nil || (!group.Direct && !group.Retry.Direct) {
+		return conn, tunnel, err
+	}
+	l.log.Info(log.M{"msg": "no tunnel connected, connect directly", "group": group.Name, "host": host, "err": err.Error()})
+	if conn, err = l.dialDirect(policy, addr, CurrentTimeouts().Dial); err == nil && len(early) > 0 {
+		if _, err = conn.Write(early); err != nil {
+			conn.Close()
+			conn = nil
 		}
-	} else {
-		l.log.Error(log.M{"msg": "connect tunnel server failed", "addr": tunnel.Addr(), "err": err.Error()})
 	}
-	return conn, true, err
+	return conn, nil, err
 }
 
 func (l *Local) Mode() string {
@@ -1,24 +1,159 @@
 package server
 
-import "net"
+import (
+	"net"
+	"time"
+)
 
-const _POOL_SIZE = 8
+// ConnPool keeps Size connections dialed ahead to a tunnel server, used
+// connections are refilled in background, connections idle longer than Idle
+// are closed before the server closes them.
+type ConnPool struct {
+	Name string
+	Size int
+	Idle time.Duration
+	Dial func(timeout time.Duration) (net.Conn, error)
 
-type ConnPool chan net.Conn
+	conns  chan pooledConn
+	refill chan struct{}
+}
 
-func (p ConnPool) Get() net.Conn {
-	select {
-	case conn := <-p:
-		return conn
-	default:
-		return nil
+type pooledConn struct {
+	net.Conn
+	expire time.Time
+}
+
+const (
+	_POOL_DIAL_TIMEOUT = 5 * time.Second
+	_POOL_IDLE         = 30 * time.Second
+)
+
+func NewConnPool(name string, size int, idle time.Duration, dial func(time.Duration) (net.Conn, error)) *ConnPool {
+	return &ConnPool{
+		Name:   name,
+		Size:   size,
+		Idle:   idle,
+		Dial:   dial,
+		conns:  make(chan pooledConn, size),
+		refill: make(chan struct{}, 1),
+	}
+}
+
+func (p *ConnPool) idle() time.Duration {
+	return poolIdle(p.Idle, CurrentTimeouts().Idle)
+}
+
+// poolIdle returns idle of pooled connections, it's kept below the idle timeout
+// after which servers close connections never sent a request.
+func poolIdle(idle, timeout time.Duration) time.Duration {
+	if idle <= 0 {
+		idle = _POOL_IDLE
+	}
+	if timeout > 0 && idle > timeout/2 {
+		idle = timeout / 2
+	}
+	return idle
+}
+
+// Get returns a pooled connection, nil if pool is empty.
+func (p *ConnPool) Get() net.Conn {
+	defer func() {
+		select {
+		case p.refill <- struct{}{}:
+		default:
+		}
+	}()
+	for {
+		select {
+		case c := <-p.conns:
+			if time.Now().Before(c.expire) {
+				DefaultStats.Incr("pool_hits_total", "tunnel", p.Name)
+				return c.Conn
+			}
+			c.Close()
+		default:
+			DefaultStats.Incr("pool_misses_total", "tunnel", p.Name)
+			return nil
+		}
+	}
+}
+
+// Run fills pool and expires idle connections until signal closed.
+func (p *ConnPool) Run(sig Signal) {
+	go func() {
+		ticker := time.NewTicker(p.idle() / 2)
+		defer ticker.Stop()
+		defer p.close()
+
+		for {
+			p.fill(sig)
+			select {
+			case <-sig:
+				return
+			case <-p.refill:
+			case <-ticker.C:
+				p.expire()
+			}
+		}
+	}()
+}
+
+// fill dial until pool is full, stop at the first failure and retry at next
+// tick.
+func (p *ConnPool) fill(sig Signal) {
+	for len(p.conns) < p.Size {
+		select {
+		case <-sig:
+			return
+		default:
+		}
+
+		conn, err := p.Dial(_POOL_DIAL_TIMEOUT)
+		if err != nil {
+			DefaultStats.Incr("pool_dial_failures_total", "tunnel", p.Name)
+			return
+		}
+		select {
+		case p.conns <- pooledConn{Conn: conn, expire: time.Now().Add(p.idle())}:
+		default:
+			conn.Close()
+			return
+		}
+	}
+}
+
+func (p *ConnPool) expire() {
+	now := time.Now()
+	for n := len(p.conns); n > 0; n-- {
+		var c pooledConn
+		select {
+		case c = <-p.conns:
+		default:
+			return
+		}
+		if now.Before(c.expire) {
+			p.put(c)
+		} else {
+			c.Close()
+		}
 	}
 }
 
-func (p ConnPool) Put(conn net.Conn) {
+func (p *ConnPool) put(c pooledConn) {
 	select {
-	case p <- conn:
+	case p.conns <- c:
 	default:
-		conn.Close()
+		c.Close()
+	}
+}
+
+func (p *ConnPool) close() {
+	for {
+		select {
+		case c := <-p.conns:
+			c.Close()
+		default:
+			return
+		}
 	}
 }
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cosiner/gohper/testing2"
+)
+
+// pipeDialer dials net.Pipe, peers of connections dialed are kept.
+type pipeDialer struct {
+	mu    sync.Mutex
+	peers []net.Conn
+	fail  bool
+}
+
+func (d *pipeDialer) dial(time.Duration) (net.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.fail {
+		return nil, errors.New("dial failed")
+	}
+	c, s := net.Pipe()
+	d.peers = append(d.peers, s)
+	return c, nil
+}
+
+func (d *pipeDialer) dials() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.peers)
+}
+
+func (d *pipeDialer) peer(i int) net.Conn {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.peers[i]
+}
+
+// closed reports whether the other side of c is closed in timeout.
+func closed(c net.Conn, timeout time.Duration) bool {
+	c.SetReadDeadline(time.Now().Add(timeout))
+	_, err := c.Read(make([]byte, 1))
+	return err != nil && !isTimeout(err)
+}
+
+func waitUntil(timeout time.Duration, cond func() bool) bool {
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if cond() {
+			return true
+		}
+	}
+	return cond()
+}
+
+func TestConnPoolRefill(t *testing.T) {
+	d := &pipeDialer{}
+	p := NewConnPool("test", 2, time.Hour, d.dial)
+	sig := NewSignal()
+	p.Run(sig)
+
+	testing2.True(t, waitUntil(time.Second, func() bool { return len(p.conns) == 2 }))
+	testing2.True(t, d.dials() == 2)
+
+	// used connections are refilled
+	c := p.Get()
+	testing2.True(t, c != nil)
+	defer c.Close()
+	testing2.True(t, waitUntil(time.Second, func() bool { return d.dials() == 3 && len(p.conns) == 2 }))
+
+	// pooled connections are closed with the pool
+	sig.Close()
+	testing2.True(t, closed(d.peer(1), time.Second) && closed(d.peer(2), time.Second))
+	testing2.False(t, closed(d.peer(0), 20*time.Millisecond))
+}
+
+func TestConnPoolEmpty(t *testing.T) {
+	d := &pipeDialer{fail: true}
+	p := NewConnPool("test", 2, time.Hour, d.dial)
+	sig := NewSignal()
+	defer sig.Close()
+	p.Run(sig)
+	time.Sleep(20 * time.Millisecond)
+	testing2.True(t, p.Get() == nil)
+}
+
+func TestConnPoolIdleExpiry(t *testing.T) {
+	d := &pipeDialer{}
+	p := NewConnPool("test", 1, 40*time.Millisecond, d.dial)
+	sig := NewSignal()
+	defer sig.Close()
+	p.Run(sig)
+
+	// idle connection is closed and replaced by a new one
+	testing2.True(t, waitUntil(time.Second, func() bool { return d.dials() == 1 }))
+	testing2.True(t, closed(d.peer(0), time.Second))
+	testing2.True(t, waitUntil(time.Second, func() bool { return d.dials() >= 2 }))
+
+	// expired connections are never returned
+	p = NewConnPool("test", 1, time.Hour, d.dial)
+	c, s := net.Pipe()
+	defer s.Close()
+	p.conns <- pooledConn{Conn: c, expire: time.Now().Add(-time.Second)}
+	testing2.True(t, p.Get() == nil)
+	testing2.True(t, closed(s, time.Second))
+}
+
+func TestConnPoolIdleCapped(t *testing.T) {
+	defer SetTimeouts(CurrentTimeouts())
+	p := NewConnPool("test", 1, 10*time.Minute, nil)
+	SetTimeouts(Timeouts{Idle: time.Minute})
+	testing2.True(t, p.idle() == 30*time.Second)
+	SetTimeouts(Timeouts{})
+	testing2.True(t, p.idle() == 10*time.Minute)
+	p.Idle = 0
+	testing2.True(t, p.idle() == _POOL_IDLE)
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cosiner/gohper/testing2"
+	"github.com/cosiner/tunnel/dns"
+	"github.com/cosiner/tunnel/proxy"
+)
+
+func TestLocalTunnelGroup(t *testing.T) {
+	group := func(name string) *TunnelGroup {
+		g, _ := NewTunnelGroup(name, SELECT_RANDOM, nil, true)
+		return g
+	}
+	listener, client, global, site := group("listener"), group("client"), group("global"), group("site")
+	parent := &Router{Groups: []GroupSites{{Group: global, Sites: NewList(LIST_TUNNEL, "global.com")}}}
+	router := &Router{Parent: parent, Groups: []GroupSites{{Group: site, Sites: NewList(LIST_TUNNEL, "site.com")}}}
+	l := &Local{group: listener}
+
+	// site rules of client, then site rules of parent, then group of client
+	policy := &ClientPolicy{Router: router, Tunnels: client}
+	testing2.True(t, l.tunnelGroup(policy, "a.site.com") == site)
+	testing2.True(t, l.tunnelGroup(policy, "a.global.com") == global)
+	testing2.True(t, l.tunnelGroup(policy, "other.com") == client)
+
+	// group of listener if client has none
+	policy = &ClientPolicy{Router: parent}
+	testing2.True(t, l.tunnelGroup(policy, "other.com") == listener)
+	testing2.True(t, l.tunnelGroup(policy, "site.com") == listener)
+
+	// router with its own default doesn't delegate to parent
+	router.Default = ROUTE_TUNNEL
+	policy = &ClientPolicy{Router: router, Tunnels: client}
+	testing2.True(t, l.tunnelGroup(policy, "a.global.com") == client)
+	testing2.True(t, l.tunnelGroup(policy, "a.site.com") == site)
+}
+
+func TestLocalResolveAddr(t *testing.T) {
+	resolver := &dns.Resolver{Hosts: map[string][]net.IP{
+		"a.com":     {net.IPv4(1, 2, 3, 4)},
+		"v6.com":    {net.ParseIP("::1")},
+		"empty.com": {},
+	}}
+	policy := &ClientPolicy{Router: &Router{Resolver: resolver}}
+	l := &Local{}
+	addr := func(host string) proxy.Addr {
+		a, _ := proxy.NewAddr(proxy.ADDR_DOMAIN_NAME, host+":80")
+		return a
+	}
+
+	resolved, err := l.resolveAddr(policy, addr("a.com"))
+	testing2.True(t, err == nil && resolved.Type == proxy.ADDR_IPV4 && resolved.String() == "1.2.3.4:80")
+	resolved, err = l.resolveAddr(policy, addr("v6.com"))
+	testing2.True(t, err == nil && resolved.Type == proxy.ADDR_IPV6 && resolved.String() == "[::1]:80")
+
+	// hosts resolved to no address are errors rather than panics
+	_, err = l.resolveAddr(policy, addr("empty.com"))
+	testing2.True(t, err == dns.ErrNoRecords)
+	_, err = l.dialResolved(policy, addr("empty.com"), time.Second)
+	testing2.True(t, err == dns.ErrNoRecords)
+}
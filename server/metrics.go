@@ -0,0 +1,134 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/cosiner/ygo/jsonlog"
+)
+
+// statsName returns the name of key.
+func statsName(key string) string {
+	if i := strings.IndexByte(key, '{'); i >= 0 {
+		return key[:i]
+	}
+	return key
+}
+
+// withLabel appends label to labels of key.
+func withLabel(key, label, value string) string {
+	if i := strings.IndexByte(key, '{'); i >= 0 {
+		return key[:len(key)-1] + "," + label + `="` + value + `"}`
+	}
+	return key + "{" + label + `="` + value + `"}`
+}
+
+// suffixName inserts suffix after the name of key.
+func suffixName(key, suffix string) string {
+	name := statsName(key)
+	return name + suffix + key[len(name):]
+}
+
+func groupByName(keys []string) (names []string, groups map[string][]string) {
+	groups = make(map[string][]string)
+	for _, key := range keys {
+		name := statsName(key)
+		if _, has := groups[name]; !has {
+			names = append(names, name)
+		}
+		groups[name] = append(groups[name], key)
+	}
+	sort.Strings(names)
+	return names, groups
+}
+
+// WritePrometheus writes stats in prometheus text format, counters named with
+// _total are counters and others are gauges, histograms are in seconds.
+func (s *Stats) WritePrometheus(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	values := s.Snapshot()
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	names, groups := groupByName(keys)
+	for _, name := range names {
+		typ := "gauge"
+		if strings.HasSuffix(name, "_total") {
+			typ = "counter"
+		}
+		bw.WriteString("# TYPE " + name + " " + typ + "\n")
+		sort.Strings(groups[name])
+		for _, key := range groups[name] {
+			bw.WriteString(key + " " + strconv.FormatInt(values[key], 10) + "\n")
+		}
+	}
+
+	s.mu.RLock()
+	histograms := make(map[string]*histogram, len(s.histograms))
+	keys = keys[:0]
+	for key, h := range s.histograms {
+		histograms[key] = h
+		keys = append(keys, key)
+	}
+	s.mu.RUnlock()
+	names, groups = groupByName(keys)
+	for _, name := range names {
+		bw.WriteString("# TYPE " + name + " histogram\n")
+		sort.Strings(groups[name])
+		for _, key := range groups[name] {
+			h := histograms[key]
+			var count int64
+			for i := range h.counts {
+				count += atomic.LoadInt64(&h.counts[i])
+				le := "+Inf"
+				if i < len(_HISTOGRAM_BUCKETS) {
+					le = strconv.FormatFloat(_HISTOGRAM_BUCKETS[i], 'g', -1, 64)
+				}
+				bw.WriteString(withLabel(suffixName(key, "_bucket"), "le", le) + " " + strconv.FormatInt(count, 10) + "\n")
+			}
+			sum := time.Duration(atomic.LoadInt64(&h.sum)).Seconds()
+			bw.WriteString(suffixName(key, "_sum") + " " + strconv.FormatFloat(sum, 'g', -1, 64) + "\n")
+			bw.WriteString(suffixName(key, "_count") + " " + strconv.FormatInt(count, 10) + "\n")
+		}
+	}
+	return bw.Flush()
+}
+
+// MetricsHandler serves DefaultStats in prometheus text format.
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		DefaultStats.WritePrometheus(w)
+	})
+}
+
+// RunMetrics serves /metrics on addr until servers closed.
+func RunMetrics(addr string, servers *Servers) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	handlers := http.NewServeMux()
+	handlers.Handle("/metrics", MetricsHandler())
+	srv := &http.Server{Handler: handlers}
+	logger := log.Derive("Metrics", addr)
+	servers.run(func() {
+		go func() {
+			servers.Signal().Wait()
+			srv.Close()
+		}()
+		if err := srv.Serve(ln); err != http.ErrServerClosed {
+			logger.Error(log.M{"msg": "metrics server closed", "err": err.Error()})
+		}
+	})
+	return nil
+}
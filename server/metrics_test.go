@@ -0,0 +1,38 @@
+package server
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cosiner/gohper/testing2"
+)
+
+func TestWritePrometheus(t *testing.T) {
+	s := NewStats()
+	s.Incr("rejected_total", "rule", "reject")
+	s.Incr("rejected_total_by_port")
+	s.Add(2, "rejected_total", "rule", `a"b`)
+	s.Set(3, "conns_active", "listener", ":1080")
+	s.Observe(20*time.Millisecond, "tunnel_dial_seconds", "tunnel", "t1")
+	s.Observe(3*time.Second, "tunnel_dial_seconds", "tunnel", "t1")
+
+	var buf bytes.Buffer
+	testing2.True(t, s.WritePrometheus(&buf) == nil)
+	out := buf.String()
+
+	for _, line := range []string{
+		"# TYPE conns_active gauge\nconns_active{listener=\":1080\"} 3\n",
+		"# TYPE rejected_total counter\nrejected_total{rule=\"a\\\"b\"} 2\nrejected_total{rule=\"reject\"} 1\n",
+		"# TYPE tunnel_dial_seconds histogram\n",
+		"tunnel_dial_seconds_bucket{tunnel=\"t1\",le=\"0.01\"} 0\n",
+		"tunnel_dial_seconds_bucket{tunnel=\"t1\",le=\"0.025\"} 1\n",
+		"tunnel_dial_seconds_bucket{tunnel=\"t1\",le=\"+Inf\"} 2\n",
+		"tunnel_dial_seconds_sum{tunnel=\"t1\"} 3.02\n",
+		"tunnel_dial_seconds_count{tunnel=\"t1\"} 2\n",
+	} {
+		testing2.True(t, strings.Contains(out, line))
+	}
+	testing2.True(t, strings.Count(out, "# TYPE rejected_total counter") == 1)
+}
@@ -3,6 +3,8 @@ package server
 import (
 	"io"
 	"net"
+	"sync/atomic"
+	"time"
 
 	log "github.com/cosiner/ygo/jsonlog"
 )
@@ -37,17 +39,130 @@ var bufferPool = buffer{
 	c:       make(chan []byte, 256),
 }
 
-func PipeCloseDst(dst, src net.Conn, logger *log.Logger) {
-	buf := bufferPool.Get()
-	defer func() {
-		dst.Close()
-		bufferPool.Put(buf)
+// PipeLinger is the time given to the other direction to finish after one
+// direction of Pipe finished, it's used until SetPipeLinger called.
+var PipeLinger = 30 * time.Second
+
+var pipeLinger int64 // atomic, 0 for PipeLinger
+
+func SetPipeLinger(d time.Duration) {
+	atomic.StoreInt64(&pipeLinger, int64(d))
+}
+
+func currentPipeLinger() time.Duration {
+	if d := atomic.LoadInt64(&pipeLinger); d > 0 {
+		return time.Duration(d)
+	}
+	return PipeLinger
+}
+
+// directions of pipe, up is from client
+const (
+	_DIR_UP   = "up"
+	_DIR_DOWN = "down"
+)
+
+func bytesCounter(dir string) *int64 {
+	return DefaultStats.counter(StatsKey("bytes_total", "dir", dir))
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// Pipe copies data between client and dst until both directions finished.
+// When a direction reaches EOF, write side of the destination is closed if it
+// supports, so peers see half close, otherwise the destination is closed.
+// Both connections are closed after both directions finished, or PipeLinger
+// passed since the first finished, or idle and lifetime of CurrentTimeouts
+// exceeded. limiters is nil for unlimited, traffic is counted to usage and
+// active if they are not nil, the pipe is cut off once quota of its user
+// exceeded.
+func Pipe(client, dst net.Conn, limiters *Limiters, usage *Usage, active *ActiveConn, logger *log.Logger) {
+	timeouts := CurrentTimeouts()
+	var act *activity
+	if timeouts.Idle > 0 {
+		act = newActivity()
+	}
+	if act != nil || timeouts.Lifetime > 0 {
+		stop := make(chan struct{})
+		defer close(stop)
+		go watchPipe(client, dst, act, timeouts, stop)
+	}
+	limiters = usage.limiters(limiters)
+
+	done := make(chan struct{}, 2)
+	go func() {
+		pipeHalf(dst, pipeReader{client, act, usage, active, limiters.Up, _DIR_UP, bytesCounter(_DIR_UP)}, logger)
+		done <- struct{}{}
+	}()
+	go func() {
+		pipeHalf(client, pipeReader{dst, act, usage, active, limiters.Down, _DIR_DOWN, bytesCounter(_DIR_DOWN)}, logger)
+		done <- struct{}{}
 	}()
 
-	_, err := io.CopyBuffer(dst, src, buf)
-	if err != nil {
-		if !isConnClosed(err) {
-			logger.Error(log.M{"msg": "pipe error", "err": err.Error()})
+	<-done
+	timer := time.NewTimer(currentPipeLinger())
+	select {
+	case <-done:
+	case <-timer.C:
+		DefaultStats.Incr("pipe_linger_timeouts_total")
+	}
+	timer.Stop()
+	client.Close()
+	dst.Close()
+}
+
+// pipeReader records activity, counts traffic and waits rate limiters after
+// each read.
+type pipeReader struct {
+	net.Conn
+	act      *activity
+	usage    *Usage
+	active   *ActiveConn
+	limiters []*RateLimiter
+	dir      string
+	bytes    *int64 // counter of bytes_total of dir
+}
+
+func (r pipeReader) Read(b []byte) (int, error) {
+	n, err := r.Conn.Read(b)
+	if n > 0 {
+		if r.act != nil {
+			r.act.touch()
 		}
+		atomic.AddInt64(r.bytes, int64(n))
+		r.active.add(n, r.dir == _DIR_UP)
+		if qerr := r.usage.add(n, r.dir == _DIR_UP); qerr != nil {
+			return n, qerr
+		}
+		waitRate(r.limiters, n, r.dir)
+	}
+	return n, err
+}
+
+func pipeHalf(dst net.Conn, src pipeReader, logger *log.Logger) {
+	buf := bufferPool.Get()
+	defer bufferPool.Put(buf)
+
+	var err error
+	if src.act != nil || src.usage != nil || src.active != nil || len(src.limiters) > 0 {
+		// hide ReaderFrom of dst to copy by the pooled buffer
+		_, err = io.CopyBuffer(struct{ io.Writer }{dst}, src, buf)
+	} else {
+		var n int64
+		n, err = io.CopyBuffer(dst, src.Conn, buf)
+		atomic.AddInt64(src.bytes, n)
+	}
+	if err == nil {
+		if cw, ok := dst.(closeWriter); ok && cw.CloseWrite() == nil {
+			return
+		}
+	} else if err != ErrQuotaExceeded && !isConnClosed(err) {
+		logger.Error(log.M{"msg": "pipe error", "err": err.Error()})
+	}
+	dst.Close()
+	if err != nil {
+		src.Close()
 	}
 }
@@ -0,0 +1,235 @@
+package server
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+const (
+	_PSL_RULE      byte = 1 << iota // suffix itself is public
+	_PSL_WILDCARD                   // all direct children of suffix are public
+	_PSL_EXCEPTION                  // suffix is not public even if matched by wildcard
+)
+
+// PublicSuffixList implements the public suffix algorithm described at
+// https://publicsuffix.org/list/. Unicode rules are converted to punycode since
+// sites are always in punycode.
+type PublicSuffixList struct {
+	mu    sync.RWMutex
+	rules map[string]byte
+}
+
+//go:generate go run gen_public_suffix.go
+
+// DefaultPublicSuffixList is initialized with the embedded list generated from
+// publicsuffix.org and can be replaced by a newer one through Reset.
+var DefaultPublicSuffixList = NewPublicSuffixList([]byte(embeddedPublicSuffixes))
+
+func NewPublicSuffixList(data []byte) *PublicSuffixList {
+	rules, _ := parsePublicSuffixes(data)
+	return &PublicSuffixList{
+		rules: rules,
+	}
+}
+
+func parsePublicSuffixes(data []byte) (map[string]byte, error) {
+	rules := make(map[string]byte)
+	err := eachLine(data, func(line string) {
+		if strings.HasPrefix(line, "//") {
+			return
+		}
+		if i := strings.IndexAny(line, " \t"); i >= 0 {
+			line = line[:i]
+		}
+		line = toASCII(strings.ToLower(line))
+
+		switch {
+		case strings.HasPrefix(line, "!"):
+			rules[line[1:]] |= _PSL_EXCEPTION
+		case strings.HasPrefix(line, "*."):
+			rules[line[2:]] |= _PSL_WILDCARD
+		default:
+			rules[line] |= _PSL_RULE
+		}
+	})
+	return rules, err
+}
+
+var errNoPublicSuffixes = errors.New("no valid public suffix rules")
+
+// Reset replace rules with the given list content, rules are kept if the
+// content can't be parsed or there is no valid rules.
+func (p *PublicSuffixList) Reset(data []byte) error {
+	rules, err := parsePublicSuffixes(data)
+	if err != nil {
+		return err
+	}
+	if len(rules) == 0 {
+		return errNoPublicSuffixes
+	}
+
+	p.mu.Lock()
+	p.rules = rules
+	p.mu.Unlock()
+	return nil
+}
+
+// PublicSuffix returns the public suffix of domain, the last label is used if
+// no rules matched.
+func (p *PublicSuffixList) PublicSuffix(domain string) string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	// check from the longest suffix, the first matched rule is the longest
+	for i := 0; ; {
+		suffix := domain[i:]
+		dot := strings.IndexByte(suffix, '.')
+		parent := ""
+		if dot >= 0 {
+			parent = suffix[dot+1:]
+		}
+
+		rule := p.rules[suffix]
+		if rule&_PSL_EXCEPTION != 0 {
+			return parent
+		}
+		if rule&_PSL_RULE != 0 || (parent != "" && p.rules[parent]&_PSL_WILDCARD != 0) {
+			return suffix
+		}
+		if dot < 0 {
+			return suffix
+		}
+		i += dot + 1
+	}
+}
+
+// RegistrableDomain returns the public suffix plus one more label. The domain
+// itself is returned if it's an ip address or a public suffix.
+func (p *PublicSuffixList) RegistrableDomain(domain string) string {
+	if domain == "" || isIPHost(domain) {
+		return domain
+	}
+	suffix := p.PublicSuffix(domain)
+	if len(suffix) >= len(domain) {
+		return domain
+	}
+	i := strings.LastIndexByte(domain[:len(domain)-len(suffix)-1], '.')
+	return domain[i+1:]
+}
+
+func isIPHost(host string) bool {
+	if strings.IndexByte(host, ':') >= 0 {
+		return true
+	}
+	i := strings.LastIndexByte(host, '.')
+	last := host[i+1:]
+	return last != "" && strings.Trim(last, "0123456789") == ""
+}
+
+// toASCII converts unicode labels of domain to punycode.
+func toASCII(domain string) string {
+	for i := 0; i < len(domain); i++ {
+		if domain[i] >= 0x80 {
+			labels := strings.Split(domain, ".")
+			for j, label := range labels {
+				labels[j] = punycodeLabel(label)
+			}
+			return strings.Join(labels, ".")
+		}
+	}
+	return domain
+}
+
+// punycode parameters of RFC 3492
+const (
+	_PUNY_BASE         = 36
+	_PUNY_TMIN         = 1
+	_PUNY_TMAX         = 26
+	_PUNY_SKEW         = 38
+	_PUNY_DAMP         = 700
+	_PUNY_INITIAL_BIAS = 72
+	_PUNY_INITIAL_N    = 128
+)
+
+// punycodeLabel encodes a label by punycode with the xn-- prefix, ascii labels
+// are returned unchanged.
+func punycodeLabel(label string) string {
+	runes := []rune(label)
+	var out []byte
+	for _, r := range runes {
+		if r < 0x80 {
+			out = append(out, byte(r))
+		}
+	}
+	basic := len(out)
+	if basic == len(runes) {
+		return label
+	}
+	if basic > 0 {
+		out = append(out, '-')
+	}
+
+	n, delta, bias := rune(_PUNY_INITIAL_N), 0, _PUNY_INITIAL_BIAS
+	for h := basic; h < len(runes); {
+		m := rune(0x7fffffff)
+		for _, r := range runes {
+			if r >= n && r < m {
+				m = r
+			}
+		}
+		delta += int(m-n) * (h + 1)
+		n = m
+		for _, r := range runes {
+			if r < n {
+				delta++
+			}
+			if r != n {
+				continue
+			}
+			q := delta
+			for k := _PUNY_BASE; ; k += _PUNY_BASE {
+				t := k - bias
+				if t < _PUNY_TMIN {
+					t = _PUNY_TMIN
+				} else if t > _PUNY_TMAX {
+					t = _PUNY_TMAX
+				}
+				if q < t {
+					break
+				}
+				out = append(out, punycodeDigit(t+(q-t)%(_PUNY_BASE-t)))
+				q = (q - t) / (_PUNY_BASE - t)
+			}
+			out = append(out, punycodeDigit(q))
+			bias = punycodeAdapt(delta, h+1, h == basic)
+			delta = 0
+			h++
+		}
+		delta++
+		n++
+	}
+	return "xn--" + string(out)
+}
+
+func punycodeDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+func punycodeAdapt(delta, points int, first bool) int {
+	if first {
+		delta /= _PUNY_DAMP
+	} else {
+		delta /= 2
+	}
+	delta += delta / points
+	k := 0
+	for delta > (_PUNY_BASE-_PUNY_TMIN)*_PUNY_TMAX/2 {
+		delta /= _PUNY_BASE - _PUNY_TMIN
+		k += _PUNY_BASE
+	}
+	return k + (_PUNY_BASE-_PUNY_TMIN+1)*delta/(delta+_PUNY_SKEW)
+}
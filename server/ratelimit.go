@@ -0,0 +1,248 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	_RATE_BURST     = 100 * time.Millisecond
+	_RATE_MIN_BURST = 8192
+)
+
+// RateLimiter is a token bucket limiting bytes per second, the burst is small
+// to keep it smooth. It's shared by connections, each read of them reserves
+// tokens and waits its turn, so connections share the rate fairly by chunks.
+type RateLimiter struct {
+	rate int64 // atomic, 0 for unlimited
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(rate int64) *RateLimiter {
+	l := &RateLimiter{}
+	l.SetRate(rate)
+	return l
+}
+
+func (l *RateLimiter) Rate() int64 {
+	return atomic.LoadInt64(&l.rate)
+}
+
+// SetRate changes rate in bytes per second, 0 for unlimited, it's applied to
+// connections already established.
+func (l *RateLimiter) SetRate(rate int64) {
+	if rate < 0 {
+		rate = 0
+	}
+	l.mu.Lock()
+	if burst := rateBurst(float64(rate)); l.Rate() == 0 || l.tokens > burst {
+		l.tokens = burst
+	}
+	l.last = time.Now()
+	atomic.StoreInt64(&l.rate, rate)
+	l.mu.Unlock()
+}
+
+// reserve takes n tokens, it returns the time to wait before they are
+// available.
+func (l *RateLimiter) reserve(n int) time.Duration {
+	if l.Rate() == 0 {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rate := float64(l.Rate())
+	if rate == 0 {
+		return 0
+	}
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * rate
+	if burst := rateBurst(rate); l.tokens > burst {
+		l.tokens = burst
+	}
+	l.last = now
+	if l.tokens -= float64(n); l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / rate * float64(time.Second))
+}
+
+func rateBurst(rate float64) float64 {
+	if burst := rate * _RATE_BURST.Seconds(); burst > _RATE_MIN_BURST {
+		return burst
+	}
+	return _RATE_MIN_BURST
+}
+
+// Rate is the bytes per second of both directions, Up is from client and Down
+// is to client, 0 for unlimited.
+type Rate struct {
+	Up   int64
+	Down int64
+}
+
+type limiterPair struct {
+	up   *RateLimiter
+	down *RateLimiter
+}
+
+func newLimiterPair(rate Rate) *limiterPair {
+	return &limiterPair{
+		up:   NewRateLimiter(rate.Up),
+		down: NewRateLimiter(rate.Down),
+	}
+}
+
+func (p *limiterPair) set(rate Rate) {
+	p.up.SetRate(rate.Up)
+	p.down.SetRate(rate.Down)
+}
+
+// Limiters are applied to each direction of a pipe, all of them are waited.
+type Limiters struct {
+	Up   []*RateLimiter
+	Down []*RateLimiter
+}
+
+func (l *Limiters) add(p *limiterPair) {
+	l.Up = append(l.Up, p.up)
+	l.Down = append(l.Down, p.down)
+}
+
+// RateLimits holds rate limiters of global, listeners and users, users are
+// socks users on local and tunnel key ids on remote. All rates can be changed
+// at runtime.
+type RateLimits struct {
+	global *limiterPair
+
+	mu        sync.Mutex
+	listeners map[string]*limiterPair
+	users     map[string]*limiterPair
+	userRates map[string]Rate
+	userRate  Rate
+}
+
+var DefaultRateLimits = NewRateLimits()
+
+func NewRateLimits() *RateLimits {
+	return &RateLimits{
+		global:    newLimiterPair(Rate{}),
+		listeners: make(map[string]*limiterPair),
+		users:     make(map[string]*limiterPair),
+		userRates: make(map[string]Rate),
+	}
+}
+
+func (r *RateLimits) SetGlobal(rate Rate) {
+	r.global.set(rate)
+}
+
+func (r *RateLimits) SetListener(addr string, rate Rate) {
+	r.mu.Lock()
+	r.listener(addr).set(rate)
+	r.mu.Unlock()
+}
+
+// SetUser sets the rate of user, it overrides the default rate of users.
+func (r *RateLimits) SetUser(user string, rate Rate) {
+	r.mu.Lock()
+	r.userRates[user] = rate
+	if p, has := r.users[user]; has {
+		p.set(rate)
+	}
+	r.mu.Unlock()
+}
+
+// SetDefaultUser sets the rate of each user without its own rate.
+func (r *RateLimits) SetDefaultUser(rate Rate) {
+	r.mu.Lock()
+	r.userRate = rate
+	for user, p := range r.users {
+		if _, has := r.userRates[user]; !has {
+			p.set(rate)
+		}
+	}
+	r.mu.Unlock()
+}
+
+// Reset replaces all rates at once, listeners and users not in maps are
+// unlimited, or limited by the default rate of users.
+func (r *RateLimits) Reset(global Rate, listeners map[string]Rate, user Rate, users map[string]Rate) {
+	r.global.set(global)
+	r.mu.Lock()
+	for addr, p := range r.listeners {
+		p.set(listeners[addr])
+	}
+	for addr, rate := range listeners {
+		r.listener(addr).set(rate)
+	}
+	r.userRate = user
+	r.userRates = make(map[string]Rate, len(users))
+	for name, rate := range users {
+		r.userRates[name] = rate
+	}
+	for name, p := range r.users {
+		rate, has := users[name]
+		if !has {
+			rate = user
+		}
+		p.set(rate)
+	}
+	r.mu.Unlock()
+}
+
+func (r *RateLimits) listener(addr string) *limiterPair {
+	p, has := r.listeners[addr]
+	if !has {
+		p = newLimiterPair(Rate{})
+		r.listeners[addr] = p
+	}
+	return p
+}
+
+// Limiters returns limiters of connections of user accepted by listener, user
+// is empty if not authenticated.
+func (r *RateLimits) Limiters(listener, user string) *Limiters {
+	if r == nil {
+		return nil
+	}
+
+	l := &Limiters{}
+	l.add(r.global)
+	r.mu.Lock()
+	l.add(r.listener(listener))
+	if user != "" {
+		p, has := r.users[user]
+		if !has {
+			rate, has := r.userRates[user]
+			if !has {
+				rate = r.userRate
+			}
+			p = newLimiterPair(rate)
+			r.users[user] = p
+		}
+		l.add(p)
+	}
+	r.mu.Unlock()
+	return l
+}
+
+// waitRate waits until n bytes are allowed by all limiters, dir is the
+// direction for stats.
+func waitRate(limiters []*RateLimiter, n int, dir string) {
+	var wait time.Duration
+	for _, l := range limiters {
+		if d := l.reserve(n); d > wait {
+			wait = d
+		}
+	}
+	if wait > 0 {
+		DefaultStats.Incr("rate_limited_total", "dir", dir)
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cosiner/gohper/testing2"
+)
+
+func near(d, want time.Duration) bool {
+	return d >= want-10*time.Millisecond && d <= want+10*time.Millisecond
+}
+
+func TestRateLimiterReserve(t *testing.T) {
+	l := NewRateLimiter(100 * 1024)
+	burst := int(rateBurst(100 * 1024))
+
+	testing2.True(t, l.reserve(burst) == 0)
+	testing2.True(t, near(l.reserve(burst), 100*time.Millisecond))
+	// reservations queue up
+	testing2.True(t, near(l.reserve(burst), 200*time.Millisecond))
+
+	// the new rate applies to debt already reserved
+	l.SetRate(200 * 1024)
+	testing2.True(t, near(l.reserve(0), 100*time.Millisecond))
+
+	l.SetRate(0)
+	testing2.True(t, l.reserve(1<<30) == 0)
+	// unlimited to limited starts with a full burst
+	l.SetRate(100 * 1024)
+	testing2.True(t, l.reserve(burst) == 0)
+	testing2.True(t, l.reserve(1) > 0)
+}
+
+func TestRateLimiterShared(t *testing.T) {
+	const n, chunk = 10, 10240
+	l := NewRateLimiter(100 * 1024)
+	l.reserve(int(rateBurst(100 * 1024)))
+
+	var (
+		mu    sync.Mutex
+		waits []time.Duration
+		wg    sync.WaitGroup
+	)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d := l.reserve(chunk)
+			mu.Lock()
+			waits = append(waits, d)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	// each reservation waits its own turn
+	var max time.Duration
+	seen := make(map[time.Duration]bool)
+	for _, d := range waits {
+		if d > max {
+			max = d
+		}
+		seen[d/(50*time.Millisecond)] = true
+	}
+	testing2.True(t, near(max, n*100*time.Millisecond))
+	testing2.True(t, len(seen) == n)
+}
+
+func TestRateLimitsReset(t *testing.T) {
+	r := NewRateLimits()
+	r.Reset(Rate{Up: 1000}, map[string]Rate{":1080": {Down: 2000}}, Rate{Up: 3000}, map[string]Rate{"vip": {Up: 4000}})
+
+	l := r.Limiters(":1080", "alice")
+	testing2.True(t, len(l.Up) == 3 && len(l.Down) == 3)
+	testing2.True(t, l.Up[0].Rate() == 1000 && l.Down[1].Rate() == 2000 && l.Up[2].Rate() == 3000)
+	testing2.True(t, r.Limiters(":1080", "vip").Up[2].Rate() == 4000)
+	testing2.True(t, len(r.Limiters(":1081", "").Up) == 2)
+
+	// limiters of established connections follow the new rates
+	r.Reset(Rate{}, nil, Rate{}, map[string]Rate{"alice": {Up: 5000}})
+	testing2.True(t, l.Up[0].Rate() == 0 && l.Down[1].Rate() == 0 && l.Up[2].Rate() == 5000)
+}
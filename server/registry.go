@@ -0,0 +1,166 @@
+package server
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConnInfo describes an active connection, Up is bytes from client and Down
+// is bytes to client.
+type ConnInfo struct {
+	ID       uint64    `json:"id"`
+	Listener string    `json:"listener"`
+	Client   string    `json:"client"`
+	User     string    `json:"user"`
+	Dest     string    `json:"dest"`
+	Route    string    `json:"route"`
+	Tunnel   string    `json:"tunnel"`
+	Up       int64     `json:"up"`
+	Down     int64     `json:"down"`
+	Start    time.Time `json:"start"`
+	Age      string    `json:"age"`
+}
+
+// ActiveConn is a connection tracked by Registry from the request parsed
+// until it's done.
+type ActiveConn struct {
+	up   int64 // atomic
+	down int64 // atomic
+
+	registry *Registry
+	client   net.Conn
+
+	mu   sync.Mutex
+	info ConnInfo
+	dst  net.Conn
+}
+
+// Connected records how the connection is carried, tunnel is empty for
+// direct connections.
+func (c *ActiveConn) Connected(route, tunnel string, dst net.Conn) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.info.Route = route
+	c.info.Tunnel = tunnel
+	c.dst = dst
+	c.mu.Unlock()
+}
+
+func (c *ActiveConn) add(n int, up bool) {
+	if c == nil {
+		return
+	}
+	if up {
+		atomic.AddInt64(&c.up, int64(n))
+	} else {
+		atomic.AddInt64(&c.down, int64(n))
+	}
+}
+
+func (c *ActiveConn) Info() ConnInfo {
+	c.mu.Lock()
+	info := c.info
+	c.mu.Unlock()
+	info.Up = atomic.LoadInt64(&c.up)
+	info.Down = atomic.LoadInt64(&c.down)
+	info.Age = time.Since(info.Start).Truncate(time.Second).String()
+	return info
+}
+
+// Close closes both sides of the connection.
+func (c *ActiveConn) Close() error {
+	c.mu.Lock()
+	dst := c.dst
+	c.mu.Unlock()
+	if dst != nil {
+		dst.Close()
+	}
+	return c.client.Close()
+}
+
+// Done removes the connection from registry.
+func (c *ActiveConn) Done() {
+	if c == nil {
+		return
+	}
+	c.registry.mu.Lock()
+	delete(c.registry.conns, c.info.ID)
+	c.registry.mu.Unlock()
+}
+
+// Registry tracks active connections of local and remote servers.
+type Registry struct {
+	id uint64 // atomic
+
+	mu    sync.Mutex
+	conns map[uint64]*ActiveConn
+}
+
+// DefaultRegistry is used by servers, nil disables tracking.
+var DefaultRegistry = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{
+		conns: make(map[uint64]*ActiveConn),
+	}
+}
+
+// Add tracks client connection accepted by listener, Done should be called
+// once it's finished.
+func (r *Registry) Add(listener, user, dest string, client net.Conn) *ActiveConn {
+	if r == nil {
+		return nil
+	}
+	c := &ActiveConn{
+		registry: r,
+		client:   client,
+		info: ConnInfo{
+			ID:       atomic.AddUint64(&r.id, 1),
+			Listener: listener,
+			Client:   client.RemoteAddr().String(),
+			User:     user,
+			Dest:     dest,
+			Start:    time.Now(),
+		},
+	}
+	r.mu.Lock()
+	r.conns[c.info.ID] = c
+	r.mu.Unlock()
+	return c
+}
+
+// List returns active connections in order of ID.
+func (r *Registry) List() []ConnInfo {
+	r.mu.Lock()
+	conns := make([]*ActiveConn, 0, len(r.conns))
+	for _, c := range r.conns {
+		conns = append(conns, c)
+	}
+	r.mu.Unlock()
+
+	infos := make([]ConnInfo, len(conns))
+	for i, c := range conns {
+		infos[i] = c.Info()
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+	return infos
+}
+
+// Close closes the connection of id, it returns false if not found.
+func (r *Registry) Close(id uint64) bool {
+	r.mu.Lock()
+	c, has := r.conns[id]
+	r.mu.Unlock()
+	if has {
+		c.Close()
+		DefaultStats.Incr("admin_closed_conns_total")
+	}
+	return has
+}
@@ -1,68 +1,85 @@
 package server
 
 import (
+	"bufio"
 	"io"
 	"net"
+	"time"
 
 	"github.com/cosiner/gohper/net2"
+	"github.com/cosiner/tunnel/mux"
 	"github.com/cosiner/tunnel/proxy"
+	"github.com/cosiner/tunnel/transport"
 	log "github.com/cosiner/ygo/jsonlog"
 )
 
-func RunMultipleRemote(tunnels []proxy.Proxy) (sig Signal, err error) {
-	sig = NewSignal()
-	for _, tunnel := range tunnels {
-		err = RunRemote(tunnel, sig)
+// RunMultipleRemote run tunnel servers, transports are the transport of each
+// tunnel, nil for tcp. egress is shared by all servers, nil to connect all
+// destinations directly. reverse nil disables reverse bindings.
+func RunMultipleRemote(tunnels []proxy.Proxy, transports []*transport.Transport, muxConfig mux.Config, egress *Egress, reverse *ReverseServer) (servers *Servers, err error) {
+	servers = NewServers()
+	for i, tunnel := range tunnels {
+		_, err = RunRemote(tunnel, transports[i], muxConfig, egress, reverse, servers)
 		if err != nil {
 			break
 		}
 	}
 	if err != nil {
-		sig.Close()
-		sig = nil
+		servers.Close()
+		servers = nil
 	}
 	return
 }
 
+// wait for data arrived with tunnel request
+const _REMOTE_EARLY_WAIT = 2 * time.Millisecond
+
 type Remote struct {
-	tunnel proxy.Proxy
+	tunnel    proxy.Proxy
+	muxConfig mux.Config
+	egress    *Egress
+	reverse   *ReverseServer
 
-	listener net.Listener
-	signal   Signal
+	servers *Servers
 
 	log *log.Logger
 }
 
-func RunRemote(tunnel proxy.Proxy, signal Signal) error {
-	ln, err := net2.RetryListen("tcp", tunnel.Addr(), 5, 1000)
-	if err != nil {
-		return err
+func newRemote(tunnel proxy.Proxy, muxConfig mux.Config, egress *Egress, reverse *ReverseServer, servers *Servers) *Remote {
+	return &Remote{
+		tunnel:    tunnel,
+		muxConfig: muxConfig,
+		egress:    egress,
+		reverse:   reverse,
+		servers:   servers,
+		log:       log.Derive("Remote", tunnel.Addr()),
 	}
+}
 
-	r := &Remote{
-		tunnel:   tunnel,
-		signal:   signal,
-		listener: ln,
-		log:      log.Derive("Remote", tunnel.Addr()),
+func RunRemote(tunnel proxy.Proxy, tr *transport.Transport, muxConfig mux.Config, egress *Egress, reverse *ReverseServer, servers *Servers) (*Listener, error) {
+	var (
+		ln  net.Listener
+		err error
+	)
+	if tr.IsPacket() {
+		ln, err = tr.ListenPacket(tunnel.Addr())
+	} else if ln, err = net2.RetryListen("tcp", tunnel.Addr(), 5, 1000); err == nil {
+		ln = tr.Listen(ln)
+	}
+	if err != nil {
+		return nil, err
 	}
-	go r.serve()
-	return nil
-}
 
-func (r *Remote) serve() error {
-	for {
-		select {
-		case <-r.signal:
-			return r.listener.Close()
-		default:
-			conn, err := r.listener.Accept()
-			if err != nil {
-				return err
-			}
+	r := newRemote(tunnel, muxConfig, egress, reverse, servers)
+	return servers.serve(ln, r.serveConn, func(err error) {
+		r.log.Error(log.M{"msg": "accept failed, listener closed", "err": err.Error()})
+	}), nil
+}
 
-			go r.serveConn(conn)
-		}
-	}
+// UpdateRemote replaces settings of listener run by RunRemote, the transport
+// can't be changed, connections in flight are not affected.
+func UpdateRemote(ln *Listener, tunnel proxy.Proxy, muxConfig mux.Config, egress *Egress, reverse *ReverseServer) {
+	ln.setHandler(newRemote(tunnel, muxConfig, egress, reverse, ln.servers).serveConn)
 }
 
 func (r *Remote) serveConn(conn net.Conn) {
@@ -80,27 +97,241 @@ func (r *Remote) serveConn(conn net.Conn) {
 		}
 	}()
 
-	conn, addr, err = r.tunnel.Server(conn)
+	defer countConn(r.tunnel.Addr())()
+
+	accepted := conn
+	raw := newPeekConn(conn)
+	if err = awaitRequest(raw, CurrentTimeouts()); err != nil {
+		countIfTimeout(err, _TIMEOUT_IDLE)
+		return
+	}
+	conn.SetDeadline(deadlineAfter(CurrentTimeouts().Handshake))
+	conn, addr, err = r.tunnel.Server(raw)
+	if proxy.Replayed(conn) {
+		DefaultStats.Incr("replays_total", "listener", r.tunnel.Addr())
+	}
 	if err != nil {
+		countHandshakeFailure(r.tunnel.Addr(), err)
 		if err != io.EOF && !isConnClosed(err) {
 			r.log.Error(log.M{"msg": "parse tunnel request failed", "err": err.Error(), "remote": conn.RemoteAddr().String()})
 		}
 		return
 	}
+	conn.SetDeadline(time.Time{})
+	switch addr.Type {
+	case proxy.ADDR_MUX:
+		r.serveMux(conn)
+		return
+	case proxy.ADDR_REVERSE:
+		r.serveReverse(conn)
+		return
+	}
 
-	addrStr := addr.String()
-	remote, err = net.Dial("tcp", addrStr)
+	usage, err := DefaultAccounting.Open(r.user(), addr.HostString())
 	if err != nil {
-		r.log.Error(log.M{"msg": "connect to dst server failed", "err": err.Error(), "addr": addrStr})
 		return
 	}
+	active := DefaultRegistry.Add(r.tunnel.Addr(), r.user(), addr.String(), accepted)
+	defer active.Done()
 
-	go PipeCloseDst(remote, conn, r.log)
-	PipeCloseDst(conn, remote, r.log)
+	var (
+		hop   *TunnelNode
+		early []byte
+	)
+	if r.egress.fastOpen() {
+		if early, err = r.readEarly(raw, conn); err != nil {
+			r.log.Error(log.M{"msg": "read early data failed", "err": err.Error(), "remote": conn.RemoteAddr().String()})
+			return
+		}
+	}
+	remote, hop, err = r.dial(addr, early)
+	if err != nil {
+		return
+	}
+	if hop != nil {
+		hop.Acquire()
+		defer hop.Release()
+	}
+	route, via := hopRoute(hop)
+	active.Connected(route, via, remote)
+
+	r.servers.closeWith(accepted, remote)
+	Pipe(conn, remote, r.limiters(), usage, active, r.log)
 	conn = nil
 	remote = nil
 }
 
+// readEarly reads data arrived with the request, it waits a little since the
+// data is usually in the same segment. The wait is done on raw connection
+// under conn and conn is read only if some bytes arrived, so the deadline
+// never cuts a frame of tunnel or transport.
+func (r *Remote) readEarly(raw *peekConn, conn net.Conn) ([]byte, error) {
+	if raw.r.Buffered() == 0 {
+		raw.SetReadDeadline(time.Now().Add(_REMOTE_EARLY_WAIT))
+		_, err := raw.r.Peek(1)
+		raw.SetReadDeadline(time.Time{})
+		if err != nil {
+			if isTimeout(err) || err == io.EOF {
+				return nil, nil
+			}
+			return nil, err
+		}
+	}
+
+	buf := make([]byte, _EARLY_DATA_SIZE)
+	n, err := conn.Read(buf)
+	if n > 0 {
+		return buf[:n], nil
+	}
+	if err == io.EOF {
+		// left to pipe, which half closes destination
+		return nil, nil
+	}
+	return nil, err
+}
+
+// dial connect addr directly or through next hops chosen by egress, the next
+// hop used is returned, nil for direct connections. early is sent with the
+// connection.
+func (r *Remote) dial(addr proxy.Addr, early []byte) (net.Conn, *TunnelNode, error) {
+	host := addr.HostString()
+	if group := r.egress.Group(host); group != nil {
+		DefaultStats.Incr("route_decisions_total", "action", ROUTE_TUNNEL, "rule", group.Name)
+		remote, hop, err := group.Dial(addr, early, host, r.log)
+		if err != nil {
+			r.log.Error(log.M{"msg": "connect to dst server through next hop failed", "err": err.Error(), "group": group.Name, "addr": addr.String()})
+		}
+		return remote, hop, err
+	}
+
+	DefaultStats.Incr("route_decisions_total", "action", ROUTE_DIRECT, "rule", RULE_DEFAULT)
+	addrStr := addr.String()
+	remote, err := transport.DialTCP(addrStr, CurrentTimeouts().Dial, r.egress.fastOpen())
+	countIfTimeout(err, _TIMEOUT_DIAL)
+	if err == nil && len(early) > 0 {
+		if _, err = remote.Write(early); err != nil {
+			remote.Close()
+			remote = nil
+		}
+	}
+	if err != nil {
+		r.log.Error(log.M{"msg": "connect to dst server failed", "err": err.Error(), "addr": addrStr})
+	}
+	return remote, nil, err
+}
+
+// serveMux serve streams of mux session until it closed, address of each
+// stream is read from the beginning of stream.
+func (r *Remote) serveMux(conn net.Conn) {
+	sess := mux.Server(conn, r.muxConfig)
+	defer sess.Close()
+
+	DefaultStats.Add(1, "mux_sessions")
+	defer DefaultStats.Add(-1, "mux_sessions")
+	for {
+		stream, err := sess.Accept()
+		if err != nil {
+			if err != io.EOF && err != mux.ErrSessionClosed && !isConnClosed(err) {
+				r.log.Warn(log.M{"msg": "mux session closed", "err": err.Error(), "remote": conn.RemoteAddr().String()})
+			}
+			return
+		}
+		r.servers.Go(stream, r.serveStream)
+	}
+}
+
+func (r *Remote) serveStream(stream net.Conn) {
+	stream.SetReadDeadline(deadlineAfter(CurrentTimeouts().Handshake))
+	addr, err := proxy.ReadAddr(stream)
+	if err != nil {
+		countHandshakeFailure(r.tunnel.Addr(), err)
+		r.log.Error(log.M{"msg": "parse stream request failed", "err": err.Error()})
+		stream.Close()
+		return
+	}
+	stream.SetReadDeadline(time.Time{})
+	usage, err := DefaultAccounting.Open(r.user(), addr.HostString())
+	if err != nil {
+		stream.Close()
+		return
+	}
+	active := DefaultRegistry.Add(r.tunnel.Addr(), r.user(), addr.String(), stream)
+	defer active.Done()
+	remote, hop, err := r.dial(addr, nil)
+	if err != nil {
+		stream.Close()
+		return
+	}
+	if hop != nil {
+		hop.Acquire()
+		defer hop.Release()
+	}
+	route, via := hopRoute(hop)
+	active.Connected(route, via, remote)
+
+	r.servers.closeWith(stream, remote)
+	Pipe(stream, remote, r.limiters(), usage, active, r.log)
+}
+
+// hopRoute returns route and address of the next hop, direct if hop is nil.
+func hopRoute(hop *TunnelNode) (route, addr string) {
+	if hop == nil {
+		return ROUTE_DIRECT, ""
+	}
+	return ROUTE_TUNNEL, hop.Addr()
+}
+
+// user identifies clients by the tunnel key.
+func (r *Remote) user() string {
+	if k, ok := r.tunnel.(interface{ KeyID() string }); ok {
+		return k.KeyID()
+	}
+	return ""
+}
+
+func (r *Remote) limiters() *Limiters {
+	return DefaultRateLimits.Limiters(r.tunnel.Addr(), r.user())
+}
+
 func (r *Remote) Mode() string {
 	return MODE_REMOTE
 }
+
+// peekConn buffers reads of a connection, so data can be waited without
+// being consumed.
+type peekConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func newPeekConn(conn net.Conn) *peekConn {
+	return &peekConn{Conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (c *peekConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// awaitRequest waits the first byte of request up to requestWait, the
+// handshake timeout starts after it, so connections dialed ahead by pools of
+// clients are not closed while they wait to be used.
+func awaitRequest(c *peekConn, t Timeouts) error {
+	c.SetReadDeadline(time.Now().Add(requestWait(t)))
+	_, err := c.r.Peek(1)
+	c.SetReadDeadline(time.Time{})
+	return err
+}
+
+// requestWait returns the longest idle of pooled connections, it's never
+// unlimited even if idle timeout is disabled, and not shorter than the
+// handshake timeout.
+func requestWait(t Timeouts) time.Duration {
+	wait := _POOL_IDLE
+	if t.Idle > 0 {
+		wait = t.Idle / 2
+	}
+	if wait < t.Handshake {
+		wait = t.Handshake
+	}
+	return wait
+}
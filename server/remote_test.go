@@ -0,0 +1,45 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/cosiner/gohper/testing2"
+	"github.com/cosiner/tunnel/proxy"
+)
+
+// readerConn reads by read instead of the connection.
+type readerConn struct {
+	net.Conn
+	read func([]byte) (int, error)
+}
+
+func (c readerConn) Read(b []byte) (int, error) {
+	return c.read(b)
+}
+
+func TestRemoteReadEarly(t *testing.T) {
+	r := &Remote{}
+	client, server := net.Pipe()
+	defer client.Close()
+	raw := newPeekConn(server)
+	errRead := errors.New("conn read")
+
+	// nothing arrived, tunnel conn is not read, so no frame is cut
+	early, err := r.readEarly(raw, readerConn{raw, func([]byte) (int, error) {
+		return 0, errRead
+	}})
+	testing2.True(t, err == nil && early == nil)
+
+	go client.Write([]byte("data"))
+	early, err = r.readEarly(raw, raw)
+	testing2.True(t, err == nil && string(early) == "data")
+
+	// errors of tunnel conn are returned
+	go client.Write([]byte{0})
+	_, err = r.readEarly(raw, readerConn{raw, func([]byte) (int, error) {
+		return 0, proxy.ErrBadEndOfStream
+	}})
+	testing2.True(t, err == proxy.ErrBadEndOfStream)
+}
@@ -0,0 +1,300 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cosiner/tunnel/mux"
+	"github.com/cosiner/tunnel/proxy"
+	log "github.com/cosiner/ygo/jsonlog"
+)
+
+// Reverse bind request: | TokenLen 1 | Token dynamic | Port 2 |,
+// response: | Status 1 |.
+const (
+	REVERSE_OK byte = iota
+	REVERSE_AUTH_FAILED
+	REVERSE_PORT_DENIED
+	REVERSE_LISTEN_FAILED
+)
+
+const (
+	_REVERSE_HANDSHAKE_TIMEOUT = 10 * time.Second
+	_REVERSE_BACKOFF           = time.Second
+	_REVERSE_MAX_BACKOFF       = time.Minute
+)
+
+var reverseErrors = map[byte]error{
+	REVERSE_AUTH_FAILED:   errors.New("reverse bind: auth failed"),
+	REVERSE_PORT_DENIED:   errors.New("reverse bind: port not allowed"),
+	REVERSE_LISTEN_FAILED: errors.New("reverse bind: listen failed"),
+}
+
+// ReverseServer accepts reverse bindings on remote server, a binding with the
+// Token listens on one of Ports of Host, connections accepted are forwarded
+// back as mux streams until the control connection closed.
+type ReverseServer struct {
+	Token string
+	Host  string // empty for all interfaces
+	Ports map[uint16]bool
+}
+
+func (rs *ReverseServer) check(token string, port uint16) byte {
+	if rs == nil || rs.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(rs.Token)) != 1 {
+		return REVERSE_AUTH_FAILED
+	}
+	if !rs.Ports[port] {
+		return REVERSE_PORT_DENIED
+	}
+	return REVERSE_OK
+}
+
+func readBindRequest(conn net.Conn) (token string, port uint16, err error) {
+	var l [1]byte
+	if _, err = io.ReadFull(conn, l[:]); err != nil {
+		return
+	}
+	b := make([]byte, int(l[0])+2)
+	if _, err = io.ReadFull(conn, b); err != nil {
+		return
+	}
+	return string(b[:l[0]]), binary.BigEndian.Uint16(b[l[0]:]), nil
+}
+
+func bindRequest(token string, port uint16) []byte {
+	b := make([]byte, 1+len(token)+2)
+	b[0] = byte(len(token))
+	copy(b[1:], token)
+	binary.BigEndian.PutUint16(b[1+len(token):], port)
+	return b
+}
+
+// serveReverse serve a reverse binding until the control connection or
+// remote server closed.
+func (r *Remote) serveReverse(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(_REVERSE_HANDSHAKE_TIMEOUT))
+	token, port, err := readBindRequest(conn)
+	if err != nil {
+		r.log.Error(log.M{"msg": "read reverse bind request failed", "err": err.Error(), "remote": conn.RemoteAddr().String()})
+		return
+	}
+
+	var ln net.Listener
+	status := r.reverse.check(token, port)
+	if status == REVERSE_OK {
+		ln, err = net.Listen("tcp", net.JoinHostPort(r.reverse.Host, strconv.Itoa(int(port))))
+		if err != nil {
+			r.log.Error(log.M{"msg": "reverse listen failed", "port": port, "err": err.Error()})
+			status = REVERSE_LISTEN_FAILED
+		}
+	}
+	if _, err = conn.Write([]byte{status}); err != nil || status != REVERSE_OK {
+		if status != REVERSE_OK {
+			DefaultStats.Incr("reverse_rejected_total", "reason", strconv.Itoa(int(status)))
+			r.log.Warn(log.M{"msg": "reverse bind rejected", "port": port, "status": status, "remote": conn.RemoteAddr().String()})
+		}
+		if ln != nil {
+			ln.Close()
+		}
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	sess := mux.Server(conn, r.muxConfig)
+	DefaultStats.Add(1, "reverse_bindings")
+	r.log.Info(log.M{"msg": "reverse binding established", "addr": ln.Addr().String(), "remote": conn.RemoteAddr().String()})
+
+	done := make(chan struct{})
+	go func() {
+		// local never opens streams, Accept returns once session closed
+		for {
+			stream, err := sess.Accept()
+			if err != nil {
+				break
+			}
+			stream.Close()
+		}
+		close(done)
+	}()
+	go func() {
+		select {
+		case <-done:
+		case <-r.servers.Signal():
+			sess.Close()
+		}
+		ln.Close()
+	}()
+
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			break
+		}
+		r.servers.Go(c, func(c net.Conn) {
+			r.forwardReverse(sess, c)
+		})
+	}
+	sess.Close()
+	DefaultStats.Add(-1, "reverse_bindings")
+	r.log.Info(log.M{"msg": "reverse binding closed", "addr": ln.Addr().String(), "remote": conn.RemoteAddr().String()})
+}
+
+func (r *Remote) forwardReverse(sess *mux.Session, c net.Conn) {
+	stream, err := sess.Open()
+	if err != nil {
+		c.Close()
+		return
+	}
+	DefaultStats.Incr("reverse_conns_total")
+	r.servers.closeWith(c, stream)
+	Pipe(c, stream, nil, nil, nil, r.log)
+}
+
+// ReverseBinding exposes Target of local side on Port of the remote server
+// through Tunnel, the control connection is reconnected with backoff once
+// closed.
+type ReverseBinding struct {
+	Tunnel *TunnelNode
+	Token  string
+	Port   uint16
+	Target string
+	Config mux.Config
+
+	stop Signal
+	once sync.Once
+	log  *log.Logger
+}
+
+func NewReverseBinding(tunnel *TunnelNode, token string, port uint16, target string, config mux.Config) *ReverseBinding {
+	return &ReverseBinding{
+		Tunnel: tunnel,
+		Token:  token,
+		Port:   port,
+		Target: target,
+		Config: config,
+		stop:   NewSignal(),
+		log:    log.Derive("Reverse", strconv.Itoa(int(port))),
+	}
+}
+
+// Run runs the binding until servers closed or Stop called.
+func (b *ReverseBinding) Run(servers *Servers) {
+	servers.run(func() {
+		b.run(servers)
+	})
+}
+
+// Stop closes the binding, streams forwarded keep running.
+func (b *ReverseBinding) Stop() {
+	b.once.Do(b.stop.Close)
+}
+
+func (b *ReverseBinding) run(servers *Servers) {
+	sig := servers.Signal()
+	backoff := _REVERSE_BACKOFF
+	for {
+		sess, err := b.bind()
+		if err != nil {
+			b.log.Error(log.M{"msg": "reverse bind failed", "tunnel": b.Tunnel.Addr(), "err": err.Error(), "retry": backoff.String()})
+			select {
+			case <-sig:
+				return
+			case <-b.stop:
+				return
+			case <-time.After(backoff):
+			}
+			backoff = nextReverseBackoff(backoff)
+			continue
+		}
+		backoff = _REVERSE_BACKOFF
+		b.log.Info(log.M{"msg": "reverse binding established", "tunnel": b.Tunnel.Addr(), "target": b.Target})
+
+		done := make(chan struct{})
+		go func() {
+			select {
+			case <-sig:
+				sess.Close()
+			case <-b.stop:
+				sess.Close()
+			case <-done:
+			}
+		}()
+		b.serve(sess, servers)
+		close(done)
+
+		select {
+		case <-sig:
+			return
+		case <-b.stop:
+			return
+		default:
+			b.log.Warn(log.M{"msg": "reverse binding closed, reconnect", "tunnel": b.Tunnel.Addr()})
+		}
+	}
+}
+
+// nextReverseBackoff doubles backoff up to _REVERSE_MAX_BACKOFF.
+func nextReverseBackoff(backoff time.Duration) time.Duration {
+	if backoff *= 2; backoff > _REVERSE_MAX_BACKOFF {
+		backoff = _REVERSE_MAX_BACKOFF
+	}
+	return backoff
+}
+
+func (b *ReverseBinding) bind() (*mux.Session, error) {
+	conn, err := b.Tunnel.Dial(_REVERSE_HANDSHAKE_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(_REVERSE_HANDSHAKE_TIMEOUT))
+	c, err := b.Tunnel.Proxy.Client(conn, proxy.ReverseAddr)
+	if err == nil {
+		_, err = c.Write(bindRequest(b.Token, b.Port))
+	}
+	var status [1]byte
+	if err == nil {
+		_, err = io.ReadFull(c, status[:])
+	}
+	if err == nil && status[0] != REVERSE_OK {
+		if err = reverseErrors[status[0]]; err == nil {
+			err = errors.New("reverse bind: unknown status " + strconv.Itoa(int(status[0])))
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return mux.Client(c, b.Config), nil
+}
+
+func (b *ReverseBinding) serve(sess *mux.Session, servers *Servers) {
+	defer sess.Close()
+	for {
+		stream, err := sess.Accept()
+		if err != nil {
+			return
+		}
+		servers.Go(stream, func(stream net.Conn) {
+			b.forward(stream, servers)
+		})
+	}
+}
+
+func (b *ReverseBinding) forward(stream net.Conn, servers *Servers) {
+	conn, err := net.DialTimeout("tcp", b.Target, CurrentTimeouts().Dial)
+	if err != nil {
+		countIfTimeout(err, _TIMEOUT_DIAL)
+		b.log.Error(log.M{"msg": "connect reverse target failed", "target": b.Target, "err": err.Error()})
+		stream.Close()
+		return
+	}
+	servers.closeWith(stream, conn)
+	Pipe(stream, conn, nil, nil, nil, b.log)
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cosiner/gohper/testing2"
+	"github.com/cosiner/tunnel/mux"
+	"github.com/cosiner/tunnel/proxy"
+)
+
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	testing2.True(t, err == nil)
+	ln.Close()
+	return ln.Addr().String()
+}
+
+func freePort(t *testing.T) uint16 {
+	_, port, _ := net.SplitHostPort(freeAddr(t))
+	p, _ := strconv.Atoi(port)
+	return uint16(p)
+}
+
+// runReverseRemote runs a remote server accepting reverse bindings on addr.
+func runReverseRemote(t *testing.T, addr string, reverse *ReverseServer) *Servers {
+	tunnel, _ := proxy.NewTunnel("aes-128-cfb", "key", addr)
+	servers := NewServers()
+	_, err := RunRemote(tunnel, nil, mux.DefaultConfig, nil, reverse, servers)
+	testing2.True(t, err == nil)
+	return servers
+}
+
+func runEcho(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	testing2.True(t, err == nil)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return ln
+}
+
+// echoed reports whether data sent to addr is echoed back in timeout.
+func echoed(addr string, timeout time.Duration) bool {
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		c, err := net.DialTimeout("tcp", addr, time.Second)
+		if err != nil {
+			continue
+		}
+		c.SetDeadline(time.Now().Add(time.Second))
+		c.Write([]byte("ping"))
+		b := make([]byte, 4)
+		_, err = io.ReadFull(c, b)
+		c.Close()
+		if err == nil && string(b) == "ping" {
+			return true
+		}
+	}
+	return false
+}
+
+func TestReverseServerCheck(t *testing.T) {
+	var rs *ReverseServer
+	testing2.True(t, rs.check("", 80) == REVERSE_AUTH_FAILED)
+	rs = &ReverseServer{Ports: map[uint16]bool{80: true}}
+	testing2.True(t, rs.check("", 80) == REVERSE_AUTH_FAILED)
+	rs.Token = "token"
+	testing2.True(t, rs.check("bad", 80) == REVERSE_AUTH_FAILED)
+	testing2.True(t, rs.check("token", 81) == REVERSE_PORT_DENIED)
+	testing2.True(t, rs.check("token", 80) == REVERSE_OK)
+
+	c, s := net.Pipe()
+	go c.Write(bindRequest("token", 8080))
+	token, port, err := readBindRequest(s)
+	testing2.True(t, err == nil && token == "token" && port == 8080)
+	c.Close()
+	s.Close()
+}
+
+func TestReverseBindRejected(t *testing.T) {
+	addr := freeAddr(t)
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	testing2.True(t, err == nil)
+	defer busy.Close()
+	_, p, _ := net.SplitHostPort(busy.Addr().String())
+	busyPort, _ := strconv.Atoi(p)
+	port := freePort(t)
+	servers := runReverseRemote(t, addr, &ReverseServer{
+		Token: "token",
+		Host:  "127.0.0.1",
+		Ports: map[uint16]bool{port: true, uint16(busyPort): true},
+	})
+	defer servers.Close()
+
+	tunnel, _ := proxy.NewTunnel("aes-128-cfb", "key", addr)
+	node := NewTunnelNode(tunnel, 1, DefaultBreaker)
+	tests := []struct {
+		token string
+		port  uint16
+		err   error
+	}{
+		{"bad", port, reverseErrors[REVERSE_AUTH_FAILED]},
+		{"token", port + 1, reverseErrors[REVERSE_PORT_DENIED]},
+		{"token", uint16(busyPort), reverseErrors[REVERSE_LISTEN_FAILED]},
+	}
+	for _, test := range tests {
+		_, err := NewReverseBinding(node, test.token, test.port, "127.0.0.1:1", mux.DefaultConfig).bind()
+		testing2.True(t, err == test.err)
+	}
+}
+
+func TestReverseBindingForward(t *testing.T) {
+	addr := freeAddr(t)
+	port := freePort(t)
+	exposed := net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port)))
+	reverse := &ReverseServer{Token: "token", Host: "127.0.0.1", Ports: map[uint16]bool{port: true}}
+	remote := runReverseRemote(t, addr, reverse)
+	echo := runEcho(t)
+	defer echo.Close()
+
+	tunnel, _ := proxy.NewTunnel("aes-128-cfb", "key", addr)
+	local := NewServers()
+	defer local.Close()
+	b := NewReverseBinding(NewTunnelNode(tunnel, 1, DefaultBreaker), "token", port, echo.Addr().String(), mux.DefaultConfig)
+	b.Run(local)
+	testing2.True(t, echoed(exposed, 2*time.Second))
+
+	// binding reconnects after remote server restarted
+	remote.Close()
+	testing2.False(t, echoed(exposed, 100*time.Millisecond))
+	remote = runReverseRemote(t, addr, reverse)
+	defer remote.Close()
+	testing2.True(t, echoed(exposed, 3*time.Second))
+
+	// stopped binding closes the remote port
+	b.Stop()
+	time.Sleep(100 * time.Millisecond)
+	testing2.False(t, echoed(exposed, 100*time.Millisecond))
+}
+
+func TestReverseBackoff(t *testing.T) {
+	testing2.True(t, nextReverseBackoff(_REVERSE_BACKOFF) == 2*_REVERSE_BACKOFF)
+	testing2.True(t, nextReverseBackoff(_REVERSE_MAX_BACKOFF/2+1) == _REVERSE_MAX_BACKOFF)
+	testing2.True(t, nextReverseBackoff(_REVERSE_MAX_BACKOFF) == _REVERSE_MAX_BACKOFF)
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"net"
+
+	"github.com/cosiner/tunnel/dns"
+)
+
+const (
+	ROUTE_DIRECT = "direct"
+	ROUTE_TUNNEL = "tunnel"
+	ROUTE_AUTO   = "auto" // try direct first, fall back to tunnel and remember
+	ROUTE_REJECT = "reject"
+)
+
+// rules reported with route decisions
+const (
+	RULE_REJECT_PORT = "reject_port"
+	RULE_REJECT      = "reject"
+	RULE_REJECT_IP   = "reject_ip"
+	RULE_SUFFIX      = "direct_suffix"
+	RULE_DIRECT      = "direct"
+	RULE_DIRECT_IP   = "direct_ip"
+	RULE_TUNNEL      = "tunnel"
+	RULE_GROUP       = "group"
+	RULE_TUNNEL_IP   = "tunnel_ip"
+	RULE_LEARNED     = "learned"
+	RULE_DEFAULT     = "default"
+)
+
+func IsValidRoute(route string) bool {
+	switch route {
+	case ROUTE_DIRECT, ROUTE_TUNNEL, ROUTE_AUTO, ROUTE_REJECT:
+		return true
+	}
+	return false
+}
+
+// dns resolve modes
+const (
+	DNS_REMOTE = "remote" // domains are resolved by remote server for tunnel
+	DNS_LOCAL  = "local"  // domains are resolved locally, tunnel receives ip
+	DNS_MATCH  = "match"  // same as remote, but domains not matched by site rules are resolved to match ip rules
+)
+
+func IsValidResolveMode(mode string) bool {
+	switch mode {
+	case DNS_REMOTE, DNS_LOCAL, DNS_MATCH:
+		return true
+	}
+	return false
+}
+
+// GroupSites routes sites to a tunnel group.
+type GroupSites struct {
+	Group *TunnelGroup
+	Sites *SiteList
+}
+
+// Router decide how to connect to a host, requests to reject ports or sites
+// in reject list are rejected, sites in direct or suffix list connect
+// directly, sites in group or tunnel list use tunnel, others use Default. Ip rules are
+// applied to ip hosts, and to resolved addresses in DNS_MATCH mode. If Default
+// is empty the decision is delegated to Parent, reject rules of Parent are
+// always applied. Resolver and Resolve are inherited from Parent if empty.
+type Router struct {
+	Reject      *SiteList
+	RejectIPs   *IPList
+	RejectPorts map[uint16]bool
+	Direct      *SiteList
+	DirectIPs   *IPList
+	Tunnel      *SiteList
+	TunnelIPs   *IPList
+	Suffix      *SiteList
+	Groups      []GroupSites
+
+	Default string
+	Auto    *AutoRoute // required if ROUTE_AUTO may be returned
+	Parent  *Router
+
+	Resolve  string
+	Resolver *dns.Resolver
+}
+
+func (r *Router) ResolveMode() string {
+	for ; r != nil; r = r.Parent {
+		if r.Resolve != "" {
+			return r.Resolve
+		}
+	}
+	return DNS_REMOTE
+}
+
+// DNSResolver returns the resolver of router or it's parents, nil means the
+// system resolver is used by net.Dial.
+func (r *Router) DNSResolver() *dns.Resolver {
+	for ; r != nil; r = r.Parent {
+		if r.Resolver != nil {
+			return r.Resolver
+		}
+	}
+	return nil
+}
+
+// Route returns the route and the rule matched.
+func (r *Router) Route(host string, port uint16) (route, rule string) {
+	ip := net.ParseIP(host)
+	if rule, rejected := r.reject(host, ip, port); rejected {
+		return ROUTE_REJECT, rule
+	}
+	route, rule = r.route(host, ip)
+	if ip != nil || rule != RULE_DEFAULT || r.ResolveMode() != DNS_MATCH {
+		return route, rule
+	}
+
+	resolver := r.DNSResolver()
+	if resolver == nil {
+		return route, rule
+	}
+	ips, err := resolver.Lookup(host)
+	if err != nil || len(ips) == 0 {
+		return route, rule
+	}
+	if rule, rejected := r.reject("", ips[0], port); rejected {
+		return ROUTE_REJECT, rule
+	}
+	if iproute, iprule, matched := r.routeIP(ips[0]); matched {
+		return iproute, iprule
+	}
+	return route, rule
+}
+
+// reject check reject rules of router and all parents, reject rules are
+// always inherited.
+func (r *Router) reject(host string, ip net.IP, port uint16) (rule string, rejected bool) {
+	for ; r != nil; r = r.Parent {
+		if r.RejectPorts[port] {
+			return RULE_REJECT_PORT, true
+		}
+		if host != "" && r.Reject != nil && r.Reject.Contains(host) {
+			return RULE_REJECT, true
+		}
+		if r.RejectIPs.Contains(ip) {
+			return RULE_REJECT_IP, true
+		}
+	}
+	return "", false
+}
+
+func (r *Router) matchIP(ip net.IP) (route, rule string, matched bool) {
+	if r.DirectIPs.Contains(ip) {
+		return ROUTE_DIRECT, RULE_DIRECT_IP, true
+	}
+	if r.TunnelIPs.Contains(ip) {
+		return ROUTE_TUNNEL, RULE_TUNNEL_IP, true
+	}
+	return "", "", false
+}
+
+// routeIP check ip rules of router and parents until Default is not empty.
+func (r *Router) routeIP(ip net.IP) (route, rule string, matched bool) {
+	for ; r != nil; r = r.Parent {
+		if route, rule, matched = r.matchIP(ip); matched || r.Default != "" {
+			return route, rule, matched
+		}
+	}
+	return "", "", false
+}
+
+func (r *Router) route(host string, ip net.IP) (route, rule string) {
+	if r.Suffix != nil && r.Suffix.Contains(host) {
+		return ROUTE_DIRECT, RULE_SUFFIX
+	}
+	if r.Direct != nil && r.Direct.Contains(host) {
+		return ROUTE_DIRECT, RULE_DIRECT
+	}
+	if r.group(host) != nil {
+		return ROUTE_TUNNEL, RULE_GROUP
+	}
+	if r.Tunnel != nil && r.Tunnel.Contains(host) {
+		return ROUTE_TUNNEL, RULE_TUNNEL
+	}
+	if route, rule, matched := r.matchIP(ip); matched {
+		return route, rule
+	}
+	if r.Default == "" && r.Parent != nil {
+		return r.Parent.route(host, ip)
+	}
+
+	switch r.Default {
+	case ROUTE_DIRECT, ROUTE_REJECT:
+		return r.Default, RULE_DEFAULT
+	case ROUTE_AUTO:
+		if route, has := r.Auto.Learned(host); has {
+			return route, RULE_LEARNED
+		}
+		return ROUTE_AUTO, RULE_DEFAULT
+	}
+	return ROUTE_TUNNEL, RULE_DEFAULT
+}
+
+func (r *Router) group(host string) *TunnelGroup {
+	for _, g := range r.Groups {
+		if g.Sites.Contains(host) {
+			return g.Group
+		}
+	}
+	return nil
+}
+
+// TunnelGroup returns the group targeted by site rules of router or parents
+// the decision delegated to, nil if no rules matched.
+func (r *Router) TunnelGroup(host string) *TunnelGroup {
+	for ; r != nil; r = r.Parent {
+		if g := r.group(host); g != nil {
+			return g
+		}
+		if r.Default != "" {
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/cosiner/ygo/jsonlog"
+)
+
+const _ROUTE_SAVE_INTERVAL = time.Minute
+
+type learnedRoute struct {
+	Route  string `json:"route"`
+	Expire int64  `json:"expire"`
+}
+
+// AutoRoute learns whether a host is reachable directly. A host is learned as
+// tunnel if direct dial failed or the connection was reset or stalled before
+// any data received, and as direct after data received. Learned routes expire
+// after Expire and are persisted to File.
+type AutoRoute struct {
+	Timeout      time.Duration // direct dial timeout
+	StallTimeout time.Duration // max wait for first data after first write
+	Expire       time.Duration
+	File         string
+
+	mu     sync.Mutex
+	routes map[string]learnedRoute
+	dirty  bool
+
+	log *log.Logger
+}
+
+func NewAutoRoute(timeout, stallTimeout, expire time.Duration, file string) *AutoRoute {
+	return &AutoRoute{
+		Timeout:      timeout,
+		StallTimeout: stallTimeout,
+		Expire:       expire,
+		File:         file,
+		routes:       make(map[string]learnedRoute),
+		log:          log.Derive("AutoRoute", file),
+	}
+}
+
+func (a *AutoRoute) Learned(host string) (route string, has bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	r, has := a.routes[host]
+	if !has {
+		return "", false
+	}
+	if r.Expire <= time.Now().Unix() {
+		delete(a.routes, host)
+		a.dirty = true
+		return "", false
+	}
+	return r.Route, true
+}
+
+func (a *AutoRoute) Learn(host, route string) {
+	a.mu.Lock()
+	r, has := a.routes[host]
+	changed := !has || r.Route != route
+	a.routes[host] = learnedRoute{Route: route, Expire: time.Now().Add(a.Expire).Unix()}
+	a.dirty = true
+	a.mu.Unlock()
+
+	if changed {
+		a.log.Info(log.M{"msg": "route learned", "host": host, "route": route})
+	}
+}
+
+func (a *AutoRoute) Load() error {
+	if a.File == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(a.File)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	routes := make(map[string]learnedRoute)
+	err = json.Unmarshal(data, &routes)
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	for host, r := range routes {
+		if r.Expire <= now || (r.Route != ROUTE_DIRECT && r.Route != ROUTE_TUNNEL) {
+			delete(routes, host)
+		}
+	}
+
+	a.mu.Lock()
+	a.routes = routes
+	a.mu.Unlock()
+	return nil
+}
+
+// Inherit copies routes learned by prev, they are saved at the next save.
+func (a *AutoRoute) Inherit(prev *AutoRoute) {
+	prev.mu.Lock()
+	routes := make(map[string]learnedRoute, len(prev.routes))
+	for host, r := range prev.routes {
+		routes[host] = r
+	}
+	prev.mu.Unlock()
+
+	a.mu.Lock()
+	a.routes = routes
+	a.dirty = true
+	a.mu.Unlock()
+}
+
+func (a *AutoRoute) Save() error {
+	a.mu.Lock()
+	if a.File == "" || !a.dirty {
+		a.mu.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(a.routes)
+	a.dirty = false
+	a.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// temp file is unique since the old route may save while replaced
+	tmp, err := ioutil.TempFile(filepath.Dir(a.File), filepath.Base(a.File)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), a.File)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// Run saves learned routes periodically until signal closed.
+func (a *AutoRoute) Run(sig Signal) {
+	go func() {
+		ticker := time.NewTicker(_ROUTE_SAVE_INTERVAL)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-sig:
+				a.save()
+				return
+			case <-ticker.C:
+				a.save()
+			}
+		}
+	}()
+}
+
+func (a *AutoRoute) save() {
+	if err := a.Save(); err != nil {
+		a.log.Error(log.M{"msg": "save learned routes failed", "err": err.Error()})
+	}
+}
+
+// Dial connect host directly with the dial function and Timeout.
+func (a *AutoRoute) Dial(host string, dial func(timeout time.Duration) (net.Conn, error)) (net.Conn, error) {
+	conn, err := dial(a.Timeout)
+	if err != nil {
+		a.Learn(host, ROUTE_TUNNEL)
+		return nil, err
+	}
+	return &probeConn{Conn: conn, auto: a, host: host}, nil
+}
+
+// probeConn watch the first read of a direct connection to detect resets and
+// stalls caused by interference after connect. The stall timer starts at the
+// first write since servers wait for requests, a stall only learns the host as
+// tunnel, the connection is kept in case the server is just slow.
+type probeConn struct {
+	net.Conn
+	auto *AutoRoute
+	host string
+
+	mu     sync.Mutex
+	stall  *time.Timer
+	probed bool
+}
+
+func (c *probeConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	if c.stall == nil && !c.probed {
+		c.stall = time.AfterFunc(c.auto.StallTimeout, func() {
+			c.auto.Learn(c.host, ROUTE_TUNNEL)
+		})
+	}
+	c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+func (c *probeConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.probed || (n == 0 && err == nil) {
+		return n, err
+	}
+	c.probed = true
+	if c.stall != nil {
+		c.stall.Stop()
+	}
+	if n > 0 {
+		c.auto.Learn(c.host, ROUTE_DIRECT)
+	} else if isTimeout(err) || isConnReset(err) {
+		c.auto.Learn(c.host, ROUTE_TUNNEL)
+	}
+	return n, err
+}
+
+var errNoCloseWrite = errors.New("close write not supported")
+
+// CloseWrite closes write side of the wrapped connection if it supports, so
+// half close passes through auto routed connections.
+func (c *probeConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errNoCloseWrite
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cosiner/gohper/testing2"
+	log "github.com/cosiner/ygo/jsonlog"
+)
+
+func TestProbeConnStall(t *testing.T) {
+	auto := NewAutoRoute(time.Second, 20*time.Millisecond, time.Hour, "")
+	client, server := net.Pipe()
+	defer server.Close()
+	conn, err := auto.Dial("a.com", func(time.Duration) (net.Conn, error) {
+		return client, nil
+	})
+	testing2.True(t, err == nil)
+	defer conn.Close()
+
+	// stall timer is not started before request sent
+	time.Sleep(60 * time.Millisecond)
+	_, has := auto.Learned("a.com")
+	testing2.False(t, has)
+
+	go server.Read(make([]byte, 3))
+	conn.Write([]byte("req"))
+	time.Sleep(60 * time.Millisecond)
+	route, _ := auto.Learned("a.com")
+	testing2.True(t, route == ROUTE_TUNNEL)
+
+	// stalled connection is kept, data received later learns direct
+	go server.Write([]byte("resp"))
+	n, err := conn.Read(make([]byte, 4))
+	testing2.True(t, err == nil && n == 4)
+	route, _ = auto.Learned("a.com")
+	testing2.True(t, route == ROUTE_DIRECT)
+}
+
+func tcpPair(t *testing.T) (client, server net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	testing2.True(t, err == nil)
+	defer ln.Close()
+	client, err = net.Dial("tcp", ln.Addr().String())
+	testing2.True(t, err == nil)
+	server, err = ln.Accept()
+	testing2.True(t, err == nil)
+	return client, server
+}
+
+func TestProbeConnHalfClose(t *testing.T) {
+	auto := NewAutoRoute(time.Second, time.Second, time.Hour, "")
+	client, accepted := tcpPair(t)
+	direct, dst := tcpPair(t)
+	defer client.Close()
+	defer dst.Close()
+	conn, _ := auto.Dial("a.com", func(time.Duration) (net.Conn, error) {
+		return direct, nil
+	})
+	go Pipe(accepted, conn, nil, nil, nil, log.Derive("Test", "auto"))
+
+	// the destination sees EOF of request and still replies
+	client.Write([]byte("req"))
+	client.(*net.TCPConn).CloseWrite()
+	req, err := ioutil.ReadAll(dst)
+	testing2.True(t, err == nil && string(req) == "req")
+	dst.Write([]byte("resp"))
+	dst.Close()
+	resp, err := ioutil.ReadAll(client)
+	testing2.True(t, err == nil && string(resp) == "resp")
+}
@@ -1,6 +1,12 @@
 package server
 
-import "strings"
+import (
+	"io"
+	"net"
+	"strings"
+
+	"github.com/cosiner/tunnel/proxy"
+)
 
 const (
 	MODE_LOCAL  = "local"
@@ -11,3 +17,50 @@ func isConnClosed(err error) bool {
 	const ERR_CONN_CLOSED = "use of closed network connection"
 	return strings.Contains(err.Error(), ERR_CONN_CLOSED)
 }
+
+func isConnReset(err error) bool {
+	const ERR_CONN_RESET = "connection reset by peer"
+	return strings.Contains(err.Error(), ERR_CONN_RESET)
+}
+
+func isTimeout(err error) bool {
+	e, ok := err.(net.Error)
+	return ok && e.Timeout()
+}
+
+// reasons of handshake failures
+const (
+	_HANDSHAKE_TIMEOUT     = "timeout"
+	_HANDSHAKE_CLOSED      = "closed"
+	_HANDSHAKE_AUTH        = "auth"
+	_HANDSHAKE_BAD_REQUEST = "bad_request"
+)
+
+// countHandshakeFailure counts failed handshake of listener by reason, auth
+// failures are also counted as rejections.
+func countHandshakeFailure(listener string, err error) {
+	reason := _HANDSHAKE_BAD_REQUEST
+	switch {
+	case isTimeout(err):
+		reason = _HANDSHAKE_TIMEOUT
+		countTimeout(_TIMEOUT_HANDSHAKE)
+	case err == io.EOF || err == io.ErrUnexpectedEOF || isConnClosed(err) || isConnReset(err):
+		reason = _HANDSHAKE_CLOSED
+	case err == proxy.ErrAuthFailed || err == proxy.ErrNoSupportedMethods:
+		reason = _HANDSHAKE_AUTH
+	}
+	DefaultStats.Incr("handshake_failures_total", "listener", listener, "reason", reason)
+	if reason == _HANDSHAKE_AUTH {
+		DefaultStats.Incr("auth_rejected_total", "listener", listener, "reason", reason)
+	}
+}
+
+// countConn counts connection accepted by listener, it's active until done
+// called.
+func countConn(listener string) (done func()) {
+	DefaultStats.Incr("conns_accepted_total", "listener", listener)
+	DefaultStats.Add(1, "conns_active", "listener", listener)
+	return func() {
+		DefaultStats.Add(-1, "conns_active", "listener", listener)
+	}
+}
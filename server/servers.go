@@ -0,0 +1,202 @@
+package server
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Servers is the handle of running servers. Close stops servers gracefully:
+// listeners are closed at once, connections in flight are given Drain to
+// finish, then they are closed by force, Close returns after all goroutines
+// of servers exited. Its Signal is closed on Close, so components run with it
+// stop with servers.
+type Servers struct {
+	Drain time.Duration
+
+	sig  Signal
+	once sync.Once
+	wg   sync.WaitGroup
+
+	mu        sync.Mutex
+	closed    bool
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn][]io.Closer
+}
+
+func NewServers() *Servers {
+	return &Servers{
+		sig:       NewSignal(),
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn][]io.Closer),
+	}
+}
+
+func (s *Servers) Signal() Signal {
+	return s.sig
+}
+
+// Listener is a listener run by Servers, its handler can be replaced at
+// runtime, connections in flight keep running with the old one.
+type Listener struct {
+	ln      net.Listener
+	handler atomic.Value // func(net.Conn)
+	closed  int32
+	servers *Servers
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+func (l *Listener) setHandler(handle func(net.Conn)) {
+	l.handler.Store(handle)
+}
+
+func (l *Listener) handle(conn net.Conn) {
+	l.handler.Load().(func(net.Conn))(conn)
+}
+
+// Close stops accepting, connections accepted keep running.
+func (l *Listener) Close() error {
+	atomic.StoreInt32(&l.closed, 1)
+	l.servers.mu.Lock()
+	delete(l.servers.listeners, l.ln)
+	l.servers.mu.Unlock()
+	return l.ln.Close()
+}
+
+// serve runs accept loop of listener in a goroutine, handle is run for each
+// connection accepted. The listener is closed on Close.
+func (s *Servers) serve(ln net.Listener, handle func(net.Conn), onError func(error)) *Listener {
+	l := &Listener{ln: ln, servers: s}
+	l.setHandler(handle)
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return l
+	}
+	s.listeners[ln] = struct{}{}
+	s.wg.Add(1)
+	s.mu.Unlock()
+
+	go func() {
+		defer s.wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if !s.isClosed() && atomic.LoadInt32(&l.closed) == 0 {
+					onError(err)
+					ln.Close()
+				}
+				return
+			}
+			s.Go(conn, l.handle)
+		}
+	}()
+	return l
+}
+
+// Go runs handle for conn in a goroutine, conn is closed by force if it's not
+// finished after Drain since Close called.
+func (s *Servers) Go(conn net.Conn, handle func(net.Conn)) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		conn.Close()
+		return
+	}
+	s.conns[conn] = nil
+	s.wg.Add(1)
+	s.mu.Unlock()
+
+	go func() {
+		defer func() {
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+			s.wg.Done()
+		}()
+		handle(conn)
+	}()
+}
+
+// run runs fn in a goroutine waited by Close, fn should return once Signal
+// closed.
+func (s *Servers) run(fn func()) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.wg.Add(1)
+	s.mu.Unlock()
+
+	go func() {
+		defer s.wg.Done()
+		fn()
+	}()
+}
+
+// closeWith closes c with conn run by Go if conn is closed by force, e.g. the
+// other side of pipe, which may be blocked in reading.
+func (s *Servers) closeWith(conn net.Conn, c io.Closer) {
+	s.mu.Lock()
+	if closers, has := s.conns[conn]; has {
+		s.conns[conn] = append(closers, c)
+	}
+	s.mu.Unlock()
+}
+
+func (s *Servers) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func (s *Servers) Close() error {
+	s.once.Do(s.shutdown)
+	return nil
+}
+
+func (s *Servers) shutdown() {
+	s.mu.Lock()
+	s.closed = true
+	for ln := range s.listeners {
+		ln.Close()
+	}
+	s.mu.Unlock()
+	s.sig.Close()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	if s.Drain > 0 {
+		timer := time.NewTimer(s.Drain)
+		select {
+		case <-done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+
+	s.mu.Lock()
+	if n := len(s.conns); n > 0 {
+		DefaultStats.Add(int64(n), "shutdown_closed_conns_total")
+	}
+	for conn, closers := range s.conns {
+		conn.Close()
+		for _, c := range closers {
+			c.Close()
+		}
+	}
+	s.mu.Unlock()
+	<-done
+}
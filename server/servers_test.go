@@ -0,0 +1,76 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cosiner/gohper/testing2"
+)
+
+func TestServersDrain(t *testing.T) {
+	s := NewServers()
+	s.Drain = time.Second
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	testing2.True(t, err == nil)
+
+	started := make(chan struct{})
+	finished := make(chan struct{})
+	s.serve(ln, func(conn net.Conn) {
+		defer conn.Close()
+		close(started)
+		time.Sleep(50 * time.Millisecond)
+		close(finished)
+	}, func(error) {})
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	testing2.True(t, err == nil)
+	defer c.Close()
+	<-started
+
+	// connection in flight finishes, listener stops accepting at once
+	s.Close()
+	testing2.True(t, isDone(finished))
+	_, err = net.Dial("tcp", ln.Addr().String())
+	testing2.True(t, err != nil)
+	testing2.True(t, isDone(s.Signal()))
+}
+
+func isDone(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestServersDrainTimeout(t *testing.T) {
+	s := NewServers()
+	s.Drain = 30 * time.Millisecond
+
+	// connection blocked in reading is closed by force with its peer
+	conn, client := net.Pipe()
+	peer, other := net.Pipe()
+	defer client.Close()
+	defer other.Close()
+	s.Go(conn, func(conn net.Conn) {
+		s.closeWith(conn, peer)
+		conn.Read(make([]byte, 1))
+	})
+
+	start := time.Now()
+	s.Close()
+	cost := time.Since(start)
+	testing2.True(t, cost >= s.Drain && cost < time.Second)
+	_, err := peer.Write([]byte{1})
+	testing2.True(t, err != nil)
+
+	// connections after close are rejected
+	conn, client = net.Pipe()
+	defer client.Close()
+	handled := false
+	s.Go(conn, func(net.Conn) { handled = true })
+	_, err = conn.Read(make([]byte, 1))
+	testing2.True(t, err != nil && !handled)
+}
@@ -2,113 +2,127 @@ package server
 
 import (
 	"strings"
+	"sync"
 )
 
 const (
 	LIST_DIRECT          = iota + 1 // sites in list doesn't using tunnel
 	LIST_DIRECT_SUFFIXES            // site has these suffixes doesn't using tunnel
 	LIST_TUNNEL                     // sites in list using tunnel
+	LIST_REJECT                     // sites in list are rejected
 )
 
+// EXACT_PREFIX marks a site matches only itself rather than all sites under
+// the same registrable domain.
+const EXACT_PREFIX = "="
+
 type node struct {
+	end      bool
 	children map[byte]*node
 }
 
+// SiteList matches a site by it's registrable domain(eTLD+1) computed from
+// public suffix list, so adding www.bbc.co.uk matches news.bbc.co.uk but not
+// other sites under co.uk. Sites prefixed with EXACT_PREFIX only match itself.
+// In LIST_DIRECT_SUFFIXES mode sites are matched by suffix.
 type SiteList struct {
 	mode int
-	root node
+
+	mu       sync.RWMutex
+	domains  map[string]struct{}
+	exact    map[string]struct{}
+	suffixes node
 }
 
 func NewList(mode int, sites ...string) *SiteList {
-	if mode != LIST_DIRECT && mode != LIST_TUNNEL && mode != LIST_DIRECT_SUFFIXES {
+	if mode < LIST_DIRECT || mode > LIST_REJECT {
 		panic("invalid list mode")
 	}
 
 	list := &SiteList{
-		mode: mode,
+		mode:    mode,
+		domains: make(map[string]struct{}),
+		exact:   make(map[string]struct{}),
 	}
 	list.Add(sites...)
 	return list
 }
 
-func (l *SiteList) excludeSubDomain(site string) string {
-	i := strings.LastIndexByte(site, '.')
-	if i < 0 {
-		return site
-	}
-	i2 := strings.LastIndexByte(site[:i], '.')
-	if i2 < 0 {
-		return site
-	}
-	return site[i2+1:]
+func (l *SiteList) Mode() int {
+	return l.mode
+}
+
+func normalizeSite(site string) string {
+	return strings.ToLower(strings.TrimSuffix(site, "."))
 }
 
 func (l *SiteList) Contains(site string) bool {
+	site = normalizeSite(site)
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
 	if l.mode == LIST_DIRECT_SUFFIXES {
 		return l.containsSuffix(site)
 	}
-
-	site = l.excludeSubDomain(site)
-	return l.contains(site)
+	if _, has := l.exact[site]; has {
+		return true
+	}
+	_, has := l.domains[DefaultPublicSuffixList.RegistrableDomain(site)]
+	return has
 }
 
 func (l *SiteList) containsSuffix(site string) bool {
-	curr := &l.root
+	curr := &l.suffixes
 	for i := len(site) - 1; i >= 0; i-- {
-		b := site[i]
-
-		if curr.children == nil {
-			return true
-		}
-
-		curr = curr.children[b]
+		curr = curr.children[site[i]]
 		if curr == nil {
 			return false
 		}
+		if curr.end {
+			return true
+		}
 	}
-	return curr.children == nil
+	return false
+}
+
+func (l *SiteList) Add(sites ...string) {
+	l.mu.Lock()
+	l.add(sites...)
+	l.mu.Unlock()
 }
 
-func (l *SiteList) contains(site string) bool {
-	curr := &l.root
-	for i := range site {
-		b := site[i]
+// Reset replaces all sites in list with the given ones, readers never see a
+// partially built list.
+func (l *SiteList) Reset(sites ...string) {
+	n := NewList(l.mode, sites...)
 
-		if curr.children == nil {
-			return false
-		}
-		curr = curr.children[b]
-		if curr == nil {
-			return false
-		}
-	}
-	return curr.children == nil
+	l.mu.Lock()
+	l.domains, l.exact, l.suffixes = n.domains, n.exact, n.suffixes
+	l.mu.Unlock()
 }
 
-func (l *SiteList) Add(sites ...string) {
-	if l.mode == LIST_DIRECT_SUFFIXES {
-		for _, site := range sites {
-			l.addSuffix(site)
-		}
-	}
+func (l *SiteList) add(sites ...string) {
 	for _, site := range sites {
-		site = l.excludeSubDomain(site)
-		l.add(site)
+		if l.mode == LIST_DIRECT_SUFFIXES {
+			l.addSuffix(strings.ToLower(site))
+		} else if strings.HasPrefix(site, EXACT_PREFIX) {
+			l.exact[normalizeSite(site[len(EXACT_PREFIX):])] = struct{}{}
+		} else {
+			l.domains[DefaultPublicSuffixList.RegistrableDomain(normalizeSite(site))] = struct{}{}
+		}
 	}
 }
 
 func (l *SiteList) addSuffix(suffix string) {
-	curr := &l.root
+	if suffix == "" {
+		return
+	}
+	curr := &l.suffixes
 	for i := len(suffix) - 1; i >= 0; i-- {
 		curr = l.addNode(curr, suffix[i])
 	}
-}
-
-func (l *SiteList) add(site string) {
-	curr := &l.root
-	for i := range site {
-		curr = l.addNode(curr, site[i])
-	}
+	curr.end = true
 }
 
 func (l *SiteList) addNode(curr *node, b byte) *node {
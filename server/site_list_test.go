@@ -50,3 +50,63 @@ func TestSuffixList(t *testing.T) {
 		testing2.True(t, list.Contains(site))
 	}
 }
+
+func TestSiteListRegistrableDomain(t *testing.T) {
+	list := NewList(LIST_TUNNEL, "www.bbc.co.uk", "a.github.io", "=mail.example.com")
+
+	testing2.True(t, list.Contains("news.bbc.co.uk"))
+	testing2.True(t, list.Contains("bbc.co.uk"))
+	testing2.False(t, list.Contains("www.gov.co.uk"))
+	testing2.True(t, list.Contains("x.a.github.io"))
+	testing2.False(t, list.Contains("b.github.io"))
+	testing2.True(t, list.Contains("MAIL.example.com."))
+	testing2.False(t, list.Contains("www.example.com"))
+}
+
+func TestPublicSuffix(t *testing.T) {
+	psl := NewPublicSuffixList([]byte("com\nco.uk\n*.ck\n!www.ck\n"))
+
+	tests := []struct {
+		domain, registrable string
+	}{
+		{"com", "com"},
+		{"a.b.com", "b.com"},
+		{"a.b.co.uk", "b.co.uk"},
+		{"co.uk", "co.uk"},
+		{"a.b.ck", "a.b.ck"},
+		{"a.www.ck", "www.ck"},
+		{"a.b.unknown", "b.unknown"},
+		{"10.0.0.1", "10.0.0.1"},
+	}
+	for _, test := range tests {
+		if got := psl.RegistrableDomain(test.domain); got != test.registrable {
+			t.Errorf("%s: expect %s, got %s", test.domain, test.registrable, got)
+		}
+	}
+}
+
+func TestDefaultPublicSuffix(t *testing.T) {
+	tests := []struct {
+		domain, registrable string
+	}{
+		{"a.b.example.com", "example.com"},
+		{"a.b.co.uk", "b.co.uk"},
+		{"a.b.github.io", "b.github.io"},
+		{"a.b.c.ck", "b.c.ck"},
+		{"a.www.ck", "www.ck"},
+		{"a.b.xn--55qx5d.cn", "b.xn--55qx5d.cn"}, // 公司.cn
+		{"a.b.xn--fiqs8s", "b.xn--fiqs8s"},       // 中国
+	}
+	for _, test := range tests {
+		if got := DefaultPublicSuffixList.RegistrableDomain(test.domain); got != test.registrable {
+			t.Errorf("%s: expect %s, got %s", test.domain, test.registrable, got)
+		}
+	}
+}
+
+func TestPunycode(t *testing.T) {
+	testing2.True(t, toASCII("bücher.de") == "xn--bcher-kva.de")
+	testing2.True(t, toASCII("公司.cn") == "xn--55qx5d.cn")
+	testing2.True(t, toASCII("中国") == "xn--fiqs8s")
+	testing2.True(t, toASCII("example.com") == "example.com")
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/cosiner/ygo/jsonlog"
+)
+
+type loadedSource struct {
+	ListSource
+
+	sites      []string
+	exceptions []string
+}
+
+// ListLoader maintains site lists built from inline sites and list sources,
+// sources are reloaded periodically and lists are rebuilt after each reload.
+type ListLoader struct {
+	mu       sync.Mutex
+	lists    map[int]*SiteList
+	inline   map[int][]string
+	sources  []*loadedSource
+	suffixes *ListSource
+
+	log *log.Logger
+}
+
+func NewListLoader() *ListLoader {
+	return &ListLoader{
+		lists:  make(map[int]*SiteList),
+		inline: make(map[int][]string),
+		log:    log.Derive("Lists", ""),
+	}
+}
+
+// List returns the list of given mode, sites are added as inline sites.
+func (l *ListLoader) List(mode int, sites ...string) *SiteList {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	list := l.list(mode)
+	l.inline[mode] = append(l.inline[mode], sites...)
+	list.Add(sites...)
+	return list
+}
+
+func (l *ListLoader) list(mode int) *SiteList {
+	list, has := l.lists[mode]
+	if !has {
+		list = NewList(mode)
+		l.lists[mode] = list
+	}
+	return list
+}
+
+// exceptionMode returns the mode of list that exceptions of a source in given
+// mode goes to, exceptions of a tunnel list connect directly. Exceptions of
+// other lists are ignored, direct list is matched before tunnel list, so they
+// never take effect.
+func exceptionMode(mode int) int {
+	if mode == LIST_TUNNEL {
+		return LIST_DIRECT
+	}
+	return 0
+}
+
+func (l *ListLoader) AddSource(src ListSource) {
+	l.mu.Lock()
+	l.list(src.Mode)
+	if m := exceptionMode(src.Mode); m != 0 {
+		l.list(m)
+	}
+	l.sources = append(l.sources, &loadedSource{ListSource: src})
+	l.mu.Unlock()
+}
+
+// SetPublicSuffixSource use src to update DefaultPublicSuffixList, lists are
+// rebuilt after each update since sites are stored as registrable domains.
+func (l *ListLoader) SetPublicSuffixSource(src ListSource) {
+	l.mu.Lock()
+	l.suffixes = &src
+	l.mu.Unlock()
+}
+
+// Load loads all sources and rebuild lists, failed sources are logged and
+// left empty.
+func (l *ListLoader) Load() {
+	l.mu.Lock()
+	sources, suffixes := l.sources, l.suffixes
+	l.mu.Unlock()
+
+	if suffixes != nil {
+		l.loadPublicSuffixes(suffixes)
+	}
+	for _, src := range sources {
+		l.load(src)
+	}
+	l.rebuild()
+}
+
+func (l *ListLoader) logLoad(src *ListSource, status int, err error) bool {
+	if err != nil {
+		switch status {
+		case _LOAD_FAILED:
+			l.log.Error(log.M{"msg": "load list failed", "url": src.Url, "err": err.Error()})
+		case _LOAD_CACHED:
+			l.log.Warn(log.M{"msg": "load list failed, use cache", "url": src.Url, "cache": src.Cache, "err": err.Error()})
+		default:
+			l.log.Warn(log.M{"msg": "list loaded with error", "url": src.Url, "err": err.Error()})
+		}
+	}
+	return status != _LOAD_FAILED
+}
+
+func (l *ListLoader) loadPublicSuffixes(src *ListSource) bool {
+	status, err := src.load(DefaultPublicSuffixList.Reset)
+	return l.logLoad(src, status, err)
+}
+
+func (l *ListLoader) load(src *loadedSource) bool {
+	sites, exceptions, status, err := src.loadSites()
+	if !l.logLoad(&src.ListSource, status, err) {
+		return false
+	}
+
+	l.mu.Lock()
+	src.sites = sites
+	src.exceptions = exceptions
+	l.mu.Unlock()
+	l.log.Info(log.M{"msg": "list loaded", "url": src.Url, "sites": len(sites), "exceptions": len(exceptions)})
+	if len(exceptions) > 0 && exceptionMode(src.Mode) == 0 {
+		l.log.Warn(log.M{"msg": "exceptions are only supported by tunnel list, ignored", "url": src.Url, "exceptions": len(exceptions)})
+	}
+	return true
+}
+
+func (l *ListLoader) rebuild() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	all := make(map[int][]string)
+	for mode, sites := range l.inline {
+		all[mode] = append(all[mode], sites...)
+	}
+	for _, src := range l.sources {
+		all[src.Mode] = append(all[src.Mode], src.sites...)
+		if m := exceptionMode(src.Mode); m != 0 {
+			all[m] = append(all[m], src.exceptions...)
+		}
+	}
+	for mode, list := range l.lists {
+		list.Reset(all[mode]...)
+	}
+}
+
+// Run reloads each source with refresh interval in background until signal
+// closed.
+func (l *ListLoader) Run(sig Signal) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, src := range l.sources {
+		if src.Refresh > 0 {
+			src := src
+			go l.refresh(src.Refresh, sig, func() bool {
+				return l.load(src)
+			})
+		}
+	}
+	if src := l.suffixes; src != nil && src.Refresh > 0 {
+		go l.refresh(src.Refresh, sig, func() bool {
+			return l.loadPublicSuffixes(src)
+		})
+	}
+}
+
+func (l *ListLoader) refresh(interval time.Duration, sig Signal, load func() bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sig:
+			return
+		case <-ticker.C:
+			if load() {
+				l.rebuild()
+			}
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cosiner/gohper/testing2"
+)
+
+func TestListLoaderExceptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lists")
+	testing2.True(t, err == nil)
+	defer os.RemoveAll(dir)
+	tunnelFile, directFile := filepath.Join(dir, "tunnel.txt"), filepath.Join(dir, "direct.txt")
+	ioutil.WriteFile(tunnelFile, []byte("||a.com\n@@||b.com\n"), 0644)
+	ioutil.WriteFile(directFile, []byte("||c.com\n@@||d.com\n"), 0644)
+
+	l := NewListLoader()
+	l.AddSource(ListSource{Mode: LIST_TUNNEL, Url: tunnelFile, Format: FORMAT_GFWLIST})
+	l.AddSource(ListSource{Mode: LIST_DIRECT, Url: directFile, Format: FORMAT_GFWLIST})
+	l.Load()
+	tunnel, direct := l.List(LIST_TUNNEL), l.List(LIST_DIRECT)
+
+	// exceptions of tunnel list connect directly
+	testing2.True(t, tunnel.Contains("a.com") && direct.Contains("b.com"))
+	testing2.False(t, tunnel.Contains("b.com"))
+
+	// exceptions of direct list are ignored
+	testing2.True(t, direct.Contains("c.com"))
+	testing2.False(t, tunnel.Contains("d.com") || direct.Contains("d.com"))
+}
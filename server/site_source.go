@@ -0,0 +1,310 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	FORMAT_PLAIN   = "plain"   // one domain per line
+	FORMAT_HOSTS   = "hosts"   // ip domain [domain...], domains match exactly
+	FORMAT_DNSMASQ = "dnsmasq" // server=/domain/ip, ipset=/domain/set, address=/domain/ip
+	FORMAT_GFWLIST = "gfwlist" // AutoProxy/AdBlock rules, optionally base64 encoded
+)
+
+const _FETCH_TIMEOUT = 30 * time.Second
+
+// ListSource describes where the sites of a list come from. Url is either a
+// local file path or a http(s) url, remote contents are saved to Cache after
+// each successful fetch and Cache is used if a later fetch fails.
+type ListSource struct {
+	Mode    int
+	Url     string
+	Format  string
+	Cache   string
+	Refresh time.Duration
+}
+
+func (s *ListSource) isRemote() bool {
+	return strings.HasPrefix(s.Url, "http://") || strings.HasPrefix(s.Url, "https://")
+}
+
+func (s *ListSource) fetch() ([]byte, error) {
+	if !s.isRemote() {
+		return ioutil.ReadFile(s.Url)
+	}
+
+	client := http.Client{Timeout: _FETCH_TIMEOUT}
+	resp, err := client.Get(s.Url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+const (
+	_LOAD_FAILED = iota
+	_LOAD_OK
+	_LOAD_CACHED // fetching or parsing failed, cache is used
+)
+
+// loadSites fetch and parse sites of the source.
+func (s *ListSource) loadSites() (sites, exceptions []string, status int, err error) {
+	status, err = s.load(func(data []byte) (err error) {
+		sites, exceptions, err = ParseList(s.Format, data)
+		return err
+	})
+	return sites, exceptions, status, err
+}
+
+// load fetch source content and pass it to parse, the cached copy is parsed if
+// fetching or parsing failed. err is non-nil if fetching, parsing or saving
+// cache failed, even if the status is not _LOAD_FAILED.
+func (s *ListSource) load(parse func([]byte) error) (status int, err error) {
+	data, err := s.fetch()
+	if err == nil {
+		err = parse(data)
+	}
+	if err == nil {
+		if s.isRemote() && s.Cache != "" {
+			if err = ioutil.WriteFile(s.Cache, data, 0644); err != nil {
+				err = errors.New("save cache failed: " + err.Error())
+			}
+		}
+		return _LOAD_OK, err
+	}
+	if s.Cache == "" {
+		return _LOAD_FAILED, err
+	}
+
+	data, cerr := ioutil.ReadFile(s.Cache)
+	if cerr == nil {
+		cerr = parse(data)
+	}
+	if cerr != nil {
+		return _LOAD_FAILED, err
+	}
+	return _LOAD_CACHED, err
+}
+
+// ParseList parse list content in the given format, exceptions are sites
+// explicitly excluded from the list, only gfwlist format has them.
+func ParseList(format string, data []byte) (sites, exceptions []string, err error) {
+	var parseLine func(string) (site string, exception bool)
+	switch format {
+	case FORMAT_PLAIN, "":
+		parseLine = parsePlainLine
+	case FORMAT_HOSTS:
+		sites, err = parseHosts(data)
+		return sites, nil, err
+	case FORMAT_DNSMASQ:
+		sites, err = parseDnsmasq(data)
+		return sites, nil, err
+	case FORMAT_GFWLIST:
+		data, err = decodeGfwlist(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		parseLine = parseGfwlistLine
+	default:
+		return nil, nil, errors.New("unsupported list format: " + format)
+	}
+
+	err = eachLine(data, func(line string) {
+		site, exception := parseLine(line)
+		if site == "" {
+			return
+		}
+		if exception {
+			exceptions = append(exceptions, site)
+		} else {
+			sites = append(sites, site)
+		}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return sites, exceptions, nil
+}
+
+// eachLine calls fn for each non-empty line, the error of scanning is returned,
+// e.g. a line is too long.
+func eachLine(data []byte, fn func(string)) error {
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(nil, 64*1024)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line != "" {
+			fn(line)
+		}
+	}
+	return sc.Err()
+}
+
+func isComment(line string) bool {
+	return strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//")
+}
+
+func isDomain(s string) bool {
+	if len(s) == 0 || len(s) > _MAX_DOMAIN_LEN || strings.IndexByte(s, '.') < 0 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c >= 'a' && c <= 'z') && !(c >= '0' && c <= '9') && c != '-' && c != '.' && c != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+const _MAX_DOMAIN_LEN = 253
+
+func normalizeDomain(s string) string {
+	s = strings.ToLower(strings.Trim(s, "."))
+	if !isDomain(s) {
+		return ""
+	}
+	return s
+}
+
+func parsePlainLine(line string) (string, bool) {
+	if isComment(line) {
+		return "", false
+	}
+	if strings.HasPrefix(line, EXACT_PREFIX) {
+		if site := normalizeDomain(line[len(EXACT_PREFIX):]); site != "" {
+			return EXACT_PREFIX + site, false
+		}
+		return "", false
+	}
+	return normalizeDomain(line), false
+}
+
+func parseHosts(data []byte) ([]string, error) {
+	var sites []string
+	err := eachLine(data, func(line string) {
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return
+		}
+		for _, f := range fields[1:] {
+			if f == "localhost" || strings.HasPrefix(f, "localhost.") {
+				continue
+			}
+			if site := normalizeDomain(f); site != "" {
+				sites = append(sites, EXACT_PREFIX+site)
+			}
+		}
+	})
+	return sites, err
+}
+
+func parseDnsmasq(data []byte) ([]string, error) {
+	var sites []string
+	err := eachLine(data, func(line string) {
+		if isComment(line) {
+			return
+		}
+		i := strings.IndexByte(line, '=')
+		if i < 0 {
+			return
+		}
+		switch line[:i] {
+		case "server", "address", "ipset", "nftset", "local":
+		default:
+			return
+		}
+		// server=/a.com/b.com/1.1.1.1, the last part is not a domain
+		parts := strings.Split(line[i+1:], "/")
+		if len(parts) < 3 || parts[0] != "" {
+			return
+		}
+		for _, p := range parts[1 : len(parts)-1] {
+			if site := normalizeDomain(p); site != "" {
+				sites = append(sites, site)
+			}
+		}
+	})
+	return sites, err
+}
+
+func decodeGfwlist(data []byte) ([]byte, error) {
+	data = bytes.TrimSpace(data)
+	if bytes.HasPrefix(data, []byte("[")) || bytes.Contains(data, []byte("||")) {
+		return data, nil
+	}
+
+	raw := bytes.Map(func(r rune) rune {
+		if r == '\r' || r == '\n' || r == ' ' || r == '\t' {
+			return -1
+		}
+		return r
+	}, data)
+	dec := make([]byte, base64.StdEncoding.DecodedLen(len(raw)))
+	n, err := base64.StdEncoding.Decode(dec, raw)
+	if err != nil {
+		return nil, errors.New("invalid gfwlist base64 content: " + err.Error())
+	}
+	return dec[:n], nil
+}
+
+func parseGfwlistLine(line string) (string, bool) {
+	if line[0] == '!' || line[0] == '[' {
+		return "", false
+	}
+	exception := strings.HasPrefix(line, "@@")
+	if exception {
+		line = line[2:]
+	}
+	if len(line) >= 2 && line[0] == '/' && line[len(line)-1] == '/' {
+		return "", false // regexp rules
+	}
+	if i := strings.IndexByte(line, '$'); i >= 0 {
+		line = line[:i] // adblock options
+	}
+
+	var prefix string
+	switch {
+	case strings.HasPrefix(line, "||"):
+		line = line[2:]
+	case strings.HasPrefix(line, "|"):
+		// url prefix matches the exact host only
+		u, err := url.Parse(line[1:])
+		if err != nil || u.Hostname() == "" {
+			return "", false
+		}
+		line = u.Hostname()
+		prefix = EXACT_PREFIX
+	default:
+		if i := strings.Index(line, "://"); i >= 0 {
+			line = line[i+3:]
+		}
+	}
+	if i := strings.IndexAny(line, "/^:|?"); i >= 0 {
+		line = line[:i]
+	}
+	line = strings.TrimPrefix(line, "*.")
+	if strings.IndexByte(line, '*') >= 0 {
+		return "", false
+	}
+	if line = normalizeDomain(line); line == "" {
+		return "", false
+	}
+	return prefix + line, exception
+}
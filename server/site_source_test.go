@@ -0,0 +1,75 @@
+package server
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cosiner/gohper/testing2"
+)
+
+func TestParseList(t *testing.T) {
+	gfwlist := `[AutoProxy 0.2.9]
+! comment
+||google.com
+|https://www.example.org/path
+.twitter.com
+@@||baidu.com
+/^https?:\/\/[^\/]+blogspot\.(.*)/
+*.keyword*
+`
+	tests := []struct {
+		format     string
+		data       string
+		sites      []string
+		exceptions []string
+	}{
+		{FORMAT_PLAIN, "# comment\n// comment\nGoogle.com\n\n.github.com\n=a.b.com\n", []string{"google.com", "github.com", "=a.b.com"}, nil},
+		{FORMAT_HOSTS, "127.0.0.1 localhost\n0.0.0.0 ads.a.com ads.b.com # ads\n", []string{"=ads.a.com", "=ads.b.com"}, nil},
+		{FORMAT_DNSMASQ, "server=/baidu.com/114.114.114.114\nipset=/qq.com/163.com/china\n", []string{"baidu.com", "qq.com", "163.com"}, nil},
+		{FORMAT_GFWLIST, gfwlist, []string{"google.com", "=www.example.org", "twitter.com"}, []string{"baidu.com"}},
+		{FORMAT_GFWLIST, base64.StdEncoding.EncodeToString([]byte(gfwlist)), []string{"google.com", "=www.example.org", "twitter.com"}, []string{"baidu.com"}},
+	}
+
+	for _, test := range tests {
+		sites, exceptions, err := ParseList(test.format, []byte(test.data))
+		testing2.True(t, err == nil)
+		if !reflect.DeepEqual(sites, test.sites) || !reflect.DeepEqual(exceptions, test.exceptions) {
+			t.Errorf("%s: expect %v %v, got %v %v", test.format, test.sites, test.exceptions, sites, exceptions)
+		}
+	}
+
+	_, _, err := ParseList("unknown", nil)
+	testing2.True(t, err != nil)
+}
+
+func TestParseListLongLine(t *testing.T) {
+	long := "a.com\n" + strings.Repeat("x", 64*1024) + ".com\nb.com\n"
+	for _, format := range []string{FORMAT_PLAIN, FORMAT_HOSTS, FORMAT_DNSMASQ, FORMAT_GFWLIST} {
+		sites, _, err := ParseList(format, []byte(long))
+		testing2.True(t, err != nil && sites == nil)
+	}
+
+	psl := NewPublicSuffixList([]byte("com\n"))
+	testing2.True(t, psl.Reset([]byte(long)) != nil)
+	testing2.True(t, psl.Reset([]byte("// comment\n")) == errNoPublicSuffixes)
+	testing2.True(t, psl.RegistrableDomain("a.b.com") == "b.com")
+}
+
+func TestListSourceLoadCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "list")
+	testing2.True(t, err == nil)
+	defer os.RemoveAll(dir)
+	src := ListSource{Url: filepath.Join(dir, "list.txt"), Cache: filepath.Join(dir, "cache.txt")}
+	ioutil.WriteFile(src.Url, []byte("a.com\n"+strings.Repeat("x", 64*1024)+".com\n"), 0644)
+	ioutil.WriteFile(src.Cache, []byte("b.com\n"), 0644)
+
+	// list failed to parse falls back to cache
+	sites, _, status, err := src.loadSites()
+	testing2.True(t, status == _LOAD_CACHED && err != nil)
+	testing2.True(t, reflect.DeepEqual(sites, []string{"b.com"}))
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a set of counters and histograms identified by name and label
+// pairs, keys are formatted as name{label="value",...}.
+type Stats struct {
+	mu         sync.RWMutex
+	counters   map[string]*int64
+	histograms map[string]*histogram
+}
+
+var DefaultStats = NewStats()
+
+func NewStats() *Stats {
+	return &Stats{
+		counters:   make(map[string]*int64),
+		histograms: make(map[string]*histogram),
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// StatsKey format name and label pairs as counter key, labels must be in
+// name, value pairs.
+func StatsKey(name string, labels ...string) string {
+	if len(labels) == 0 {
+		return name
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(name)
+	buf.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(labels[i])
+		buf.WriteString(`="`)
+		labelEscaper.WriteString(&buf, labels[i+1])
+		buf.WriteByte('"')
+	}
+	buf.WriteByte('}')
+	return buf.String()
+}
+
+func (s *Stats) counter(key string) *int64 {
+	s.mu.RLock()
+	c, has := s.counters[key]
+	s.mu.RUnlock()
+	if has {
+		return c
+	}
+
+	s.mu.Lock()
+	c, has = s.counters[key]
+	if !has {
+		c = new(int64)
+		s.counters[key] = c
+	}
+	s.mu.Unlock()
+	return c
+}
+
+func (s *Stats) Add(delta int64, name string, labels ...string) {
+	atomic.AddInt64(s.counter(StatsKey(name, labels...)), delta)
+}
+
+// Set is used for gauges.
+func (s *Stats) Set(value int64, name string, labels ...string) {
+	atomic.StoreInt64(s.counter(StatsKey(name, labels...)), value)
+}
+
+// Delete removes the counter, it's used for gauges of things no longer exist.
+func (s *Stats) Delete(name string, labels ...string) {
+	key := StatsKey(name, labels...)
+	s.mu.Lock()
+	delete(s.counters, key)
+	s.mu.Unlock()
+}
+
+func (s *Stats) Incr(name string, labels ...string) {
+	s.Add(1, name, labels...)
+}
+
+func (s *Stats) Get(name string, labels ...string) int64 {
+	return atomic.LoadInt64(s.counter(StatsKey(name, labels...)))
+}
+
+// Keys returns all counter keys in order.
+func (s *Stats) Keys() []string {
+	s.mu.RLock()
+	keys := make([]string, 0, len(s.counters))
+	for key := range s.counters {
+		keys = append(keys, key)
+	}
+	s.mu.RUnlock()
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *Stats) Snapshot() map[string]int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	m := make(map[string]int64, len(s.counters))
+	for key, c := range s.counters {
+		m[key] = atomic.LoadInt64(c)
+	}
+	return m
+}
+
+// histogram buckets of durations in seconds
+var _HISTOGRAM_BUCKETS = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	counts []int64 // atomic, count of each bucket and +Inf, not cumulative
+	sum    int64   // atomic, nanoseconds
+}
+
+func (s *Stats) histogram(key string) *histogram {
+	s.mu.RLock()
+	h, has := s.histograms[key]
+	s.mu.RUnlock()
+	if has {
+		return h
+	}
+
+	s.mu.Lock()
+	h, has = s.histograms[key]
+	if !has {
+		h = &histogram{counts: make([]int64, len(_HISTOGRAM_BUCKETS)+1)}
+		s.histograms[key] = h
+	}
+	s.mu.Unlock()
+	return h
+}
+
+// Observe records duration d to histogram.
+func (s *Stats) Observe(d time.Duration, name string, labels ...string) {
+	h := s.histogram(StatsKey(name, labels...))
+	i := sort.SearchFloat64s(_HISTOGRAM_BUCKETS, d.Seconds())
+	atomic.AddInt64(&h.counts[i], 1)
+	atomic.AddInt64(&h.sum, int64(d))
+}
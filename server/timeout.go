@@ -0,0 +1,128 @@
+package server
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Timeouts of the data path on both local and remote, 0 disables each one.
+type Timeouts struct {
+	Handshake time.Duration // reading socks and tunnel requests
+	Dial      time.Duration // each outbound connection attempt
+	Idle      time.Duration // no data in either direction
+	Lifetime  time.Duration // total time of a connection
+}
+
+// DefaultTimeouts are used until SetTimeouts called.
+var DefaultTimeouts = Timeouts{
+	Handshake: 10 * time.Second,
+	Dial:      10 * time.Second,
+	Idle:      5 * time.Minute,
+}
+
+var timeouts atomic.Value // Timeouts
+
+// SetTimeouts changes timeouts of new connections.
+func SetTimeouts(t Timeouts) {
+	timeouts.Store(t)
+}
+
+func CurrentTimeouts() Timeouts {
+	if t, ok := timeouts.Load().(Timeouts); ok {
+		return t
+	}
+	return DefaultTimeouts
+}
+
+const (
+	_TIMEOUT_HANDSHAKE = "handshake"
+	_TIMEOUT_DIAL      = "dial"
+	_TIMEOUT_IDLE      = "idle"
+	_TIMEOUT_LIFETIME  = "lifetime"
+)
+
+func countTimeout(kind string) {
+	DefaultStats.Incr("timeouts_total", "kind", kind)
+}
+
+// countIfTimeout counts err if it's a timeout, it returns err.
+func countIfTimeout(err error, kind string) error {
+	if err != nil && isTimeout(err) {
+		countTimeout(kind)
+	}
+	return err
+}
+
+// deadlineAfter returns the deadline d later, zero time if d is 0.
+func deadlineAfter(d time.Duration) time.Time {
+	if d <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(d)
+}
+
+// minTimeout returns the smaller of a and b, 0 is unlimited.
+func minTimeout(a, b time.Duration) time.Duration {
+	if a <= 0 || (b > 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// activity records the last time data was read, shared by both directions of
+// a pipe.
+type activity struct {
+	last int64
+}
+
+func newActivity() *activity {
+	a := &activity{}
+	a.touch()
+	return a
+}
+
+func (a *activity) touch() {
+	atomic.StoreInt64(&a.last, time.Now().UnixNano())
+}
+
+// remaining returns the time left before idle exceeded.
+func (a *activity) remaining(idle time.Duration) time.Duration {
+	return time.Duration(atomic.LoadInt64(&a.last)+int64(idle)) - time.Duration(time.Now().UnixNano())
+}
+
+// watchPipe closes both connections once idle or lifetime of t exceeded,
+// until stop closed.
+func watchPipe(a, b net.Conn, act *activity, t Timeouts, stop <-chan struct{}) {
+	var lifetime, idle <-chan time.Time
+	if t.Lifetime > 0 {
+		timer := time.NewTimer(t.Lifetime)
+		defer timer.Stop()
+		lifetime = timer.C
+	}
+	var idleTimer *time.Timer
+	if act != nil {
+		idleTimer = time.NewTimer(t.Idle)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+
+	var kind string
+	for kind == "" {
+		select {
+		case <-stop:
+			return
+		case <-lifetime:
+			kind = _TIMEOUT_LIFETIME
+		case <-idle:
+			if d := act.remaining(t.Idle); d > 0 {
+				idleTimer.Reset(d)
+			} else {
+				kind = _TIMEOUT_IDLE
+			}
+		}
+	}
+	countTimeout(kind)
+	a.Close()
+	b.Close()
+}
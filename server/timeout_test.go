@@ -0,0 +1,53 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cosiner/gohper/testing2"
+)
+
+func TestPoolIdleBelowIdleTimeout(t *testing.T) {
+	testing2.True(t, poolIdle(0, DefaultTimeouts.Idle) == _POOL_IDLE)
+	testing2.True(t, poolIdle(0, DefaultTimeouts.Idle) < DefaultTimeouts.Idle)
+	testing2.True(t, poolIdle(10*time.Minute, 5*time.Minute) == 150*time.Second)
+	testing2.True(t, poolIdle(10*time.Minute, 0) == 10*time.Minute)
+}
+
+func TestAwaitRequest(t *testing.T) {
+	timeouts := Timeouts{Handshake: 20 * time.Millisecond, Idle: time.Second}
+
+	// pooled connection silent longer than handshake timeout is still served
+	client, server := net.Pipe()
+	go func() {
+		time.Sleep(3 * timeouts.Handshake)
+		client.Write([]byte("req"))
+	}()
+	c := newPeekConn(server)
+	testing2.True(t, awaitRequest(c, timeouts) == nil)
+	buf := make([]byte, 3)
+	n, err := c.Read(buf)
+	testing2.True(t, err == nil && string(buf[:n]) == "req")
+	client.Close()
+	server.Close()
+
+	// connection without request is closed after the longest pool idle
+	client, server = net.Pipe()
+	timeouts.Idle = 4 * timeouts.Handshake
+	start := time.Now()
+	err = awaitRequest(newPeekConn(server), timeouts)
+	testing2.True(t, err != nil && isTimeout(err) && time.Since(start) < timeouts.Idle)
+	client.Close()
+	server.Close()
+}
+
+func TestRequestWait(t *testing.T) {
+	// bounded even if idle timeout is disabled
+	testing2.True(t, requestWait(Timeouts{}) == _POOL_IDLE)
+	testing2.True(t, requestWait(Timeouts{Handshake: time.Second}) == _POOL_IDLE)
+	testing2.True(t, requestWait(Timeouts{Handshake: time.Minute}) == time.Minute)
+	// pooled connections are kept below half of the idle timeout
+	testing2.True(t, requestWait(Timeouts{Handshake: time.Second, Idle: 5 * time.Minute}) == 150*time.Second)
+	testing2.True(t, requestWait(Timeouts{Handshake: time.Second, Idle: time.Second}) == time.Second)
+}
@@ -0,0 +1,252 @@
+package server
+
+import (
+	"errors"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/cosiner/tunnel/proxy"
+	log "github.com/cosiner/ygo/jsonlog"
+)
+
+// tunnel selection strategies
+const (
+	SELECT_RANDOM      = "random" // weighted random
+	SELECT_ROUND_ROBIN = "round_robin"
+	SELECT_LEAST_CONNS = "least_conns"
+	SELECT_LATENCY     = "latency" // lowest ewma handshake latency
+	SELECT_HASH        = "hash"    // consistent hashing by destination host
+)
+
+const _HASH_REPLICAS = 64 // virtual nodes per weight of a tunnel in hash ring
+
+// group of all tunnels if not configured
+const DEFAULT_GROUP = "default"
+
+var (
+	ErrNoTunnel     = errors.New("no tunnel available")
+	errDialDeadline = errors.New("tunnel dial deadline exceeded")
+)
+
+// Retry configures dialing of tunnels in a group, each attempt selects a
+// tunnel not tried, attempts stop after Deadline. Direct allows connecting
+// directly after all attempts failed.
+type Retry struct {
+	Attempts int
+	Deadline time.Duration
+	Direct   bool
+}
+
+// TunnelGroup is a named set of tunnels selected by a strategy, only available
+// tunnels are selected unless all tunnels are unavailable. If Direct is set,
+// direct connection is used instead of unavailable tunnels.
+type TunnelGroup struct {
+	Name     string
+	Strategy string
+	Nodes    []*TunnelNode
+	Direct   bool
+	Retry    Retry
+
+	next uint64   // round robin counter
+	ring []uint32 // sorted hash ring
+	owns map[uint32]*TunnelNode
+}
+
+func NewTunnelGroup(name, strategy string, nodes []*TunnelNode, direct bool) (*TunnelGroup, error) {
+	if len(nodes) == 0 && !direct {
+		return nil, errors.New("empty tunnel group: " + name)
+	}
+	if strategy == "" {
+		strategy = SELECT_RANDOM
+	}
+	g := &TunnelGroup{
+		Name:     name,
+		Strategy: strategy,
+		Nodes:    nodes,
+		Direct:   direct,
+	}
+	switch strategy {
+	case SELECT_RANDOM, SELECT_ROUND_ROBIN, SELECT_LEAST_CONNS, SELECT_LATENCY:
+	case SELECT_HASH:
+		g.buildRing()
+	default:
+		return nil, errors.New("unsupported tunnel selection strategy: " + strategy)
+	}
+	return g, nil
+}
+
+func hash32(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+func (g *TunnelGroup) buildRing() {
+	g.owns = make(map[uint32]*TunnelNode)
+	for _, n := range g.Nodes {
+		for i := 0; i < _HASH_REPLICAS*n.Weight; i++ {
+			h := hash32(n.Addr() + "#" + strconv.Itoa(i))
+			if _, has := g.owns[h]; !has {
+				g.owns[h] = n
+				g.ring = append(g.ring, h)
+			}
+		}
+	}
+	sort.Slice(g.ring, func(i, j int) bool { return g.ring[i] < g.ring[j] })
+}
+
+// Select returns a tunnel for host, excluded tunnels are never selected, it
+// returns nil if all tunnels excluded, or no tunnel available and Direct is
+// set.
+func (g *TunnelGroup) Select(host string, excluded map[*TunnelNode]bool) *TunnelNode {
+	candidates := make([]*TunnelNode, 0, len(g.Nodes))
+	for _, n := range g.Nodes {
+		if !excluded[n] && n.selectable() {
+			candidates = append(candidates, n)
+		}
+	}
+	if len(candidates) == 0 {
+		if g.Direct {
+			return nil
+		}
+		for _, n := range g.Nodes {
+			if !excluded[n] {
+				candidates = append(candidates, n)
+			}
+		}
+		if len(candidates) == 0 {
+			return nil
+		}
+	}
+
+	var n *TunnelNode
+	switch g.Strategy {
+	case SELECT_ROUND_ROBIN:
+		n = candidates[atomic.AddUint64(&g.next, 1)%uint64(len(candidates))]
+	case SELECT_LEAST_CONNS:
+		n = g.leastConns(candidates)
+	case SELECT_LATENCY:
+		n = g.lowestLatency(candidates)
+	case SELECT_HASH:
+		n = g.hashed(host, candidates)
+	default:
+		n = g.weightedRandom(candidates)
+	}
+	// move open circuit to half open
+	n.Available()
+	return n
+}
+
+func (g *TunnelGroup) weightedRandom(candidates []*TunnelNode) *TunnelNode {
+	var total int
+	for _, n := range candidates {
+		total += n.Weight
+	}
+	r := rand.Intn(total)
+	for _, n := range candidates {
+		if r -= n.Weight; r < 0 {
+			return n
+		}
+	}
+	return candidates[len(candidates)-1]
+}
+
+// leastConns compares active connections divided by weight.
+func (g *TunnelGroup) leastConns(candidates []*TunnelNode) *TunnelNode {
+	best := candidates[0]
+	for _, n := range candidates[1:] {
+		if n.Active()*int64(best.Weight) < best.Active()*int64(n.Weight) {
+			best = n
+		}
+	}
+	return best
+}
+
+// lowestLatency prefers unmeasured tunnels so each tunnel gets measured.
+func (g *TunnelGroup) lowestLatency(candidates []*TunnelNode) *TunnelNode {
+	best, bestLatency := candidates[0], candidates[0].Latency()
+	for _, n := range candidates[1:] {
+		if l := n.Latency(); l < bestLatency {
+			best, bestLatency = n, l
+		}
+	}
+	return best
+}
+
+// hashed walks the ring clockwise from hash of host to the first candidate, so
+// a host sticks to a tunnel as long as it's available.
+func (g *TunnelGroup) hashed(host string, candidates []*TunnelNode) *TunnelNode {
+	allowed := make(map[*TunnelNode]bool, len(candidates))
+	for _, n := range candidates {
+		allowed[n] = true
+	}
+
+	h := hash32(host)
+	start := sort.Search(len(g.ring), func(i int) bool { return g.ring[i] >= h })
+	for i := 0; i < len(g.ring); i++ {
+		n := g.owns[g.ring[(start+i)%len(g.ring)]]
+		if allowed[n] {
+			return n
+		}
+	}
+	return candidates[0]
+}
+
+// Dial try tunnels of the group until succeed, retry attempts or deadline
+// exceeded, the tunnel connected is returned. early is sent with the request.
+func (g *TunnelGroup) Dial(addr proxy.Addr, early []byte, host string, logger *log.Logger) (conn net.Conn, tunnel *TunnelNode, err error) {
+	retry := g.Retry
+	attempts := retry.Attempts
+	if attempts <= 0 {
+		attempts = 1
+	}
+	var deadline time.Time
+	if retry.Deadline > 0 {
+		deadline = time.Now().Add(retry.Deadline)
+	}
+
+	err = ErrNoTunnel
+	tried := make(map[*TunnelNode]bool)
+	for i := 1; i <= attempts; i++ {
+		timeout := CurrentTimeouts().Dial
+		if !deadline.IsZero() {
+			left := time.Until(deadline)
+			if left <= 0 {
+				err = errDialDeadline
+				break
+			}
+			timeout = minTimeout(timeout, left)
+		}
+		if tunnel = g.Select(host, tried); tunnel == nil {
+			break
+		}
+		tried[tunnel] = true
+
+		start := time.Now()
+		var dialed bool
+		conn, dialed, err = tunnel.Connect(addr, early, timeout)
+		if err == nil {
+			// only new connections measure the distance to tunnel server
+			var latency time.Duration
+			if dialed {
+				latency = time.Since(start)
+				DefaultStats.Observe(latency, "tunnel_dial_seconds", "tunnel", tunnel.Addr())
+			}
+			tunnel.Success(latency)
+			if i > 1 {
+				logger.Info(log.M{"msg": "tunnel connected after retry", "group": g.Name, "addr": tunnel.Addr(), "host": host, "attempt": i})
+			}
+			return conn, tunnel, nil
+		}
+		tunnel.Failure(err)
+		countIfTimeout(err, _TIMEOUT_DIAL)
+		DefaultStats.Incr("tunnel_dial_failures_total", "tunnel", tunnel.Addr())
+		logger.Error(log.M{"msg": "connect tunnel failed", "group": g.Name, "addr": tunnel.Addr(), "host": host, "attempt": i, "cost": time.Since(start).String(), "err": err.Error()})
+	}
+	return nil, nil, err
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cosiner/gohper/testing2"
+	"github.com/cosiner/tunnel/proxy"
+	log "github.com/cosiner/ygo/jsonlog"
+)
+
+func TestTunnelGroupDialRetry(t *testing.T) {
+	bad, good := newFakeTunnel(t), newFakeTunnel(t)
+	defer bad.ln.Close()
+	defer good.ln.Close()
+	bad.fail(true)
+	breaker := Breaker{Failures: 2, Backoff: time.Minute, MaxBackoff: time.Minute}
+	nodes := []*TunnelNode{NewTunnelNode(bad, 1, breaker), NewTunnelNode(good, 1, breaker)}
+	// unmeasured tunnels have equal latency, the first is always selected
+	g, err := NewTunnelGroup("test", SELECT_LATENCY, nodes, false)
+	testing2.True(t, err == nil)
+	addr, _ := proxy.NewRawAddr(proxy.ADDR_IPV4, net.IPv4(127, 0, 0, 1).To4(), 80)
+	logger := log.Derive("Test", "retry")
+
+	g.Retry = Retry{Attempts: 1}
+	_, tunnel, err := g.Dial(addr, nil, "a.com", logger)
+	testing2.True(t, err == errFakeTunnel && tunnel == nil)
+
+	// next attempt selects a tunnel not tried
+	g.Retry = Retry{Attempts: 2}
+	c, tunnel, err := g.Dial(addr, nil, "a.com", logger)
+	testing2.True(t, err == nil && tunnel == nodes[1])
+	c.Close()
+
+	// failed tunnel is no longer selected once its circuit is open
+	state, _, _ := nodes[0].State()
+	testing2.True(t, state == CIRCUIT_OPEN)
+	clients := atomic.LoadInt32(&bad.clients)
+	c, tunnel, err = g.Dial(addr, nil, "a.com", logger)
+	testing2.True(t, err == nil && tunnel == nodes[1])
+	c.Close()
+	testing2.True(t, atomic.LoadInt32(&bad.clients) == clients)
+
+	// each tunnel is tried at most once
+	good.fail(true)
+	g.Retry = Retry{Attempts: 5}
+	clients = atomic.LoadInt32(&good.clients)
+	_, _, err = g.Dial(addr, nil, "a.com", logger)
+	testing2.True(t, err == errFakeTunnel)
+	testing2.True(t, atomic.LoadInt32(&good.clients) == clients+1)
+}
+
+func TestTunnelGroupDialDeadline(t *testing.T) {
+	slow, other := newFakeTunnel(t), newFakeTunnel(t)
+	defer slow.ln.Close()
+	defer other.ln.Close()
+	slow.fail(true)
+	slow.delay = 50 * time.Millisecond
+	nodes := []*TunnelNode{NewTunnelNode(slow, 1, DefaultBreaker), NewTunnelNode(other, 1, DefaultBreaker)}
+	g, _ := NewTunnelGroup("test", SELECT_LATENCY, nodes, false)
+	g.Retry = Retry{Attempts: 2, Deadline: 30 * time.Millisecond}
+	addr, _ := proxy.NewRawAddr(proxy.ADDR_IPV4, net.IPv4(127, 0, 0, 1).To4(), 80)
+
+	_, _, err := g.Dial(addr, nil, "a.com", log.Derive("Test", "deadline"))
+	testing2.True(t, err == errDialDeadline)
+	testing2.True(t, atomic.LoadInt32(&other.clients) == 0)
+}
+
+func TestTunnelGroupDirect(t *testing.T) {
+	f := newFakeTunnel(t)
+	defer f.ln.Close()
+	n := NewTunnelNode(f, 1, Breaker{Failures: 1, Backoff: time.Minute, MaxBackoff: time.Minute})
+	n.Failure(errFakeTunnel)
+
+	// unavailable tunnels are still used unless direct connection is allowed
+	g, _ := NewTunnelGroup("test", SELECT_RANDOM, []*TunnelNode{n}, false)
+	testing2.True(t, g.Select("a.com", nil) == n)
+	g, _ = NewTunnelGroup("test", SELECT_RANDOM, []*TunnelNode{n}, true)
+	testing2.True(t, g.Select("a.com", nil) == nil)
+	_, _, err := g.Dial(proxy.Addr{}, nil, "a.com", log.Derive("Test", "direct"))
+	testing2.True(t, err == ErrNoTunnel)
+}
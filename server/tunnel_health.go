@@ -0,0 +1,130 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/cosiner/tunnel/proxy"
+	log "github.com/cosiner/ygo/jsonlog"
+)
+
+// HealthChecker probes tunnel nodes periodically. Each probe connects to the
+// tunnel server, and if Target is set, also completes a tunnel handshake and a
+// HTTP HEAD request to Target through the tunnel. Nodes whose circuit is open
+// are not probed until backoff passed, a node is not probed again while its
+// last probe is in flight.
+type HealthChecker struct {
+	Nodes    []*TunnelNode
+	Interval time.Duration
+	Timeout  time.Duration
+	Target   string // host:port of a http server, empty to check tcp connect only
+
+	mu       sync.Mutex
+	checking map[*TunnelNode]bool
+
+	log *log.Logger
+}
+
+func NewHealthChecker(nodes []*TunnelNode, interval, timeout time.Duration, target string) *HealthChecker {
+	return &HealthChecker{
+		Nodes:    nodes,
+		Interval: interval,
+		Timeout:  timeout,
+		Target:   target,
+		checking: make(map[*TunnelNode]bool),
+		log:      log.Derive("HealthCheck", target),
+	}
+}
+
+func (h *HealthChecker) Run(sig Signal) {
+	go func() {
+		ticker := time.NewTicker(h.Interval)
+		defer ticker.Stop()
+
+		for {
+			h.checkAll()
+			select {
+			case <-sig:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// checkAll probes nodes available, an open circuit past backoff moves to half
+// open and the probe takes its single attempt, so a failed probe opens it
+// again with doubled backoff.
+func (h *HealthChecker) checkAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, n := range h.Nodes {
+		if !h.checking[n] && n.Available() {
+			h.checking[n] = true
+			go h.check(n)
+		}
+	}
+}
+
+func (h *HealthChecker) check(n *TunnelNode) {
+	defer func() {
+		h.mu.Lock()
+		delete(h.checking, n)
+		h.mu.Unlock()
+	}()
+
+	start := time.Now()
+	err := h.probe(n)
+	if err != nil {
+		DefaultStats.Incr("tunnel_check_failures_total", "tunnel", n.Addr())
+		h.log.Warn(log.M{"msg": "tunnel check failed", "tunnel": n.Addr(), "err": err.Error()})
+		n.Failure(err)
+		return
+	}
+
+	cost := time.Since(start)
+	if h.log.IsDebugEnable() {
+		h.log.Debug(log.M{"msg": "tunnel check passed", "tunnel": n.Addr(), "cost": cost.String()})
+	}
+	if h.Target == "" {
+		n.Success(cost)
+	} else {
+		// the cost includes a http round trip, not comparable to handshakes
+		n.Success(0)
+	}
+}
+
+func (h *HealthChecker) probe(n *TunnelNode) error {
+	conn, err := n.Dial(h.Timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if h.Target == "" {
+		return nil
+	}
+
+	conn.SetDeadline(time.Now().Add(h.Timeout))
+	addr, err := proxy.ParseAddr(h.Target)
+	if err != nil {
+		return err
+	}
+	conn, err = n.Proxy.Client(conn, addr)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write([]byte("HEAD / HTTP/1.1\r\nHost: " + addr.HostString() + "\r\nConnection: close\r\n\r\n"))
+	if err != nil {
+		return err
+	}
+
+	var b [1]byte
+	_, err = io.ReadFull(conn, b[:])
+	if err == io.EOF {
+		return errors.New("connection closed by remote")
+	}
+	return err
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cosiner/gohper/testing2"
+)
+
+func TestHealthCheckerInFlight(t *testing.T) {
+	f := newFakeTunnel(t)
+	defer f.ln.Close()
+	f.fail(true)
+	f.delay = 50 * time.Millisecond
+	n := NewTunnelNode(f, 1, DefaultBreaker)
+	h := NewHealthChecker([]*TunnelNode{n}, time.Hour, time.Second, "127.0.0.1:80")
+
+	// node isn't probed again while its probe is in flight
+	h.checkAll()
+	h.checkAll()
+	time.Sleep(100 * time.Millisecond)
+	testing2.True(t, atomic.LoadInt32(&f.clients) == 1)
+	h.checkAll()
+	time.Sleep(100 * time.Millisecond)
+	testing2.True(t, atomic.LoadInt32(&f.clients) == 2)
+}
+
+func TestHealthCheckerOpenCircuit(t *testing.T) {
+	f := newFakeTunnel(t)
+	defer f.ln.Close()
+	f.fail(true)
+	f.delay = 30 * time.Millisecond
+	n := NewTunnelNode(f, 1, Breaker{Failures: 1, Backoff: 20 * time.Millisecond, MaxBackoff: time.Second})
+	h := NewHealthChecker([]*TunnelNode{n}, time.Hour, time.Second, "127.0.0.1:80")
+	n.Failure(errFakeTunnel)
+	backoff := func() time.Duration {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		return n.backoff
+	}
+
+	// open circuit isn't probed until backoff passed
+	h.checkAll()
+	time.Sleep(10 * time.Millisecond)
+	state, _, _ := n.State()
+	testing2.True(t, state == CIRCUIT_OPEN && atomic.LoadInt32(&f.clients) == 0)
+
+	// the probe takes the half open attempt, connections don't select it
+	time.Sleep(20 * time.Millisecond)
+	h.checkAll()
+	state, _, _ = n.State()
+	testing2.True(t, state == CIRCUIT_HALF_OPEN)
+	testing2.False(t, n.selectable())
+
+	// failed probe opens the circuit again with doubled backoff
+	time.Sleep(50 * time.Millisecond)
+	state, _, _ = n.State()
+	testing2.True(t, state == CIRCUIT_OPEN && backoff() == 40*time.Millisecond)
+
+	// passed probe closes it
+	h.Target = ""
+	time.Sleep(50 * time.Millisecond)
+	h.checkAll()
+	time.Sleep(50 * time.Millisecond)
+	state, _, _ = n.State()
+	testing2.True(t, state == CIRCUIT_CLOSED)
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cosiner/tunnel/mux"
+	"github.com/cosiner/tunnel/proxy"
+)
+
+// MuxPool carries connections to a tunnel server as streams of at most
+// Sessions long-lived mux sessions, a stream is opened on the session with
+// fewest streams, sessions are created on demand and dropped once closed.
+type MuxPool struct {
+	Tunnel   proxy.Proxy
+	Sessions int
+	Config   mux.Config
+	Dial     func(timeout time.Duration) (net.Conn, error)
+
+	mu       sync.Mutex
+	sessions []*mux.Session
+	dialing  int
+	dialed   chan struct{} // closed and renewed after each dial
+	closed   bool
+}
+
+func NewMuxPool(tunnel proxy.Proxy, dial func(time.Duration) (net.Conn, error), sessions int, config mux.Config) *MuxPool {
+	if sessions <= 0 {
+		sessions = 1
+	}
+	return &MuxPool{
+		Tunnel:   tunnel,
+		Sessions: sessions,
+		Config:   config,
+		Dial:     dial,
+		dialed:   make(chan struct{}),
+	}
+}
+
+// Open opens a stream to addr, early is sent with the address, timeout limits
+// creating new session, 0 means no timeout. dialed reports whether a new
+// session was created.
+func (p *MuxPool) Open(addr proxy.Addr, early []byte, timeout time.Duration) (c net.Conn, dialed bool, err error) {
+	sess, dialed, err := p.session(timeout)
+	if err != nil {
+		return nil, dialed, err
+	}
+	stream, err := sess.Open()
+	if err != nil {
+		return nil, dialed, err
+	}
+	raw := addr.ToRaw()
+	b := make([]byte, 0, len(raw)+len(early))
+	if _, err = stream.Write(append(append(b, raw...), early...)); err != nil {
+		stream.Close()
+		return nil, dialed, err
+	}
+	return stream, dialed, nil
+}
+
+// session returns the session with fewest streams, a new session is dialed
+// without holding the lock if there is room. Callers wait pending dials only
+// if there is no session at all.
+func (p *MuxPool) session(timeout time.Duration) (*mux.Session, bool, error) {
+	p.mu.Lock()
+	var best *mux.Session
+	for {
+		if p.closed {
+			p.mu.Unlock()
+			return nil, false, mux.ErrSessionClosed
+		}
+		best = p.best()
+		if best != nil && (best.NumStreams() == 0 || len(p.sessions)+p.dialing >= p.Sessions) {
+			p.mu.Unlock()
+			return best, false, nil
+		}
+		if best != nil || p.dialing < p.Sessions {
+			break
+		}
+		dialed := p.dialed
+		p.mu.Unlock()
+		<-dialed
+		p.mu.Lock()
+	}
+	p.dialing++
+	p.mu.Unlock()
+
+	sess, err := p.dialSession(timeout)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dialing--
+	close(p.dialed)
+	p.dialed = make(chan struct{})
+	if err == nil && p.closed {
+		sess.Close()
+		err = mux.ErrSessionClosed
+	}
+	if err != nil {
+		if best != nil && !best.IsClosed() {
+			return best, false, nil
+		}
+		return nil, true, err
+	}
+	p.sessions = append(p.sessions, sess)
+	DefaultStats.Incr("mux_sessions_total", "tunnel", p.Tunnel.Addr())
+	return sess, true, nil
+}
+
+// best drops closed sessions and returns the one with fewest streams.
+func (p *MuxPool) best() *mux.Session {
+	var (
+		live = p.sessions[:0]
+		best *mux.Session
+	)
+	for _, s := range p.sessions {
+		if s.IsClosed() {
+			continue
+		}
+		live = append(live, s)
+		if best == nil || s.NumStreams() < best.NumStreams() {
+			best = s
+		}
+	}
+	for i := len(live); i < len(p.sessions); i++ {
+		p.sessions[i] = nil
+	}
+	p.sessions = live
+	return best
+}
+
+func (p *MuxPool) dialSession(timeout time.Duration) (*mux.Session, error) {
+	conn, err := p.Dial(timeout)
+	if err != nil {
+		return nil, err
+	}
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	c, err := p.Tunnel.Client(conn, proxy.MuxAddr)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if timeout > 0 {
+		conn.SetDeadline(time.Time{})
+	}
+	return mux.Client(c, p.Config), nil
+}
+
+func (p *MuxPool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, s := range p.sessions {
+		s.Close()
+	}
+	p.sessions = nil
+	p.closed = true
+	return nil
+}
+
+// Retire closes sessions once their streams finished, or at latest when sig
+// closed, it's used when the tunnel is removed and no new stream is opened.
+func (p *MuxPool) Retire(sig Signal) {
+	p.mu.Lock()
+	sessions := p.sessions
+	p.sessions = nil
+	p.closed = true
+	p.mu.Unlock()
+	if len(sessions) == 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for len(sessions) > 0 {
+			select {
+			case <-sig:
+				for _, s := range sessions {
+					s.Close()
+				}
+				return
+			case <-ticker.C:
+			}
+			live := sessions[:0]
+			for _, s := range sessions {
+				if s.NumStreams() == 0 {
+					s.Close()
+				} else {
+					live = append(live, s)
+				}
+			}
+			sessions = live
+		}
+	}()
+}
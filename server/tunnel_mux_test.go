@@ -0,0 +1,65 @@
+package server
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cosiner/gohper/testing2"
+	"github.com/cosiner/tunnel/mux"
+	"github.com/cosiner/tunnel/proxy"
+)
+
+func TestMuxPoolDialOutsideLock(t *testing.T) {
+	tunnel, _ := proxy.NewTunnel("aes-128-cfb", "key", "tunnel")
+	slow := make(chan struct{})
+	var dials int32
+	pool := NewMuxPool(tunnel, func(time.Duration) (net.Conn, error) {
+		if atomic.AddInt32(&dials, 1) > 1 {
+			<-slow
+		}
+		c, s := net.Pipe()
+		go func() {
+			conn, _, err := tunnel.Server(s)
+			if err != nil {
+				return
+			}
+			sess := mux.Server(conn, mux.DefaultConfig)
+			for {
+				if _, err := sess.Accept(); err != nil {
+					return
+				}
+			}
+		}()
+		return c, nil
+	}, 2, mux.DefaultConfig)
+	defer pool.Close()
+	defer close(slow)
+
+	addr, _ := proxy.NewRawAddr(proxy.ADDR_IPV4, net.IPv4(127, 0, 0, 1).To4(), 80)
+	_, dialed, err := pool.Open(addr, nil, time.Second)
+	testing2.True(t, err == nil && dialed)
+
+	// the second session is being dialed slowly
+	go pool.Open(addr, nil, time.Second)
+	for atomic.LoadInt32(&dials) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	opened := make(chan error, 1)
+	go func() {
+		_, dialed, err := pool.Open(addr, nil, time.Second)
+		if err == nil && dialed {
+			err = mux.ErrBadFrame
+		}
+		opened <- err
+	}()
+	// it's not blocked by the pending dial
+	err = errDialDeadline
+	select {
+	case err = <-opened:
+	case <-time.After(time.Second):
+	}
+	testing2.True(t, err == nil)
+}
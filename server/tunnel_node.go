@@ -0,0 +1,257 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cosiner/tunnel/proxy"
+	"github.com/cosiner/tunnel/transport"
+	log "github.com/cosiner/ygo/jsonlog"
+)
+
+const (
+	CIRCUIT_CLOSED    = "closed"    // healthy
+	CIRCUIT_OPEN      = "open"      // unhealthy, not selected until backoff passed
+	CIRCUIT_HALF_OPEN = "half_open" // backoff passed, a single attempt is allowed
+)
+
+// Breaker configures the circuit breaker of tunnel nodes, circuit opens after
+// Failures consecutive failures and stays open for Backoff, the backoff is
+// doubled each time the half open attempt fails, up to MaxBackoff.
+type Breaker struct {
+	Failures   int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+var DefaultBreaker = Breaker{
+	Failures:   3,
+	Backoff:    10 * time.Second,
+	MaxBackoff: 10 * time.Minute,
+}
+
+// latency ewma smoothing factor, weight of the newest sample
+const _LATENCY_EWMA_ALPHA = 0.3
+
+// TunnelNode is a tunnel with health and load state shared by all users of
+// the tunnel.
+type TunnelNode struct {
+	Proxy     proxy.Proxy
+	Breaker   Breaker
+	Weight    int
+	Mux       *MuxPool  // nil if mux is disabled
+	Pool      *ConnPool // nil if pool is disabled
+	Transport *transport.Transport
+
+	active int64
+
+	mu        sync.Mutex
+	latency   float64 // ewma of handshake latency in nanoseconds
+	samples   int
+	state     string
+	failures  int
+	backoff   time.Duration
+	openUntil time.Time
+	probing   bool
+	lastErr   string
+
+	log *log.Logger
+}
+
+func NewTunnelNode(p proxy.Proxy, weight int, breaker Breaker) *TunnelNode {
+	if weight <= 0 {
+		weight = 1
+	}
+	n := &TunnelNode{
+		Proxy:   p,
+		Weight:  weight,
+		Breaker: breaker,
+		state:   CIRCUIT_CLOSED,
+		log:     log.Derive("Tunnel", p.Addr()),
+	}
+	DefaultStats.Set(1, "tunnel_healthy", "tunnel", p.Addr())
+	return n
+}
+
+func (n *TunnelNode) Addr() string {
+	return n.Proxy.Addr()
+}
+
+// Dial connect tunnel server by transport of the node.
+func (n *TunnelNode) Dial(timeout time.Duration) (net.Conn, error) {
+	return n.Transport.Dial(n.Addr(), timeout)
+}
+
+// Connect connect addr through the tunnel, early is sent with the request if
+// not empty, connecting tunnel server and the handshake complete in timeout, 0
+// means no timeout. dialed reports whether a new connection to tunnel server
+// was made, streams of mux sessions and pooled connections cost no round trip.
+func (n *TunnelNode) Connect(addr proxy.Addr, early []byte, timeout time.Duration) (c net.Conn, dialed bool, err error) {
+	if n.Mux != nil {
+		return n.Mux.Open(addr, early, timeout)
+	}
+	if n.Pool != nil {
+		if conn := n.Pool.Get(); conn != nil {
+			c, err = proxy.ClientEarly(n.Proxy, conn, addr, early)
+			if err == nil {
+				return c, false, nil
+			}
+			// pooled connection may be closed by server, dial a new one
+			conn.Close()
+		}
+	}
+	conn, err := n.Dial(timeout)
+	if err != nil {
+		return nil, true, err
+	}
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	c, err = proxy.ClientEarly(n.Proxy, conn, addr, early)
+	if err != nil {
+		conn.Close()
+		return nil, true, err
+	}
+	if timeout > 0 {
+		conn.SetDeadline(time.Time{})
+	}
+	return c, true, nil
+}
+
+// selectable reports whether the node can be selected without changing state.
+func (n *TunnelNode) selectable() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	switch n.state {
+	case CIRCUIT_CLOSED:
+		return true
+	case CIRCUIT_OPEN:
+		return !time.Now().Before(n.openUntil)
+	}
+	return !n.probing
+}
+
+// Active returns count of connections using the node.
+func (n *TunnelNode) Active() int64 {
+	return atomic.LoadInt64(&n.active)
+}
+
+func (n *TunnelNode) Acquire() {
+	atomic.AddInt64(&n.active, 1)
+}
+
+func (n *TunnelNode) Release() {
+	atomic.AddInt64(&n.active, -1)
+}
+
+// Latency returns the ewma of handshake latency, 0 if never measured.
+func (n *TunnelNode) Latency() time.Duration {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return time.Duration(n.latency)
+}
+
+func (n *TunnelNode) observeLatency(d time.Duration) {
+	n.mu.Lock()
+	if n.samples == 0 {
+		n.latency = float64(d)
+	} else {
+		n.latency = _LATENCY_EWMA_ALPHA*float64(d) + (1-_LATENCY_EWMA_ALPHA)*n.latency
+	}
+	n.samples++
+	n.mu.Unlock()
+}
+
+// Available reports whether the node can be selected, an open circuit becomes
+// half open after backoff and allows one attempt.
+func (n *TunnelNode) Available() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	switch n.state {
+	case CIRCUIT_CLOSED:
+		return true
+	case CIRCUIT_OPEN:
+		if time.Now().Before(n.openUntil) {
+			return false
+		}
+		n.setState(CIRCUIT_HALF_OPEN)
+		fallthrough
+	default:
+		if n.probing {
+			return false
+		}
+		n.probing = true
+		return true
+	}
+}
+
+func (n *TunnelNode) State() (state string, failures int, lastErr string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.state, n.failures, n.lastErr
+}
+
+func (n *TunnelNode) setState(state string) {
+	if n.state == state {
+		return
+	}
+	n.log.Info(log.M{"msg": "tunnel circuit state changed", "from": n.state, "to": state, "failures": n.failures, "backoff": n.backoff.String(), "err": n.lastErr})
+	n.state = state
+
+	var healthy int64
+	if state == CIRCUIT_CLOSED {
+		healthy = 1
+	}
+	DefaultStats.Set(healthy, "tunnel_healthy", "tunnel", n.Addr())
+	if state == CIRCUIT_OPEN {
+		DefaultStats.Incr("tunnel_circuit_open_total", "tunnel", n.Addr())
+	}
+}
+
+// Success record a successful handshake and it's latency, 0 if the handshake
+// didn't dial tunnel server.
+func (n *TunnelNode) Success(latency time.Duration) {
+	if latency > 0 {
+		n.observeLatency(latency)
+	}
+
+	n.mu.Lock()
+	n.failures = 0
+	n.backoff = 0
+	n.probing = false
+	n.setState(CIRCUIT_CLOSED)
+	n.mu.Unlock()
+}
+
+func (n *TunnelNode) Failure(err error) {
+	DefaultStats.Incr("tunnel_failures_total", "tunnel", n.Addr())
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.failures++
+	n.probing = false
+	if err != nil {
+		n.lastErr = err.Error()
+	}
+	switch n.state {
+	case CIRCUIT_CLOSED:
+		if n.failures < n.Breaker.Failures {
+			return
+		}
+		n.backoff = n.Breaker.Backoff
+	case CIRCUIT_HALF_OPEN:
+		n.backoff *= 2
+		if n.backoff > n.Breaker.MaxBackoff {
+			n.backoff = n.Breaker.MaxBackoff
+		}
+	default:
+		return
+	}
+	n.openUntil = time.Now().Add(n.backoff)
+	n.setState(CIRCUIT_OPEN)
+}
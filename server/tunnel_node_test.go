@@ -0,0 +1,129 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cosiner/gohper/testing2"
+	"github.com/cosiner/tunnel/proxy"
+)
+
+var errFakeTunnel = errors.New("fake tunnel failure")
+
+// fakeTunnel accepts tcp connections and fails handshakes while failing is set.
+type fakeTunnel struct {
+	ln      net.Listener
+	failing int32
+	clients int32
+	delay   time.Duration
+}
+
+func newFakeTunnel(t *testing.T) *fakeTunnel {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	testing2.True(t, err == nil)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+	return &fakeTunnel{ln: ln}
+}
+
+func (f *fakeTunnel) fail(fail bool) {
+	var v int32
+	if fail {
+		v = 1
+	}
+	atomic.StoreInt32(&f.failing, v)
+}
+
+func (f *fakeTunnel) Client(c net.Conn, addr proxy.Addr) (net.Conn, error) {
+	atomic.AddInt32(&f.clients, 1)
+	time.Sleep(f.delay)
+	if atomic.LoadInt32(&f.failing) != 0 {
+		return c, errFakeTunnel
+	}
+	return c, nil
+}
+
+func (f *fakeTunnel) Server(c net.Conn) (net.Conn, proxy.Addr, error) {
+	return c, proxy.Addr{}, errFakeTunnel
+}
+
+func (f *fakeTunnel) Addr() string {
+	return f.ln.Addr().String()
+}
+
+func TestTunnelNodeBreaker(t *testing.T) {
+	f := newFakeTunnel(t)
+	defer f.ln.Close()
+	n := NewTunnelNode(f, 1, Breaker{Failures: 2, Backoff: 40 * time.Millisecond, MaxBackoff: 100 * time.Millisecond})
+
+	// circuit opens after consecutive failures
+	n.Failure(errFakeTunnel)
+	state, failures, _ := n.State()
+	testing2.True(t, state == CIRCUIT_CLOSED && failures == 1 && n.Available())
+	n.Failure(errFakeTunnel)
+	state, _, lastErr := n.State()
+	testing2.True(t, state == CIRCUIT_OPEN && lastErr == errFakeTunnel.Error())
+	testing2.False(t, n.selectable())
+	testing2.False(t, n.Available())
+
+	// selectable doesn't move the circuit to half open, Available does and
+	// allows a single attempt
+	time.Sleep(50 * time.Millisecond)
+	testing2.True(t, n.selectable())
+	state, _, _ = n.State()
+	testing2.True(t, state == CIRCUIT_OPEN)
+	testing2.True(t, n.Available())
+	state, _, _ = n.State()
+	testing2.True(t, state == CIRCUIT_HALF_OPEN)
+	testing2.False(t, n.Available())
+	testing2.False(t, n.selectable())
+
+	// failed attempt doubles the backoff
+	n.Failure(errFakeTunnel)
+	state, _, _ = n.State()
+	testing2.True(t, state == CIRCUIT_OPEN)
+	time.Sleep(50 * time.Millisecond)
+	testing2.False(t, n.selectable())
+	time.Sleep(40 * time.Millisecond)
+	testing2.True(t, n.Available())
+
+	// up to max backoff
+	n.Failure(errFakeTunnel)
+	n.mu.Lock()
+	backoff := n.backoff
+	n.mu.Unlock()
+	testing2.True(t, backoff == 100*time.Millisecond)
+
+	// success closes the circuit and resets failures
+	n.Success(0)
+	state, failures, _ = n.State()
+	testing2.True(t, state == CIRCUIT_CLOSED && failures == 0 && n.Latency() == 0)
+	n.Failure(errFakeTunnel)
+	state, _, _ = n.State()
+	testing2.True(t, state == CIRCUIT_CLOSED)
+}
+
+func TestTunnelNodeConnect(t *testing.T) {
+	f := newFakeTunnel(t)
+	defer f.ln.Close()
+	n := NewTunnelNode(f, 1, DefaultBreaker)
+	addr, _ := proxy.NewRawAddr(proxy.ADDR_IPV4, net.IPv4(127, 0, 0, 1).To4(), 80)
+
+	c, dialed, err := n.Connect(addr, nil, time.Second)
+	testing2.True(t, err == nil && dialed)
+	c.Close()
+
+	f.fail(true)
+	_, dialed, err = n.Connect(addr, nil, time.Second)
+	testing2.True(t, err == errFakeTunnel && dialed)
+}
@@ -0,0 +1,336 @@
+package transport
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// galois field GF(2^8) with polynomial x^8+x^4+x^3+x^2+1
+var (
+	gfExp [510]byte
+	gfLog [256]int
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfExp[i+255] = byte(x)
+		gfLog[x] = i
+		if x <<= 1; x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[gfLog[a]+gfLog[b]]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-gfLog[a]]
+}
+
+// reedSolomon is a systematic erasure code, parity rows of the encoding matrix
+// is a cauchy matrix so that any data shards of all shards can recover data.
+type reedSolomon struct {
+	data, parity int
+	matrix       [][]byte // parity x data
+}
+
+func newReedSolomon(data, parity int) (*reedSolomon, error) {
+	if data <= 0 || parity <= 0 || data+parity > 256 {
+		return nil, errors.New("invalid count of fec shards")
+	}
+	r := &reedSolomon{
+		data:   data,
+		parity: parity,
+		matrix: make([][]byte, parity),
+	}
+	for i := range r.matrix {
+		r.matrix[i] = make([]byte, data)
+		for j := range r.matrix[i] {
+			r.matrix[i][j] = gfInv(byte(data+i) ^ byte(j))
+		}
+	}
+	return r, nil
+}
+
+func mulAdd(dst, src []byte, c byte) {
+	if c == 0 {
+		return
+	}
+	for i, b := range src {
+		dst[i] ^= gfMul(c, b)
+	}
+}
+
+// encode fills parity shards, all shards must be allocated with same length.
+func (r *reedSolomon) encode(shards [][]byte) {
+	for i, row := range r.matrix {
+		parity := shards[r.data+i]
+		for k := range parity {
+			parity[k] = 0
+		}
+		for j, c := range row {
+			mulAdd(parity, shards[j], c)
+		}
+	}
+}
+
+// reconstruct fills missing(nil) data shards, shards present must have same
+// length.
+func (r *reedSolomon) reconstruct(shards [][]byte) error {
+	var (
+		rows    = make([][]byte, 0, r.data)
+		present = make([][]byte, 0, r.data)
+		size    int
+	)
+	for i := 0; i < len(shards) && len(rows) < r.data; i++ {
+		if shards[i] == nil {
+			continue
+		}
+		size = len(shards[i])
+		if i < r.data {
+			row := make([]byte, r.data)
+			row[i] = 1
+			rows = append(rows, row)
+		} else {
+			rows = append(rows, append([]byte(nil), r.matrix[i-r.data]...))
+		}
+		present = append(present, shards[i])
+	}
+	if len(rows) < r.data {
+		return errors.New("too few shards to reconstruct")
+	}
+
+	inv, err := invertMatrix(rows)
+	if err != nil {
+		return err
+	}
+	for j := 0; j < r.data; j++ {
+		if shards[j] != nil {
+			continue
+		}
+		shard := make([]byte, size)
+		for k, c := range inv[j] {
+			mulAdd(shard, present[k], c)
+		}
+		shards[j] = shard
+	}
+	return nil
+}
+
+// invertMatrix inverts m in place by gauss-jordan elimination.
+func invertMatrix(m [][]byte) ([][]byte, error) {
+	n := len(m)
+	inv := make([][]byte, n)
+	for i := range inv {
+		inv[i] = make([]byte, n)
+		inv[i][i] = 1
+	}
+	for col := 0; col < n; col++ {
+		pivot := -1
+		for row := col; row < n; row++ {
+			if m[row][col] != 0 {
+				pivot = row
+				break
+			}
+		}
+		if pivot < 0 {
+			return nil, errors.New("singular matrix")
+		}
+		m[col], m[pivot] = m[pivot], m[col]
+		inv[col], inv[pivot] = inv[pivot], inv[col]
+
+		if c := m[col][col]; c != 1 {
+			c = gfInv(c)
+			for k := 0; k < n; k++ {
+				m[col][k] = gfMul(m[col][k], c)
+				inv[col][k] = gfMul(inv[col][k], c)
+			}
+		}
+		for row := 0; row < n; row++ {
+			if c := m[row][col]; row != col && c != 0 {
+				mulAdd(m[row], m[col], c)
+				mulAdd(inv[row], inv[col], c)
+			}
+		}
+	}
+	return inv, nil
+}
+
+// | SeqId 4 | Flag 1 | Shard |, data shard is | Size 2 | Packet |
+const (
+	_FEC_HEADER_LEN = 5
+	_FEC_DATA       = 0xf1
+	_FEC_PARITY     = 0xf2
+	_FEC_GROUPS     = 32 // groups kept for reconstruction
+)
+
+// fecEncoder appends parity shards after each data shards of a group.
+type fecEncoder struct {
+	rs     *reedSolomon
+	seq    uint32
+	shards [][]byte // data shards of current group without fec header
+}
+
+func newFECEncoder(rs *reedSolomon) *fecEncoder {
+	return &fecEncoder{rs: rs}
+}
+
+// encode returns packets to send for packet.
+func (e *fecEncoder) encode(packet []byte) [][]byte {
+	shard := make([]byte, 2+len(packet))
+	binary.BigEndian.PutUint16(shard, uint16(len(packet)))
+	copy(shard[2:], packet)
+	e.shards = append(e.shards, shard)
+
+	out := [][]byte{e.withHeader(_FEC_DATA, shard)}
+	if len(e.shards) < e.rs.data {
+		return out
+	}
+
+	var size int
+	for _, s := range e.shards {
+		if len(s) > size {
+			size = len(s)
+		}
+	}
+	shards := make([][]byte, e.rs.data+e.rs.parity)
+	for i := range shards {
+		shards[i] = make([]byte, size)
+		if i < e.rs.data {
+			copy(shards[i], e.shards[i])
+		}
+	}
+	e.rs.encode(shards)
+	for _, s := range shards[e.rs.data:] {
+		out = append(out, e.withHeader(_FEC_PARITY, s))
+	}
+	e.shards = e.shards[:0]
+	return out
+}
+
+func (e *fecEncoder) withHeader(flag byte, shard []byte) []byte {
+	b := make([]byte, _FEC_HEADER_LEN+len(shard))
+	binary.BigEndian.PutUint32(b, e.seq)
+	b[4] = flag
+	copy(b[_FEC_HEADER_LEN:], shard)
+	e.seq++
+	return b
+}
+
+type fecGroup struct {
+	shards    [][]byte
+	count     int
+	recovered bool
+}
+
+// fecDecoder returns data packets as soon as received, and packets recovered
+// once enough shards of a group received.
+type fecDecoder struct {
+	rs     *reedSolomon
+	groups map[uint32]*fecGroup
+	newest uint32
+}
+
+func newFECDecoder(rs *reedSolomon) *fecDecoder {
+	return &fecDecoder{
+		rs:     rs,
+		groups: make(map[uint32]*fecGroup),
+	}
+}
+
+func (d *fecDecoder) decode(b []byte) (packets [][]byte) {
+	if len(b) < _FEC_HEADER_LEN {
+		return nil
+	}
+	var (
+		seq   = binary.BigEndian.Uint32(b)
+		flag  = b[4]
+		shard = b[_FEC_HEADER_LEN:]
+		total = uint32(d.rs.data + d.rs.parity)
+		base  = seq - seq%total
+		index = int(seq - base)
+	)
+	if flag == _FEC_DATA {
+		if p := shardPacket(shard); p != nil {
+			packets = append(packets, p)
+		}
+	} else if flag != _FEC_PARITY || index < d.rs.data {
+		return nil
+	}
+
+	if base > d.newest {
+		d.newest = base
+		for gb := range d.groups {
+			if d.newest-gb > _FEC_GROUPS*total {
+				delete(d.groups, gb)
+			}
+		}
+	} else if d.newest-base > _FEC_GROUPS*total {
+		return packets
+	}
+	g := d.groups[base]
+	if g == nil {
+		g = &fecGroup{shards: make([][]byte, total)}
+		d.groups[base] = g
+	}
+	if g.recovered || g.shards[index] != nil {
+		return packets
+	}
+	g.shards[index] = append([]byte(nil), shard...)
+	g.count++
+	if g.count < d.rs.data {
+		return packets
+	}
+
+	g.recovered = true
+	var missing []int
+	for i := 0; i < d.rs.data; i++ {
+		if g.shards[i] == nil {
+			missing = append(missing, i)
+		}
+	}
+	if len(missing) == 0 {
+		return packets
+	}
+	// data shards are shorter than parity shards if not the longest
+	var size int
+	for _, s := range g.shards {
+		if len(s) > size {
+			size = len(s)
+		}
+	}
+	for i, s := range g.shards {
+		if s != nil && len(s) < size {
+			padded := make([]byte, size)
+			copy(padded, s)
+			g.shards[i] = padded
+		}
+	}
+	if d.rs.reconstruct(g.shards) != nil {
+		return packets
+	}
+	for _, i := range missing {
+		if p := shardPacket(g.shards[i]); p != nil {
+			packets = append(packets, p)
+		}
+	}
+	return packets
+}
+
+func shardPacket(shard []byte) []byte {
+	if len(shard) < 2 {
+		return nil
+	}
+	size := int(binary.BigEndian.Uint16(shard))
+	if size > len(shard)-2 {
+		return nil
+	}
+	return shard[2 : 2+size]
+}
@@ -0,0 +1,413 @@
+package transport
+
+import (
+	"encoding/binary"
+)
+
+// kcp is a reliable ordered protocol over unreliable packets, it trades
+// bandwidth for latency: no congestion control, retransmission timeout grows
+// by 1.5 instead of 2, and segments are resent once later segments are acked
+// twice.
+//
+// Segment: | Conv 4 | Cmd 1 | Wnd 2 | Ts 4 | Sn 4 | Una 4 | Len 2 | Data Len |
+const (
+	_KCP_PUSH = 1
+	_KCP_ACK  = 2
+	_KCP_FIN  = 3 // ordered like PUSH, reader gets EOF after data before it
+	_KCP_WASK = 4 // ask peer's window
+	_KCP_WINS = 5 // tell own window
+	_KCP_PING = 6 // keepalive
+
+	_KCP_OVERHEAD = 21
+
+	_KCP_RTO_MIN     = 30
+	_KCP_RTO_DEFAULT = 200
+	_KCP_RTO_MAX     = 60000
+	_KCP_FASTRESEND  = 2
+	_KCP_PROBE_INIT  = 1000
+	_KCP_PROBE_MAX   = 10000
+)
+
+type kcpSegment struct {
+	cmd  byte
+	sn   uint32
+	ts   uint32
+	data []byte
+
+	resendts uint32
+	rto      uint32
+	fastack  int
+	xmit     int
+}
+
+type kcpAck struct {
+	sn, ts uint32
+}
+
+type kcp struct {
+	conv     uint32
+	mtu      int
+	mss      int
+	interval uint32
+
+	sndWnd, rcvWnd, rmtWnd uint32
+	sndUna, sndNxt, rcvNxt uint32
+
+	srtt, rttvar, rto uint32
+
+	sndQueue []*kcpSegment
+	sndBuf   []*kcpSegment
+	rcvBuf   []*kcpSegment // sorted by sn
+	rcvQueue []*kcpSegment
+
+	acks               []kcpAck
+	askWnd, tellWnd    bool
+	probeWait, probeAt uint32
+	lastSend           uint32
+	eof                bool
+	deadLink           bool
+	output             func([]byte)
+	buf                []byte
+}
+
+func newKCP(conv uint32, mtu, sndWnd, rcvWnd int, interval uint32, output func([]byte)) *kcp {
+	return &kcp{
+		conv:     conv,
+		mtu:      mtu,
+		mss:      mtu - _KCP_OVERHEAD,
+		interval: interval,
+		sndWnd:   uint32(sndWnd),
+		rcvWnd:   uint32(rcvWnd),
+		rmtWnd:   uint32(rcvWnd),
+		rto:      _KCP_RTO_DEFAULT,
+		output:   output,
+		buf:      make([]byte, 0, mtu),
+	}
+}
+
+// waitSnd returns count of segments not acked.
+func (k *kcp) waitSnd() int {
+	return len(k.sndQueue) + len(k.sndBuf)
+}
+
+func (k *kcp) send(b []byte) {
+	for len(b) > 0 {
+		size := len(b)
+		if size > k.mss {
+			size = k.mss
+		}
+		k.sndQueue = append(k.sndQueue, &kcpSegment{cmd: _KCP_PUSH, data: append([]byte(nil), b[:size]...)})
+		b = b[size:]
+	}
+}
+
+func (k *kcp) sendFin() {
+	k.sndQueue = append(k.sndQueue, &kcpSegment{cmd: _KCP_FIN})
+}
+
+// recv reads ordered data, it returns 0 if no data, check k.eof for end of
+// stream.
+func (k *kcp) recv(b []byte) int {
+	full := uint32(len(k.rcvQueue)) >= k.rcvWnd
+
+	var n int
+	for len(k.rcvQueue) > 0 && n < len(b) {
+		seg := k.rcvQueue[0]
+		if seg.cmd == _KCP_FIN {
+			k.eof = true
+			k.rcvQueue = k.rcvQueue[1:]
+			break
+		}
+		c := copy(b[n:], seg.data)
+		n += c
+		if seg.data = seg.data[c:]; len(seg.data) == 0 {
+			k.rcvQueue = k.rcvQueue[1:]
+		}
+	}
+	k.moveRcv()
+	if full && uint32(len(k.rcvQueue)) < k.rcvWnd {
+		k.tellWnd = true
+	}
+	return n
+}
+
+// readable reports whether recv returns data or eof.
+func (k *kcp) readable() bool {
+	return len(k.rcvQueue) > 0 || k.eof
+}
+
+func (k *kcp) moveRcv() {
+	for len(k.rcvBuf) > 0 {
+		seg := k.rcvBuf[0]
+		if seg.sn != k.rcvNxt || uint32(len(k.rcvQueue)) >= k.rcvWnd {
+			break
+		}
+		k.rcvBuf = k.rcvBuf[1:]
+		k.rcvQueue = append(k.rcvQueue, seg)
+		k.rcvNxt++
+	}
+}
+
+func (k *kcp) wndUnused() uint16 {
+	if n := uint32(len(k.rcvQueue)); n < k.rcvWnd {
+		return uint16(k.rcvWnd - n)
+	}
+	return 0
+}
+
+func (k *kcp) updateRtt(rtt uint32) {
+	if k.srtt == 0 {
+		k.srtt = rtt
+		k.rttvar = rtt / 2
+	} else {
+		delta := int32(rtt - k.srtt)
+		if delta < 0 {
+			delta = -delta
+		}
+		k.rttvar = (3*k.rttvar + uint32(delta)) / 4
+		if k.srtt = (7*k.srtt + rtt) / 8; k.srtt < 1 {
+			k.srtt = 1
+		}
+	}
+	rto := k.srtt + max32(k.interval, 4*k.rttvar)
+	k.rto = min32(max32(rto, _KCP_RTO_MIN), _KCP_RTO_MAX)
+}
+
+func (k *kcp) parseUna(una uint32) {
+	i := 0
+	for ; i < len(k.sndBuf); i++ {
+		if int32(una-k.sndBuf[i].sn) <= 0 {
+			break
+		}
+	}
+	k.sndBuf = k.sndBuf[i:]
+	k.shrinkBuf()
+}
+
+func (k *kcp) shrinkBuf() {
+	if len(k.sndBuf) > 0 {
+		k.sndUna = k.sndBuf[0].sn
+	} else {
+		k.sndUna = k.sndNxt
+	}
+}
+
+func (k *kcp) parseAck(sn uint32) {
+	if int32(sn-k.sndUna) < 0 || int32(sn-k.sndNxt) >= 0 {
+		return
+	}
+	for i, seg := range k.sndBuf {
+		if seg.sn == sn {
+			k.sndBuf = append(k.sndBuf[:i], k.sndBuf[i+1:]...)
+			break
+		}
+		if int32(sn-seg.sn) < 0 {
+			break
+		}
+	}
+}
+
+func (k *kcp) parseFastack(sn uint32) {
+	for _, seg := range k.sndBuf {
+		if int32(sn-seg.sn) <= 0 {
+			break
+		}
+		seg.fastack++
+	}
+}
+
+func (k *kcp) insertRcv(seg *kcpSegment) {
+	if int32(seg.sn-(k.rcvNxt+k.rcvWnd)) >= 0 || int32(seg.sn-k.rcvNxt) < 0 {
+		return
+	}
+	i := len(k.rcvBuf)
+	for ; i > 0; i-- {
+		prev := k.rcvBuf[i-1]
+		if prev.sn == seg.sn {
+			return
+		}
+		if int32(seg.sn-prev.sn) > 0 {
+			break
+		}
+	}
+	k.rcvBuf = append(k.rcvBuf, nil)
+	copy(k.rcvBuf[i+1:], k.rcvBuf[i:])
+	k.rcvBuf[i] = seg
+	k.moveRcv()
+}
+
+// input parse a packet, it returns false if packet is malformed or not
+// belong to the conversation.
+func (k *kcp) input(b []byte, now uint32) bool {
+	var (
+		maxack  uint32
+		hasAck  bool
+		handled bool
+	)
+	for len(b) >= _KCP_OVERHEAD {
+		var (
+			conv   = binary.BigEndian.Uint32(b)
+			cmd    = b[4]
+			wnd    = binary.BigEndian.Uint16(b[5:])
+			ts     = binary.BigEndian.Uint32(b[7:])
+			sn     = binary.BigEndian.Uint32(b[11:])
+			una    = binary.BigEndian.Uint32(b[15:])
+			length = int(binary.BigEndian.Uint16(b[19:]))
+		)
+		if conv != k.conv || len(b) < _KCP_OVERHEAD+length {
+			return handled
+		}
+		data := b[_KCP_OVERHEAD : _KCP_OVERHEAD+length]
+		b = b[_KCP_OVERHEAD+length:]
+		handled = true
+
+		k.rmtWnd = uint32(wnd)
+		k.parseUna(una)
+		switch cmd {
+		case _KCP_ACK:
+			if int32(now-ts) >= 0 {
+				k.updateRtt(now - ts)
+			}
+			k.parseAck(sn)
+			k.shrinkBuf()
+			if !hasAck || int32(sn-maxack) > 0 {
+				maxack, hasAck = sn, true
+			}
+		case _KCP_PUSH, _KCP_FIN:
+			if int32(sn-(k.rcvNxt+k.rcvWnd)) < 0 {
+				k.acks = append(k.acks, kcpAck{sn: sn, ts: ts})
+				k.insertRcv(&kcpSegment{cmd: cmd, sn: sn, data: append([]byte(nil), data...)})
+			}
+		case _KCP_WASK:
+			k.tellWnd = true
+		case _KCP_WINS, _KCP_PING:
+		default:
+			return handled
+		}
+	}
+	if hasAck {
+		k.parseFastack(maxack)
+	}
+	return handled
+}
+
+func (k *kcp) writeSeg(cmd byte, sn, ts uint32, data []byte) {
+	if len(k.buf)+_KCP_OVERHEAD+len(data) > k.mtu {
+		k.flushBuf()
+	}
+	var h [_KCP_OVERHEAD]byte
+	binary.BigEndian.PutUint32(h[0:], k.conv)
+	h[4] = cmd
+	binary.BigEndian.PutUint16(h[5:], k.wndUnused())
+	binary.BigEndian.PutUint32(h[7:], ts)
+	binary.BigEndian.PutUint32(h[11:], sn)
+	binary.BigEndian.PutUint32(h[15:], k.rcvNxt)
+	binary.BigEndian.PutUint16(h[19:], uint16(len(data)))
+	k.buf = append(k.buf, h[:]...)
+	k.buf = append(k.buf, data...)
+}
+
+func (k *kcp) flushBuf() {
+	if len(k.buf) > 0 {
+		k.output(k.buf)
+		k.buf = make([]byte, 0, k.mtu)
+	}
+}
+
+// flushAcks sends pending acks immediately.
+func (k *kcp) flushAcks(now uint32) {
+	k.writeAcks()
+	if len(k.buf) > 0 {
+		k.lastSend = now
+	}
+	k.flushBuf()
+}
+
+func (k *kcp) writeAcks() {
+	for _, ack := range k.acks {
+		k.writeSeg(_KCP_ACK, ack.sn, ack.ts, nil)
+	}
+	k.acks = k.acks[:0]
+}
+
+// flush sends acks, window probes, new segments and retransmissions.
+func (k *kcp) flush(now uint32, keepalive bool) {
+	k.writeAcks()
+
+	if k.rmtWnd == 0 {
+		if k.probeWait == 0 {
+			k.probeWait = _KCP_PROBE_INIT
+			k.probeAt = now + k.probeWait
+		} else if int32(now-k.probeAt) >= 0 {
+			k.probeWait = min32(k.probeWait+k.probeWait/2, _KCP_PROBE_MAX)
+			k.probeAt = now + k.probeWait
+			k.askWnd = true
+		}
+	} else {
+		k.probeWait = 0
+	}
+	if k.askWnd {
+		k.writeSeg(_KCP_WASK, 0, now, nil)
+		k.askWnd = false
+	}
+	if k.tellWnd {
+		k.writeSeg(_KCP_WINS, 0, now, nil)
+		k.tellWnd = false
+	}
+
+	cwnd := min32(k.sndWnd, k.rmtWnd)
+	for len(k.sndQueue) > 0 && int32(k.sndNxt-(k.sndUna+cwnd)) < 0 {
+		seg := k.sndQueue[0]
+		k.sndQueue = k.sndQueue[1:]
+		seg.sn = k.sndNxt
+		k.sndNxt++
+		k.sndBuf = append(k.sndBuf, seg)
+	}
+
+	for _, seg := range k.sndBuf {
+		var send bool
+		switch {
+		case seg.xmit == 0:
+			send = true
+			seg.rto = k.rto
+		case int32(now-seg.resendts) >= 0:
+			send = true
+			seg.rto += seg.rto / 2
+		case seg.fastack >= _KCP_FASTRESEND:
+			send = true
+			seg.fastack = 0
+		}
+		if !send {
+			continue
+		}
+		seg.xmit++
+		seg.ts = now
+		seg.resendts = now + seg.rto
+		k.writeSeg(seg.cmd, seg.sn, seg.ts, seg.data)
+		if seg.xmit > 20 {
+			k.deadLink = true
+		}
+	}
+
+	if keepalive && len(k.buf) == 0 {
+		k.writeSeg(_KCP_PING, 0, now, nil)
+	}
+	if len(k.buf) > 0 {
+		k.lastSend = now
+	}
+	k.flushBuf()
+}
+
+func min32(a, b uint32) uint32 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max32(a, b uint32) uint32 {
+	if a > b {
+		return a
+	}
+	return b
+}
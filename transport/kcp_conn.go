@@ -0,0 +1,558 @@
+package transport
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// KCPConfig configures udp transport, zero fields use defaults.
+type KCPConfig struct {
+	SndWnd       int           // segments
+	RcvWnd       int           // segments
+	MTU          int           // bytes of udp payload
+	Interval     time.Duration // flush interval
+	DataShards   int           // 0 to disable fec
+	ParityShards int
+	Timeout      time.Duration // connection is broken if nothing received within
+}
+
+const (
+	_KCP_WND       = 256
+	_KCP_MTU       = 1350
+	_KCP_INTERVAL  = 20 * time.Millisecond
+	_KCP_TIMEOUT   = 30 * time.Second
+	_KCP_KEEPALIVE = 10 * time.Second
+	_KCP_LINGER    = 5 * time.Second
+	_KCP_MAX_PKT   = 65535
+
+	// connections of a source ip, since a forged packet creates a connection
+	// without any handshake
+	_KCP_SOURCE_CONNS = 64
+	_KCP_SOURCE_RATE  = 10 // new connections per second
+	_KCP_SOURCE_BURST = 20
+)
+
+var (
+	ErrKCPTimeout = errors.New("kcp: connection timeout")
+	errKCPClosed  = errors.New("kcp: use of closed network connection")
+)
+
+func (c KCPConfig) withDefaults() KCPConfig {
+	if c.SndWnd <= 0 {
+		c.SndWnd = _KCP_WND
+	}
+	if c.RcvWnd <= 0 {
+		c.RcvWnd = _KCP_WND
+	}
+	if c.MTU <= 0 {
+		c.MTU = _KCP_MTU
+	}
+	if c.Interval <= 0 {
+		c.Interval = _KCP_INTERVAL
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = _KCP_TIMEOUT
+	}
+	return c
+}
+
+func (c KCPConfig) fec() (*reedSolomon, error) {
+	if c.DataShards <= 0 {
+		return nil, nil
+	}
+	return newReedSolomon(c.DataShards, c.ParityShards)
+}
+
+var kcpEpoch = time.Now()
+
+func kcpNow() uint32 {
+	return uint32(time.Since(kcpEpoch) / time.Millisecond)
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "kcp: i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// kcpConn is a reliable connection over udp packets, packets are sent by write
+// and received packets are passed to input.
+type kcpConn struct {
+	config KCPConfig
+	local  net.Addr
+	remote net.Addr
+	write  func([]byte) error
+	onDone func()
+
+	mu        sync.Mutex
+	kcp       *kcp
+	enc       *fecEncoder
+	dec       *fecDecoder
+	lastRecv  time.Time
+	closing   bool
+	lingerEnd time.Time
+	err       error
+	rdeadline time.Time
+	wdeadline time.Time
+
+	readCh  chan struct{}
+	writeCh chan struct{}
+	done    chan struct{}
+}
+
+func newKCPConn(conv uint32, config KCPConfig, rs *reedSolomon, local, remote net.Addr, write func([]byte) error, onDone func()) *kcpConn {
+	c := &kcpConn{
+		config:   config,
+		local:    local,
+		remote:   remote,
+		write:    write,
+		onDone:   onDone,
+		lastRecv: time.Now(),
+		readCh:   make(chan struct{}, 1),
+		writeCh:  make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	mtu := config.MTU
+	if rs != nil {
+		c.enc = newFECEncoder(rs)
+		c.dec = newFECDecoder(rs)
+		mtu -= _FEC_HEADER_LEN + 2
+	}
+	c.kcp = newKCP(conv, mtu, config.SndWnd, config.RcvWnd, uint32(config.Interval/time.Millisecond), c.output)
+	go c.update()
+	return c
+}
+
+// output is called with c.mu held.
+func (c *kcpConn) output(b []byte) {
+	if c.enc == nil {
+		c.write(b)
+		return
+	}
+	for _, p := range c.enc.encode(b) {
+		c.write(p)
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (c *kcpConn) input(b []byte) {
+	c.mu.Lock()
+	var ok bool
+	if c.dec == nil {
+		ok = c.kcp.input(b, kcpNow())
+	} else {
+		for _, p := range c.dec.decode(b) {
+			if c.kcp.input(p, kcpNow()) {
+				ok = true
+			}
+		}
+	}
+	if ok {
+		c.lastRecv = time.Now()
+		c.kcp.flushAcks(kcpNow())
+	}
+	c.mu.Unlock()
+
+	if ok {
+		notify(c.readCh)
+		notify(c.writeCh)
+	}
+}
+
+func (c *kcpConn) update() {
+	ticker := time.NewTicker(c.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case now := <-ticker.C:
+			c.mu.Lock()
+			c.kcp.flush(kcpNow(), c.idle())
+			var err error
+			switch {
+			case c.kcp.deadLink || now.Sub(c.lastRecv) > c.config.Timeout:
+				err = ErrKCPTimeout
+			case c.closing && (c.kcp.waitSnd() == 0 || now.After(c.lingerEnd)):
+				err = errKCPClosed
+			}
+			c.mu.Unlock()
+			notify(c.writeCh)
+			if err != nil {
+				c.destroy(err)
+				return
+			}
+		}
+	}
+}
+
+// idle reports whether nothing was sent for keepalive interval.
+func (c *kcpConn) idle() bool {
+	return kcpNow()-c.kcp.lastSend > uint32(_KCP_KEEPALIVE/time.Millisecond)
+}
+
+func (c *kcpConn) destroy(err error) {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return
+	}
+	c.err = err
+	close(c.done)
+	c.mu.Unlock()
+	if c.onDone != nil {
+		c.onDone()
+	}
+}
+
+// wait blocks until ch notified, deadline or connection destroyed.
+func (c *kcpConn) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return timeoutError{}
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-ch:
+		return nil
+	case <-c.done:
+		return nil
+	case <-timeout:
+		return timeoutError{}
+	}
+}
+
+func (c *kcpConn) Read(b []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		if c.closing {
+			c.mu.Unlock()
+			return 0, errKCPClosed
+		}
+		if c.kcp.readable() {
+			n := c.kcp.recv(b)
+			eof := c.kcp.eof
+			c.mu.Unlock()
+			if n == 0 && eof {
+				return 0, io.EOF
+			}
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		err, deadline := c.err, c.rdeadline
+		c.mu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+		if err = c.wait(c.readCh, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (c *kcpConn) Write(b []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		if c.closing {
+			c.mu.Unlock()
+			return 0, errKCPClosed
+		}
+		if c.err != nil {
+			err := c.err
+			c.mu.Unlock()
+			return 0, err
+		}
+		if c.kcp.waitSnd() < 2*c.config.SndWnd {
+			c.kcp.send(b)
+			c.kcp.flush(kcpNow(), false)
+			c.mu.Unlock()
+			return len(b), nil
+		}
+		deadline := c.wdeadline
+		c.mu.Unlock()
+		if err := c.wait(c.writeCh, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Close sends end of stream to peer and returns immediately, the connection
+// lingers until all sent data acknowledged.
+func (c *kcpConn) Close() error {
+	c.mu.Lock()
+	if c.closing || c.err != nil {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closing = true
+	c.lingerEnd = time.Now().Add(_KCP_LINGER)
+	c.kcp.sendFin()
+	c.kcp.flush(kcpNow(), false)
+	c.mu.Unlock()
+
+	notify(c.readCh)
+	notify(c.writeCh)
+	return nil
+}
+
+func (c *kcpConn) LocalAddr() net.Addr  { return c.local }
+func (c *kcpConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *kcpConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *kcpConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.rdeadline = t
+	c.mu.Unlock()
+	notify(c.readCh)
+	return nil
+}
+
+func (c *kcpConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.wdeadline = t
+	c.mu.Unlock()
+	notify(c.writeCh)
+	return nil
+}
+
+// dialKCP connects addr over a dedicated udp socket, timeout limits resolving
+// addr since kcp has no handshake, 0 means no timeout.
+func dialKCP(addr string, config KCPConfig, timeout time.Duration) (net.Conn, error) {
+	config = config.withDefaults()
+	rs, err := config.fec()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := (&net.Dialer{Timeout: timeout}).Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	udp := conn.(*net.UDPConn)
+	raddr := udp.RemoteAddr()
+	var b [4]byte
+	if _, err = rand.Read(b[:]); err != nil {
+		udp.Close()
+		return nil, err
+	}
+	write := func(p []byte) error {
+		_, err := udp.Write(p)
+		return err
+	}
+	c := newKCPConn(binary.BigEndian.Uint32(b[:]), config, rs, udp.LocalAddr(), raddr, write, func() {
+		udp.Close()
+	})
+	go func() {
+		buf := make([]byte, _KCP_MAX_PKT)
+		for {
+			n, err := udp.Read(buf)
+			if err != nil {
+				c.destroy(err)
+				return
+			}
+			c.input(append([]byte(nil), buf[:n]...))
+		}
+	}()
+	return c, nil
+}
+
+// kcpListener accepts kcp connections on a udp socket, peers are identified
+// by address.
+type kcpListener struct {
+	udp    *net.UDPConn
+	config KCPConfig
+	rs     *reedSolomon
+
+	mu      sync.Mutex
+	conns   map[string]*kcpConn
+	sources map[string]*kcpSource
+
+	accept chan net.Conn
+	done   chan struct{}
+	err    error
+	closed sync.Once
+}
+
+func listenKCP(addr string, config KCPConfig) (net.Listener, error) {
+	config = config.withDefaults()
+	rs, err := config.fec()
+	if err != nil {
+		return nil, err
+	}
+	laddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	udp, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	l := &kcpListener{
+		udp:     udp,
+		config:  config,
+		rs:      rs,
+		conns:   make(map[string]*kcpConn),
+		sources: make(map[string]*kcpSource),
+		accept:  make(chan net.Conn, 128),
+		done:    make(chan struct{}),
+	}
+	go l.serve()
+	return l, nil
+}
+
+func (l *kcpListener) serve() {
+	buf := make([]byte, _KCP_MAX_PKT)
+	for {
+		n, raddr, err := l.udp.ReadFromUDP(buf)
+		if err != nil {
+			l.closeWithError(err)
+			return
+		}
+		p := append([]byte(nil), buf[:n]...)
+		key := raddr.String()
+
+		l.mu.Lock()
+		c := l.conns[key]
+		if c == nil {
+			conv, ok := l.dialPacket(p)
+			if !ok || !l.allow(raddr.IP) {
+				l.mu.Unlock()
+				continue
+			}
+			c = l.newConn(conv, raddr, key)
+			select {
+			case l.accept <- c:
+				l.conns[key] = c
+			default: // backlog full, peer will retry
+				l.mu.Unlock()
+				c.destroy(errKCPClosed)
+				continue
+			}
+		}
+		l.mu.Unlock()
+		c.input(p)
+	}
+}
+
+// kcpSource limits connections of a source ip by a token bucket of new
+// connections and count of connections.
+type kcpSource struct {
+	tokens float64
+	last   time.Time
+	conns  int
+}
+
+// allow reports whether ip can create a connection, it's counted until the
+// connection done. l.mu is held.
+func (l *kcpListener) allow(ip net.IP) bool {
+	now := time.Now()
+	if len(l.sources) >= 1024 {
+		for key, s := range l.sources {
+			if s.conns == 0 && now.Sub(s.last) >= _KCP_SOURCE_BURST*time.Second/_KCP_SOURCE_RATE {
+				delete(l.sources, key)
+			}
+		}
+	}
+
+	key := ip.String()
+	s := l.sources[key]
+	if s == nil {
+		s = &kcpSource{tokens: _KCP_SOURCE_BURST, last: now}
+		l.sources[key] = s
+	}
+	s.tokens += now.Sub(s.last).Seconds() * _KCP_SOURCE_RATE
+	if s.tokens > _KCP_SOURCE_BURST {
+		s.tokens = _KCP_SOURCE_BURST
+	}
+	s.last = now
+	if s.tokens < 1 || s.conns >= _KCP_SOURCE_CONNS {
+		return false
+	}
+	s.tokens--
+	s.conns++
+	return true
+}
+
+func (l *kcpListener) newConn(conv uint32, raddr *net.UDPAddr, key string) *kcpConn {
+	var c *kcpConn
+	write := func(p []byte) error {
+		_, err := l.udp.WriteToUDP(p, raddr)
+		return err
+	}
+	source := raddr.IP.String()
+	c = newKCPConn(conv, l.config, l.rs, l.udp.LocalAddr(), raddr, write, func() {
+		l.mu.Lock()
+		if l.conns[key] == c {
+			delete(l.conns, key)
+		}
+		if s := l.sources[source]; s != nil {
+			s.conns--
+		}
+		l.mu.Unlock()
+	})
+	return c
+}
+
+// dialPacket reports whether p starts a connection: the first segment sent by
+// client, stale packets of closed connections are dropped.
+func (l *kcpListener) dialPacket(p []byte) (uint32, bool) {
+	if l.rs != nil {
+		if len(p) < _FEC_HEADER_LEN || p[4] != _FEC_DATA {
+			return 0, false
+		}
+		if p = shardPacket(p[_FEC_HEADER_LEN:]); p == nil {
+			return 0, false
+		}
+	}
+	if len(p) < _KCP_OVERHEAD || p[4] != _KCP_PUSH || binary.BigEndian.Uint32(p[11:]) != 0 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(p), true
+}
+
+func (l *kcpListener) closeWithError(err error) {
+	l.closed.Do(func() {
+		l.err = err
+		close(l.done)
+	})
+}
+
+func (l *kcpListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+func (l *kcpListener) Close() error {
+	err := l.udp.Close()
+	l.closeWithError(errKCPClosed)
+	return err
+}
+
+func (l *kcpListener) Addr() net.Addr {
+	return l.udp.LocalAddr()
+}
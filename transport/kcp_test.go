@@ -0,0 +1,219 @@
+package transport
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cosiner/gohper/testing2"
+)
+
+func TestFEC(t *testing.T) {
+	rs, err := newReedSolomon(4, 2)
+	testing2.True(t, err == nil)
+	enc, dec := newFECEncoder(rs), newFECDecoder(rs)
+
+	var (
+		sent []string
+		got  = make(map[string]bool)
+	)
+	for i := 0; i < 8; i++ {
+		p := string(bytes.Repeat([]byte{byte('a' + i)}, i*10+1))
+		sent = append(sent, p)
+		for _, shard := range enc.encode([]byte(p)) {
+			// drop two data shards of each group
+			if seq := shard[3]; seq%6 == 1 || seq%6 == 2 {
+				continue
+			}
+			for _, r := range dec.decode(shard) {
+				got[string(r)] = true
+			}
+		}
+	}
+	for _, p := range sent {
+		testing2.True(t, got[p])
+	}
+}
+
+func TestKCP(t *testing.T) {
+	config := KCPConfig{Interval: 10 * time.Millisecond, DataShards: 4, ParityShards: 2}
+	server := &Transport{Type: TYPE_KCP, KCP: config}
+	ln, err := server.ListenPacket("127.0.0.1:0")
+	testing2.True(t, err == nil)
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	client := &Transport{Type: TYPE_KCP, KCP: config}
+	conn, err := client.Dial(ln.Addr().String(), time.Second)
+	testing2.True(t, err == nil)
+	defer conn.Close()
+
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+	go conn.Write(data)
+	echo := make([]byte, len(data))
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	_, err = io.ReadFull(conn, echo)
+	testing2.True(t, err == nil)
+	testing2.True(t, bytes.Equal(data, echo))
+}
+
+func TestKCPLossy(t *testing.T) {
+	var (
+		config = KCPConfig{Interval: 10 * time.Millisecond}.withDefaults()
+		addr   = &net.UDPAddr{}
+		a, b   *kcpConn
+	)
+	lossy := func(dst **kcpConn) func([]byte) error {
+		return func(p []byte) error {
+			if rand.Intn(5) != 0 {
+				p = append([]byte(nil), p...)
+				go (*dst).input(p)
+			}
+			return nil
+		}
+	}
+	a = newKCPConn(1, config, nil, addr, addr, lossy(&b), nil)
+	b = newKCPConn(1, config, nil, addr, addr, lossy(&a), nil)
+
+	data := make([]byte, 256<<10)
+	rand.Read(data)
+	go func() {
+		a.Write(data)
+		a.Close()
+	}()
+	b.SetReadDeadline(time.Now().Add(20 * time.Second))
+	got, err := io.ReadAll(b)
+	testing2.True(t, err == nil)
+	testing2.True(t, bytes.Equal(data, got))
+}
+
+func TestReedSolomonReconstruct(t *testing.T) {
+	const data, parity = 4, 3
+	rs, err := newReedSolomon(data, parity)
+	testing2.True(t, err == nil)
+
+	shards := make([][]byte, data+parity)
+	for i := range shards {
+		shards[i] = make([]byte, 32)
+		if i < data {
+			rand.Read(shards[i])
+		}
+	}
+	rs.encode(shards)
+
+	// every combination of at most parity lost shards is recovered
+	for mask := 0; mask < 1<<(data+parity); mask++ {
+		lost := 0
+		for i := 0; i < data+parity; i++ {
+			lost += mask >> i & 1
+		}
+		if lost > parity {
+			continue
+		}
+		got := make([][]byte, len(shards))
+		for i := range shards {
+			if mask>>i&1 == 0 {
+				got[i] = shards[i]
+			}
+		}
+		testing2.True(t, rs.reconstruct(got) == nil)
+		for i := 0; i < data; i++ {
+			testing2.True(t, bytes.Equal(got[i], shards[i]))
+		}
+	}
+
+	testing2.False(t, rs.reconstruct(make([][]byte, data+parity)) == nil)
+}
+
+// kcpPair connects two kcp connections by link, which delivers packets to
+// input of the other side.
+func kcpPair(config KCPConfig, link func(p []byte, input func([]byte))) (a, b *kcpConn) {
+	config = config.withDefaults()
+	rs, _ := config.fec()
+	addr := &net.UDPAddr{}
+	to := func(dst **kcpConn) func([]byte) error {
+		return func(p []byte) error {
+			link(append([]byte(nil), p...), func(p []byte) { (*dst).input(p) })
+			return nil
+		}
+	}
+	a = newKCPConn(1, config, rs, addr, addr, to(&b), nil)
+	b = newKCPConn(1, config, rs, addr, addr, to(&a), nil)
+	return a, b
+}
+
+func testKCPTransfer(t *testing.T, a, b *kcpConn, size int) {
+	data := make([]byte, size)
+	rand.Read(data)
+	go func() {
+		a.Write(data)
+		a.Close()
+	}()
+	b.SetReadDeadline(time.Now().Add(20 * time.Second))
+	got, err := io.ReadAll(b)
+	testing2.True(t, err == nil)
+	testing2.True(t, bytes.Equal(data, got))
+	b.Close()
+}
+
+func TestKCPReorderDuplicate(t *testing.T) {
+	a, b := kcpPair(KCPConfig{Interval: 10 * time.Millisecond}, func(p []byte, input func([]byte)) {
+		delay := time.Duration(rand.Intn(30)) * time.Millisecond
+		time.AfterFunc(delay, func() { input(p) })
+		if rand.Intn(10) == 0 {
+			time.AfterFunc(2*delay, func() { input(p) })
+		}
+	})
+	testKCPTransfer(t, a, b, 256<<10)
+}
+
+func TestKCPLossyFEC(t *testing.T) {
+	var lost int64
+	config := KCPConfig{Interval: 10 * time.Millisecond, DataShards: 4, ParityShards: 2}
+	a, b := kcpPair(config, func(p []byte, input func([]byte)) {
+		if rand.Intn(10) == 0 {
+			atomic.AddInt64(&lost, 1)
+			return
+		}
+		go input(p)
+	})
+	testKCPTransfer(t, a, b, 256<<10)
+	testing2.True(t, atomic.LoadInt64(&lost) > 0)
+}
+
+func TestKCPSourceLimit(t *testing.T) {
+	l := &kcpListener{sources: make(map[string]*kcpSource)}
+	ip, other := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := 0; i < _KCP_SOURCE_BURST; i++ {
+		testing2.True(t, l.allow(ip))
+	}
+	testing2.False(t, l.allow(ip))
+	testing2.True(t, l.allow(other))
+
+	// tokens refill over time, count of connections is still limited
+	l.sources[ip.String()].last = time.Now().Add(-time.Hour)
+	l.sources[ip.String()].conns = _KCP_SOURCE_CONNS
+	testing2.False(t, l.allow(ip))
+	l.sources[ip.String()].conns--
+	testing2.True(t, l.allow(ip))
+}
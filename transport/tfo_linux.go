@@ -0,0 +1,60 @@
+package transport
+
+import (
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/cosiner/ygo/jsonlog"
+)
+
+const (
+	_TCP_FASTOPEN         = 23
+	_TCP_FASTOPEN_CONNECT = 30 // linux 4.11+, data of first write is sent with SYN
+	_TFO_QUEUE_LEN        = 256
+)
+
+var tfoUnsupported sync.Once
+
+// DialTCP connect addr, with fastOpen data of the first write is sent in SYN
+// if both sides support it, it falls back to normal handshake if the kernel
+// doesn't support it, which is logged once.
+func DialTCP(addr string, timeout time.Duration, fastOpen bool) (net.Conn, error) {
+	d := net.Dialer{Timeout: timeout}
+	if fastOpen {
+		d.Control = func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, _TCP_FASTOPEN_CONNECT, 1)
+			})
+			if err == nil && serr != nil {
+				tfoUnsupported.Do(func() {
+					log.Warn(log.M{"msg": "tcp fast open unavailable, dial normally", "err": serr.Error()})
+				})
+			}
+			return err
+		}
+	}
+	return d.Dial("tcp", addr)
+}
+
+// enableFastOpen accepts data in SYN on the listener.
+func enableFastOpen(ln net.Listener) error {
+	l, ok := ln.(*net.TCPListener)
+	if !ok {
+		return nil
+	}
+	raw, err := l.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, _TCP_FASTOPEN, _TFO_QUEUE_LEN)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package transport
+
+import (
+	"net"
+	"time"
+)
+
+// DialTCP connect addr, fastOpen is ignored on this platform.
+func DialTCP(addr string, timeout time.Duration, fastOpen bool) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr, timeout)
+}
+
+func enableFastOpen(ln net.Listener) error {
+	return nil
+}
@@ -0,0 +1,183 @@
+package transport
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	log "github.com/cosiner/ygo/jsonlog"
+)
+
+// transport types
+const (
+	TYPE_TCP = "tcp"
+	TYPE_WS  = "ws"  // websocket
+	TYPE_WSS = "wss" // websocket over tls
+	TYPE_KCP = "kcp" // reliable udp
+)
+
+// Transport carries tunnel connections, a nil Transport is plain tcp.
+type Transport struct {
+	Type     string
+	Path     string      // websocket path, also works as a secret since other paths are rejected
+	Host     string      // Host header and tls server name, host of address if empty
+	Connect  *url.URL    // http proxy to connect through by CONNECT, nil to connect directly
+	TLS      *tls.Config // client config for wss, or server config with certificates
+	KCP      KCPConfig
+	FastOpen bool // tcp fast open on linux
+}
+
+func IsValidType(typ string) bool {
+	switch typ {
+	case TYPE_TCP, TYPE_WS, TYPE_WSS, TYPE_KCP:
+		return true
+	}
+	return false
+}
+
+// Dial connect addr, timeout limits connecting and handshakes, 0 means no
+// timeout.
+func (t *Transport) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	if t == nil {
+		return net.DialTimeout("tcp", addr, timeout)
+	}
+	if t.Type == TYPE_KCP {
+		return dialKCP(addr, t.KCP, timeout)
+	}
+
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	conn, err := t.dial(addr, timeout, deadline)
+	if err == nil && timeout > 0 {
+		conn.SetDeadline(time.Time{})
+	}
+	return conn, err
+}
+
+func (t *Transport) dial(addr string, timeout time.Duration, deadline time.Time) (net.Conn, error) {
+	var (
+		conn net.Conn
+		err  error
+	)
+	if t.Connect != nil {
+		conn, err = dialConnect(t.Connect, addr, timeout, deadline)
+	} else {
+		conn, err = DialTCP(addr, timeout, t.FastOpen)
+	}
+	if err != nil || t.Type == "" || t.Type == TYPE_TCP {
+		return conn, err
+	}
+	conn.SetDeadline(deadline)
+
+	host := t.Host
+	if host == "" {
+		if host, _, err = net.SplitHostPort(addr); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if t.Type == TYPE_WSS {
+		config := &tls.Config{}
+		if t.TLS != nil {
+			config = t.TLS.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName = host
+		}
+		tconn := tls.Client(conn, config)
+		if err = tconn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tconn
+	}
+
+	ws, err := clientHandshake(conn, host, t.Path)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ws, nil
+}
+
+// IsPacket reports whether the transport listens on udp instead of tcp.
+func (t *Transport) IsPacket() bool {
+	return t != nil && t.Type == TYPE_KCP
+}
+
+// ListenPacket listens addr for packet transports.
+func (t *Transport) ListenPacket(addr string) (net.Listener, error) {
+	return listenKCP(addr, t.KCP)
+}
+
+// Listen wraps ln to accept connections of the transport, failure of enabling
+// tcp fast open is logged and the listener works without it.
+func (t *Transport) Listen(ln net.Listener) net.Listener {
+	if t == nil {
+		return ln
+	}
+	if t.FastOpen {
+		if err := enableFastOpen(ln); err != nil {
+			log.Warn(log.M{"msg": "tcp fast open unavailable on listener", "addr": ln.Addr().String(), "err": err.Error()})
+		}
+	}
+	if t.Type == "" || t.Type == TYPE_TCP {
+		return ln
+	}
+	if t.Type == TYPE_WSS && t.TLS != nil {
+		ln = tls.NewListener(ln, t.TLS)
+	}
+	return newWebSocketListener(ln, t.Path)
+}
+
+// dialConnect connect addr through http proxy by CONNECT method.
+func dialConnect(proxy *url.URL, addr string, timeout time.Duration, deadline time.Time) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", proxy.Host, timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(deadline)
+
+	req := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if u := proxy.User; u != nil {
+		pass, _ := u.Password()
+		req += "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(u.Username()+":"+pass)) + "\r\n"
+	}
+	if _, err = conn.Write([]byte(req + "\r\n")); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: "CONNECT"})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// body of CONNECT response is the tunnel, don't close it
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, errors.New("http proxy connect failed: " + resp.Status)
+	}
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a connection whose beginning was read into buffer.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
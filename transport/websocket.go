@@ -0,0 +1,358 @@
+package transport
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// websocket opcodes
+const (
+	_WS_CONTINUATION byte = 0x0
+	_WS_TEXT         byte = 0x1
+	_WS_BINARY       byte = 0x2
+	_WS_CLOSE        byte = 0x8
+	_WS_PING         byte = 0x9
+	_WS_PONG         byte = 0xa
+
+	_WS_FIN  byte = 0x80
+	_WS_MASK byte = 0x80
+
+	_WS_GUID              = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	_WS_HANDSHAKE_TIMEOUT = 10 * time.Second
+	_WS_MAX_CONTROL_LEN   = 125
+)
+
+var (
+	ErrBadHandshake = errors.New("websocket: bad handshake")
+	ErrBadFrame     = errors.New("websocket: malformed frame")
+)
+
+func acceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + _WS_GUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func clientHandshake(conn net.Conn, host, path string) (net.Conn, error) {
+	if path == "" {
+		path = "/"
+	}
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+
+	req := "GET " + path + " HTTP/1.1\r\n" +
+		"Host: " + host + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"
+	if _, err := conn.Write([]byte(req)); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: "GET"})
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		!strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") ||
+		resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		return nil, errors.New("websocket: bad handshake: " + resp.Status)
+	}
+	return newWebSocketConn(conn, br, true), nil
+}
+
+func serverHandshake(conn net.Conn, path string) (net.Conn, error) {
+	if path == "" {
+		path = "/"
+	}
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return nil, err
+	}
+
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if req.Method != "GET" || req.URL.Path != path || key == "" ||
+		!strings.EqualFold(req.Header.Get("Upgrade"), "websocket") ||
+		req.Header.Get("Sec-WebSocket-Version") != "13" {
+		// look like an ordinary web server for wrong paths
+		conn.Write([]byte("HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"))
+		return nil, ErrBadHandshake
+	}
+
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n"
+	if _, err = conn.Write([]byte(resp)); err != nil {
+		return nil, err
+	}
+	return newWebSocketConn(conn, br, false), nil
+}
+
+// webSocketConn transfers bytes as binary messages, frames written by client
+// are masked as required.
+type webSocketConn struct {
+	net.Conn
+	r      *bufio.Reader
+	client bool
+
+	remaining int64 // unread bytes of current data frame
+	masked    bool
+	mask      [4]byte
+	maskPos   int
+
+	wmu       sync.Mutex
+	closeOnce sync.Once
+}
+
+func newWebSocketConn(conn net.Conn, r *bufio.Reader, client bool) *webSocketConn {
+	return &webSocketConn{
+		Conn:   conn,
+		r:      r,
+		client: client,
+	}
+}
+
+func (c *webSocketConn) Read(b []byte) (int, error) {
+	for c.remaining == 0 {
+		opcode, length, size, err := c.peekHeader()
+		if err != nil {
+			return 0, err
+		}
+		switch opcode {
+		case _WS_CONTINUATION, _WS_TEXT, _WS_BINARY:
+			c.r.Discard(size)
+			c.remaining = length
+		case _WS_PING, _WS_PONG, _WS_CLOSE:
+			if length > _WS_MAX_CONTROL_LEN {
+				return 0, ErrBadFrame
+			}
+			frame, err := c.r.Peek(size + int(length))
+			if err != nil {
+				return 0, err
+			}
+			payload := append([]byte(nil), frame[size:]...)
+			c.r.Discard(len(frame))
+			c.unmask(payload)
+			switch opcode {
+			case _WS_PING:
+				if err = c.writeFrame(_WS_PONG, payload); err != nil {
+					return 0, err
+				}
+			case _WS_CLOSE:
+				c.closeOnce.Do(func() {
+					c.writeFrame(_WS_CLOSE, payload)
+				})
+				return 0, io.EOF
+			}
+		default:
+			return 0, ErrBadFrame
+		}
+	}
+
+	if int64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.r.Read(b)
+	c.unmask(b[:n])
+	c.remaining -= int64(n)
+	return n, err
+}
+
+// peekHeader parses frame header of size bytes without consuming it, so a
+// read deadline expired in the middle of header loses nothing.
+func (c *webSocketConn) peekHeader() (opcode byte, length int64, size int, err error) {
+	head, err := c.r.Peek(2)
+	if err != nil {
+		return
+	}
+	size = 2
+	switch head[1] &^ _WS_MASK {
+	case 126:
+		size += 2
+	case 127:
+		size += 8
+	}
+	if head[1]&_WS_MASK != 0 {
+		size += 4
+	}
+	if head, err = c.r.Peek(size); err != nil {
+		return
+	}
+
+	opcode = head[0] & 0x0f
+	c.masked = head[1]&_WS_MASK != 0
+	ext := head[2:]
+	switch length = int64(head[1] &^ _WS_MASK); length {
+	case 126:
+		length = int64(binary.BigEndian.Uint16(ext))
+		ext = ext[2:]
+	case 127:
+		if length = int64(binary.BigEndian.Uint64(ext)); length < 0 {
+			err = ErrBadFrame
+			return
+		}
+		ext = ext[8:]
+	}
+	if c.masked {
+		copy(c.mask[:], ext)
+	}
+	c.maskPos = 0
+	return
+}
+
+func (c *webSocketConn) unmask(b []byte) {
+	if !c.masked {
+		return
+	}
+	for i := range b {
+		b[i] ^= c.mask[c.maskPos&3]
+		c.maskPos++
+	}
+}
+
+func (c *webSocketConn) Write(b []byte) (int, error) {
+	if err := c.writeFrame(_WS_BINARY, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *webSocketConn) writeFrame(opcode byte, payload []byte) error {
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, _WS_FIN|opcode)
+
+	var maskBit byte
+	if c.client {
+		maskBit = _WS_MASK
+	}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, maskBit|byte(n))
+	case n <= 0xffff:
+		frame = append(frame, maskBit|126, byte(n>>8), byte(n))
+	default:
+		var l [8]byte
+		binary.BigEndian.PutUint64(l[:], uint64(n))
+		frame = append(frame, maskBit|127)
+		frame = append(frame, l[:]...)
+	}
+
+	start := len(frame)
+	if c.client {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		frame = append(frame, mask[:]...)
+		start += 4
+		frame = append(frame, payload...)
+		for i := range frame[start:] {
+			frame[start+i] ^= mask[i&3]
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	c.wmu.Lock()
+	_, err := c.Conn.Write(frame)
+	c.wmu.Unlock()
+	return err
+}
+
+// Close sends close frame and closes the connection.
+func (c *webSocketConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+		c.writeFrame(_WS_CLOSE, []byte{0x03, 0xe8}) // 1000 normal closure
+	})
+	return c.Conn.Close()
+}
+
+// webSocketListener completes websocket handshakes in background, connections
+// failed the handshake are closed.
+type webSocketListener struct {
+	net.Listener
+	path string
+
+	conns  chan net.Conn
+	done   chan struct{}
+	err    error
+	closed sync.Once
+}
+
+func newWebSocketListener(ln net.Listener, path string) *webSocketListener {
+	l := &webSocketListener{
+		Listener: ln,
+		path:     path,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	go l.serve()
+	return l
+}
+
+func (l *webSocketListener) serve() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.closeWithError(err)
+			return
+		}
+		go l.handshake(conn)
+	}
+}
+
+func (l *webSocketListener) handshake(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(_WS_HANDSHAKE_TIMEOUT))
+	ws, err := serverHandshake(conn, l.path)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	select {
+	case l.conns <- ws:
+	case <-l.done:
+		ws.Close()
+	}
+}
+
+func (l *webSocketListener) closeWithError(err error) {
+	l.closed.Do(func() {
+		l.err = err
+		close(l.done)
+	})
+}
+
+func (l *webSocketListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+func (l *webSocketListener) Close() error {
+	err := l.Listener.Close()
+	l.closeWithError(errors.New("use of closed network connection"))
+	return err
+}
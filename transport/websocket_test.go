@@ -0,0 +1,86 @@
+package transport
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cosiner/gohper/testing2"
+)
+
+func TestWebSocket(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	testing2.True(t, err == nil)
+	server := &Transport{Type: TYPE_WS, Path: "/secret"}
+	ln = server.Listen(ln)
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	client := &Transport{Type: TYPE_WS, Path: "/secret", Host: "cdn.example.com"}
+	conn, err := client.Dial(ln.Addr().String(), time.Second)
+	testing2.True(t, err == nil)
+	defer conn.Close()
+
+	for _, size := range []int{0, 1, 125, 126, 65535, 65536, 200000} {
+		data := bytes.Repeat([]byte{'x'}, size)
+		_, err = conn.Write(data)
+		testing2.True(t, err == nil)
+
+		echo := make([]byte, size)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = io.ReadFull(conn, echo)
+		testing2.True(t, err == nil)
+		testing2.True(t, bytes.Equal(data, echo))
+	}
+
+	client.Path = "/guess"
+	_, err = client.Dial(ln.Addr().String(), time.Second)
+	testing2.False(t, err == nil)
+}
+
+func TestWebSocketHeaderDeadline(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	testing2.True(t, err == nil)
+	tr := &Transport{Type: TYPE_WS, Path: "/"}
+	ln = tr.Listen(ln)
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	conn, err := tr.Dial(ln.Addr().String(), time.Second)
+	testing2.True(t, err == nil)
+	defer conn.Close()
+	server := (<-accepted).(*webSocketConn)
+	defer server.Close()
+
+	// deadline expires after first byte of header, it must not be lost
+	server.Conn.Write([]byte{_WS_FIN | _WS_BINARY})
+	conn.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	buf := make([]byte, 8)
+	_, err = conn.Read(buf)
+	testing2.True(t, err != nil && err.(net.Error).Timeout())
+
+	server.Conn.Write([]byte{3, 'a', 'b', 'c'})
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	testing2.True(t, err == nil && string(buf[:n]) == "abc")
+}